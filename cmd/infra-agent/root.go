@@ -3,14 +3,15 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/uverustech/infra-agent/internal/agent"
 	"github.com/uverustech/infra-agent/internal/config"
+	"github.com/uverustech/infra-agent/internal/install"
 	"github.com/uverustech/infra-agent/internal/setup"
 )
 
@@ -29,6 +30,20 @@ var (
 		RunE:  setup.RunFullSetup,
 	}
 
+	installCmd = &cobra.Command{
+		Use:   "install",
+		Short: "Provision this node: config, binary, systemd unit, setup and gateway config",
+		Args:  cobra.NoArgs,
+		RunE:  install.Run,
+	}
+
+	uninstallCmd = &cobra.Command{
+		Use:   "uninstall",
+		Short: "Decommission this node: notify the control plane and remove the agent and its managed setup",
+		Args:  cobra.NoArgs,
+		RunE:  install.Uninstall,
+	}
+
 	versionCmd = &cobra.Command{
 		Use:   "version",
 		Short: "Show current version",
@@ -41,30 +56,16 @@ var (
 		Use:   "update",
 		Short: "Self-update the agent to the latest version",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			controlURL := viper.GetString(config.KeyControlURL)
-			resp, err := http.Get(controlURL + "/api/agent/latest-version")
+			latest, err := agent.GetLatestVersion(config.GetString(config.KeyControlURL), version)
 			if err != nil {
 				return fmt.Errorf("failed to check for updates: %w", err)
 			}
-			defer resp.Body.Close()
-
-			if resp.StatusCode != 200 {
-				return fmt.Errorf("update check failed: HTTP %d", resp.StatusCode)
-			}
-
-			var v struct {
-				Version string `json:"version"`
-			}
-			if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
-				return fmt.Errorf("failed to decode response: %w", err)
-			}
-
-			if v.Version == "" {
+			if latest == "" {
 				return fmt.Errorf("control plane returned empty version")
 			}
 
 			// Simple normalization (remove 'v' prefix)
-			newVer := strings.TrimPrefix(v.Version, "v")
+			newVer := strings.TrimPrefix(latest, "v")
 			currVer := strings.TrimPrefix(version, "v")
 
 			if newVer == currVer {
@@ -72,39 +73,22 @@ var (
 				return nil
 			}
 
-			fmt.Printf("Updating agent %s → %s...\n", version, v.Version)
-			return agent.SelfUpdate(newVer, viper.GetBool(config.KeyVerbose))
+			fmt.Printf("Updating agent %s → %s...\n", version, latest)
+			return agent.SelfUpdate(newVer, config.GetBool(config.KeyVerbose))
 		},
 	}
 
 	configCmd = &cobra.Command{
 		Use:   "config",
 		Short: "Manage configuration",
-		Run: func(cmd *cobra.Command, args []string) {
-			settings := viper.AllSettings()
-			if len(settings) == 0 {
-				fmt.Println("No configuration found.")
-				return
-			}
-			fmt.Println("Current Configuration (Precedence: Flag > Env > Config > Default):")
-			for k, v := range settings {
-				source := "Default"
-				if viper.InConfig(k) {
-					source = "Config File"
-				}
-				if cmd.Flags().Changed(k) {
-					source = "Flag"
-				}
-				// Check env? Viper doesn't make it easy to see if it came from env specifically
+		RunE:  listConfig,
+	}
 
-				if strings.Contains(k, "token") {
-					fmt.Printf("  %-15s: %-20s (%s)\n", k, config.MaskSecret(fmt.Sprintf("%v", v)), source)
-				} else {
-					fmt.Printf("  %-15s: %-20s (%s)\n", k, v, source)
-				}
-			}
-			fmt.Printf("\nConfig file used: %s\n", viper.ConfigFileUsed())
-		},
+	configListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "Show every setting with its value and source",
+		Args:  cobra.NoArgs,
+		RunE:  listConfig,
 	}
 
 	configSetCmd = &cobra.Command{
@@ -112,8 +96,94 @@ var (
 		Short: "Set a configuration value",
 		Args:  cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			viper.Set(args[0], args[1])
-			return config.Save()
+			value, err := config.Coerce(args[0], args[1])
+			if err != nil {
+				return err
+			}
+			return config.Set(args[0], value)
+		},
+	}
+
+	configUnsetCmd = &cobra.Command{
+		Use:   "unset [key]",
+		Short: "Remove a value from the config file, restoring its default",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := config.CheckKey(args[0]); err != nil {
+				return err
+			}
+			removed, err := config.Unset(args[0])
+			if err != nil {
+				return err
+			}
+			if !removed {
+				fmt.Printf("%s is not set in %s\n", args[0], config.ConfigFileUsed())
+			}
+			if s := config.Resolve(args[0], nil); s.Source == "env" {
+				fmt.Printf("Note: %s is still set by %s\n", args[0], s.Origin)
+			}
+			return nil
+		},
+	}
+
+	configDiffCmd = &cobra.Command{
+		Use:   "diff",
+		Short: "Show the settings that differ from their defaults",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			changed, err := config.ChangedFromDefaults()
+			if err != nil {
+				return err
+			}
+			if len(changed) == 0 {
+				fmt.Println("All settings are at their defaults")
+				return nil
+			}
+			for _, key := range changed {
+				s := config.Resolve(key, cmd.Flags()).Masked()
+				def := config.Default(key)
+				if def == nil {
+					def = "(none)"
+				}
+				fmt.Printf("%s\n  - %s\n  + %s  (%s)\n", key, formatValue(def), formatValue(s.Value), sourceLabel(s))
+			}
+			return nil
+		},
+	}
+
+	configValidateCmd = &cobra.Command{
+		Use:   "validate",
+		Short: "Check the configuration for invalid values and unknown keys",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			unknown, err := config.UnknownKeys()
+			if err != nil {
+				return err
+			}
+			for _, key := range unknown {
+				msg := fmt.Sprintf("unknown key %q", key)
+				if s := config.Suggest(key); s != "" {
+					msg += fmt.Sprintf(", did you mean %q?", s)
+				}
+				fmt.Println("Warning: " + msg)
+			}
+			if _, err := config.Current(); err != nil {
+				return fmt.Errorf("configuration is invalid:\n%w", err)
+			}
+			fmt.Println("Configuration is valid")
+			return nil
+		},
+	}
+
+	configSchemaCmd = &cobra.Command{
+		Use:   "schema",
+		Short: "Print the JSON Schema of the config file",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			out, err := json.MarshalIndent(config.Schema(), "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(out))
+			return nil
 		},
 	}
 
@@ -121,8 +191,17 @@ var (
 		Use:   "get [key]",
 		Short: "Get a configuration value",
 		Args:  cobra.ExactArgs(1),
-		Run: func(cmd *cobra.Command, args []string) {
-			fmt.Println(viper.Get(args[0]))
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if config.IsSecret(args[0]) {
+				value, err := config.Secret(args[0])
+				if err != nil {
+					return err
+				}
+				fmt.Println(value)
+				return nil
+			}
+			fmt.Println(config.Get(args[0]))
+			return nil
 		},
 	}
 
@@ -147,6 +226,12 @@ var (
 		},
 	}
 
+	setupRevertHardeningCmd = &cobra.Command{
+		Use:   "revert-hardening",
+		Short: "Restore everything changed by the last hardening run",
+		RunE:  setup.RevertHardening,
+	}
+
 	statusCmd = &cobra.Command{
 		Use:   "status",
 		Short: "Show gateway status and drift information",
@@ -160,18 +245,72 @@ var (
 			fmt.Printf("Agent Version:  %s\n", status["agent_version"])
 			fmt.Printf("Local Git SHA:  %s\n", status["local_git_sha"])
 			fmt.Printf("Remote Git SHA: %s\n", status["remote_git_sha"])
+			if desired, _ := status["desired_git_sha"].(string); desired != "" {
+				fmt.Printf("Desired SHA:    %s (pinned by control plane)\n", desired)
+			}
+			if drift, ok := status["caddy_config_drift"].(bool); ok {
+				if drift {
+					fmt.Println("Caddy Config:   MODIFIED (running config differs from checkout)")
+				} else {
+					fmt.Println("Caddy Config:   IN SYNC")
+				}
+			}
+			if status["drained"].(bool) {
+				fmt.Printf("State:          DRAINED since %v", status["drained_since"])
+				if reason, _ := status["drain_reason"].(string); reason != "" {
+					fmt.Printf(" (%s)", reason)
+				}
+				fmt.Println()
+			} else {
+				fmt.Println("State:          IN SERVICE")
+			}
 			if status["drift"].(bool) {
-				fmt.Println("Status:         DRAINED (Drift detected! Run 'gateway pull' to sync)")
+				fmt.Println("Status:         OUT OF SYNC (Drift detected! Run 'gateway pull' to sync)")
 			} else {
 				fmt.Println("Status:         HEALTHY (Up to date)")
 			}
 			return nil
 		},
 	}
+
+	gatewayDrainCmd = &cobra.Command{
+		Use:   "drain",
+		Short: "Take the gateway out of service (fail /health, suspend auto-pull)",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			reason, _ := cmd.Flags().GetString("reason")
+			if err := agent.Drain(reason); err != nil {
+				return err
+			}
+			fmt.Println("Gateway drained: /health now fails and auto-pull is suspended")
+
+			if wait, _ := cmd.Flags().GetBool("wait"); wait {
+				maxConns, _ := cmd.Flags().GetInt("max-connections")
+				timeout, _ := cmd.Flags().GetDuration("timeout")
+				if err := agent.WaitForConnections(maxConns, timeout); err != nil {
+					return err
+				}
+				fmt.Println("Requests drained")
+			}
+			return nil
+		},
+	}
+
+	gatewayUndrainCmd = &cobra.Command{
+		Use:   "undrain",
+		Short: "Put the gateway back in service",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := agent.Undrain(); err != nil {
+				return err
+			}
+			fmt.Println("Gateway back in service")
+			return nil
+		},
+	}
 )
 
 func init() {
 	config.Init()
+	setup.AgentVersion = version
 
 	RootCmd.PersistentFlags().StringP(config.KeyNodeID, "i", "", "Node ID")
 	RootCmd.PersistentFlags().StringP(config.KeyNodeType, "t", "server", "Node Type (gateway, server)")
@@ -185,15 +324,36 @@ func init() {
 
 	RootCmd.AddCommand(versionCmd)
 	RootCmd.AddCommand(setupCmd)
+	RootCmd.AddCommand(installCmd)
+	RootCmd.AddCommand(uninstallCmd)
 	RootCmd.AddCommand(updateCmd)
 	RootCmd.AddCommand(configCmd)
 	RootCmd.AddCommand(gatewayCmd)
 
+	configCmd.AddCommand(configListCmd)
 	configCmd.AddCommand(configSetCmd)
+	configCmd.AddCommand(configUnsetCmd)
+	configCmd.AddCommand(configDiffCmd)
 	configCmd.AddCommand(configGetCmd)
+	configCmd.AddCommand(configValidateCmd)
+	configCmd.AddCommand(configSchemaCmd)
 	gatewayCmd.AddCommand(gatewayPullCmd)
 	gatewayCmd.AddCommand(gatewayReloadCmd)
 	gatewayCmd.AddCommand(statusCmd)
+	gatewayCmd.AddCommand(gatewayDrainCmd)
+	gatewayCmd.AddCommand(gatewayUndrainCmd)
+
+	install.Flags(installCmd)
+	for _, c := range []*cobra.Command{configCmd, configListCmd} {
+		c.Flags().Bool("json", false, "Print the settings as JSON")
+		c.Flags().Bool("show-secrets", false, "Print secret values instead of masking them")
+	}
+	install.UninstallFlags(uninstallCmd)
+
+	gatewayDrainCmd.Flags().String("reason", "", "Reason recorded with the drain")
+	gatewayDrainCmd.Flags().Bool("wait", false, "Wait for the requests Caddy is proxying to fall below --max-connections")
+	gatewayDrainCmd.Flags().Int("max-connections", 10, "Connection threshold for --wait")
+	gatewayDrainCmd.Flags().Duration("timeout", 5*time.Minute, "Maximum time to wait for connections to drain")
 
 	// Add setup subcommands
 	for _, step := range setup.Steps {
@@ -201,10 +361,68 @@ func init() {
 		sub := &cobra.Command{
 			Use:   stepCopy.Name,
 			Short: fmt.Sprintf("Run %s setup step", stepCopy.Name),
-			RunE:  stepCopy.Run,
+			RunE:  setup.StepCommand(stepCopy),
 		}
 		setupCmd.AddCommand(sub)
 	}
+	setupCmd.AddCommand(setupRevertHardeningCmd)
+	setupCmd.PersistentFlags().Bool("dry-run", false, "Print the planned changes without applying them")
+	setupCmd.PersistentFlags().StringP("output", "o", "text", "Plan output format for --dry-run (text, json)")
+	setupCmd.PersistentFlags().Bool("force", false, "Run steps even if their inputs are unchanged or dependencies are missing")
+	setupCmd.Flags().StringSlice("only", nil, "Run only these steps (comma-separated)")
+	setupCmd.Flags().StringSlice("skip", nil, "Skip these steps (comma-separated)")
+	setupCmd.Flags().Bool("resume", false, "Continue from the step that failed in the previous run")
+}
+
+// listConfig prints every setting with the source that won: a flag, an
+// environment variable, a line of the config file, or the default.
+func listConfig(cmd *cobra.Command, args []string) error {
+	settings := config.Settings(cmd.Flags())
+	if show, _ := cmd.Flags().GetBool("show-secrets"); !show {
+		for i := range settings {
+			settings[i] = settings[i].Masked()
+		}
+	}
+
+	if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+		out, err := json.MarshalIndent(settings, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	fmt.Println("Current Configuration (Precedence: Flag > Env > Config > Default):")
+	for _, s := range settings {
+		if s.Source == "unset" {
+			continue
+		}
+		fmt.Printf("  %-28s %-30s (%s)\n", s.Key, formatValue(s.Value), sourceLabel(s))
+	}
+	if file := config.ConfigFileUsed(); file != "" {
+		fmt.Printf("\nConfig file used: %s\n", file)
+	}
+	return nil
+}
+
+func sourceLabel(s config.Setting) string {
+	if s.Origin == "" {
+		return s.Source
+	}
+	return s.Source + ": " + s.Origin
+}
+
+// formatValue prints strings as they are and anything else as JSON.
+func formatValue(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(out)
 }
 
 func Execute() {
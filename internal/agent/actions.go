@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// controlMessage is a command pushed by the control plane.
+type controlMessage struct {
+	Type   string                 `json:"type"`
+	ID     string                 `json:"id,omitempty"`
+	Action string                 `json:"action"`
+	Params map[string]interface{} `json:"params,omitempty"`
+}
+
+// readControl consumes messages sent by the control plane on the websocket
+// until the connection fails.
+func readControl(conn *websocket.Conn) {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			log.Printf("[control] ws read error: %v", err)
+			wsMu.Lock()
+			if wsConn == conn {
+				wsConn.Close()
+				wsConn = nil
+			}
+			wsMu.Unlock()
+			return
+		}
+
+		var msg controlMessage
+		if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "action" {
+			continue
+		}
+		go func() {
+			result := map[string]interface{}{
+				"type":   "action_result",
+				"id":     msg.ID,
+				"action": msg.Action,
+				"ok":     true,
+			}
+			if err := handleAction(msg.Action, msg.Params); err != nil {
+				log.Printf("[control] action %s failed: %v", msg.Action, err)
+				result["ok"] = false
+				result["error"] = err.Error()
+			}
+			sendToControl(result)
+		}()
+	}
+}
+
+// handleAction runs a remote action by name.
+func handleAction(action string, params map[string]interface{}) error {
+	log.Printf("[control] running action %s", action)
+	switch action {
+	case "drain":
+		reason, _ := params["reason"].(string)
+		if err := Drain(reason); err != nil {
+			return err
+		}
+		if max, ok := params["max_connections"].(float64); ok {
+			timeout := 5 * time.Minute
+			if t, ok := params["timeout"].(string); ok {
+				if d, err := time.ParseDuration(t); err == nil {
+					timeout = d
+				}
+			}
+			return WaitForConnections(int(max), timeout)
+		}
+		return nil
+	case "undrain":
+		return Undrain()
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+}
@@ -14,10 +14,9 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/gorilla/websocket"
-	"github.com/spf13/viper"
 	"github.com/uverustech/infra-agent/internal/config"
+	"github.com/uverustech/infra-agent/internal/setup"
 )
 
 var (
@@ -33,42 +32,149 @@ var (
 
 func Run(v string) {
 	currentVersion = v
-	viper.OnConfigChange(func(e fsnotify.Event) {
-		log.Printf("Config file changed: %s. Re-applying settings...", e.Name)
-	})
-	viper.WatchConfig()
 
-	nodeID := viper.GetString(config.KeyNodeID)
-	nodeType := viper.GetString(config.KeyNodeType)
+	cfg, err := config.Current()
+	if err != nil {
+		log.Fatalf("Invalid configuration (see 'infra-agent config validate'):\n%v", err)
+	}
+	activeConfig = cfg
+	if unknown, _ := config.UnknownKeys(); len(unknown) > 0 {
+		log.Printf("Warning: unknown keys in %s: %s", config.ConfigFileUsed(), strings.Join(unknown, ", "))
+	}
+
+	nodeID := config.GetString(config.KeyNodeID)
+	nodeType := config.GetString(config.KeyNodeType)
 
 	if nodeID == "" {
 		log.Fatal("node-id is required. Set it permanently with: infra-agent config set node-id <name>\nOr use --node-id once, or set INFRA_NODE_ID environment variable.")
 	}
 
 	log.Printf("infra-agent %s starting — node: %s", currentVersion, nodeID)
+	if rev := config.RemoteRevision(); rev != "" {
+		log.Printf("[config] using remote config revision %s", rev)
+	}
+	sdNotify("READY=1\nSTATUS=starting")
 
 	if nodeType == "gateway" {
-		GitPull()
-		ValidateAndReload()
+		serveHealth()
+		if IsDrained() {
+			log.Println("[drain] node is drained, skipping initial pull and reload")
+		} else {
+			iteration(func() {
+				GitPull()
+				ValidateAndReload()
+			})
+		}
 	}
 
 	// Start log streaming in background
 	go streamLogs()
+	go reconcileSSHKeys()
+	watchReloadTriggers()
+
+	ticker := time.NewTicker(activeConfig.HeartbeatInterval)
+	for {
+		select {
+		case reason := <-reloadRequests:
+			iteration(func() { reloadConfig(reason, ticker) })
+			continue
+		case <-ticker.C:
+		}
+
+		iteration(func() {
+			if !heartbeatHasConfig {
+				syncRemoteConfig(ticker)
+			}
 
-	ticker := time.NewTicker(10 * time.Second)
-	for range ticker.C {
-		// Dynamic check: node type might have changed in config
-		currNodeType := viper.GetString(config.KeyNodeType)
-		if currNodeType == "gateway" && viper.GetBool(config.KeyAutoPull) {
-			GitPull()
-			ValidateAndReload()
+			// Dynamic check: node type might have changed in config
+			currNodeType := config.GetString(config.KeyNodeType)
+			if currNodeType == "gateway" && config.GetBool(config.KeyAutoPull) && !IsDrained() {
+				GitPull()
+				ValidateAndReload()
+			}
+			handleHeartbeatResponse(sendHeartbeat(), ticker)
+		})
+		notifyAlive()
+
+		// Every call above has a deadline, but an iteration can still outlast
+		// the interval. A tick that fired meanwhile is dropped rather than
+		// starting the next iteration straight away.
+		select {
+		case <-ticker.C:
+			log.Println("[agent] iteration overran the interval, skipping a tick")
+		default:
 		}
-		sendHeartbeat()
+	}
+}
+
+// sshReconcileWake cuts the wait between reconciles short, e.g. when the
+// key sources or the interval changed.
+var sshReconcileWake = make(chan struct{}, 1)
+
+func wakeSSHReconcile() {
+	select {
+	case sshReconcileWake <- struct{}{}:
+	default:
+	}
+}
+
+// reconcileSSHKeys keeps the managed authorized_keys blocks, the trusted CA
+// and the principals in sync with their sources, so that revoking access
+// reaches every node. Only steps that setup applied on this node are
+// reconciled; a node whose operator declined them is left alone.
+func reconcileSSHKeys() {
+	for {
+		interval := config.GetDuration(config.KeySSHKeysReconcile)
+		if interval <= 0 {
+			<-sshReconcileWake
+			continue
+		}
+		if setup.StepSucceeded("ssh") {
+			applied, err := setup.ReconcileSSHKeys()
+			if err != nil {
+				log.Printf("[ssh] key reconcile failed: %v", err)
+			}
+			for _, change := range applied {
+				log.Printf("[ssh] %s", change)
+			}
+		}
+		if setup.StepSucceeded("ssh-ca") {
+			applied, err := setup.ReconcileSSHCA()
+			if err != nil {
+				log.Printf("[ssh] CA reconcile failed: %v", err)
+			}
+			for _, change := range applied {
+				log.Printf("[ssh] %s", change)
+			}
+		}
+		select {
+		case <-time.After(interval):
+		case <-sshReconcileWake:
+		}
+	}
+}
+
+var (
+	logsMu  sync.Mutex
+	logsCmd *exec.Cmd
+)
+
+// restartLogs stops journalctl; streamLogs starts it again with the current
+// log-units.
+func restartLogs() {
+	logsMu.Lock()
+	defer logsMu.Unlock()
+	if logsCmd != nil && logsCmd.Process != nil {
+		logsCmd.Process.Kill()
 	}
 }
 
 func streamLogs() {
-	cmd := exec.Command("journalctl", "-f", "-o", "json", "-n", "0")
+	args := []string{"-f", "-o", "json", "-n", "0"}
+	for _, unit := range config.GetStringSlice(config.KeyLogUnits) {
+		args = append(args, "-u", unit)
+	}
+	cmd := exec.Command("journalctl", args...)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		log.Printf("[logs] failed to create stdout pipe: %v", err)
@@ -84,6 +190,9 @@ func streamLogs() {
 		return
 	}
 
+	logsMu.Lock()
+	logsCmd = cmd
+	logsMu.Unlock()
 	log.Println("[logs] started streaming from system journal")
 
 	scanner := bufio.NewScanner(stdout)
@@ -145,6 +254,7 @@ func sendToControl(logData interface{}) {
 	}
 
 	msgJSON, _ := json.Marshal(logData)
+	wsConn.SetWriteDeadline(time.Now().Add(config.GetDuration(config.KeyTimeoutHTTP)))
 	err := wsConn.WriteMessage(websocket.TextMessage, msgJSON)
 	if err != nil {
 		log.Printf("[logs] ws write error: %v, reconnecting...", err)
@@ -153,14 +263,25 @@ func sendToControl(logData interface{}) {
 	}
 }
 
+// closeWS drops the control plane connection; the next log line reconnects
+// with the current settings.
+func closeWS() {
+	wsMu.Lock()
+	defer wsMu.Unlock()
+	if wsConn != nil {
+		wsConn.Close()
+		wsConn = nil
+	}
+}
+
 func connectWS() error {
-	nodeID := viper.GetString(config.KeyNodeID)
-	controlURL := viper.GetString(config.KeyControlURL)
+	nodeID := config.GetString(config.KeyNodeID)
+	controlURL := config.GetString(config.KeyControlURL)
 	u := strings.Replace(controlURL, "https://", "wss://", 1) + "/api/logs/stream"
 	header := http.Header{}
 	header.Add("X-Node-ID", nodeID)
 
-	dialer := websocket.DefaultDialer
+	dialer := &websocket.Dialer{Proxy: http.ProxyFromEnvironment, HandshakeTimeout: config.GetDuration(config.KeyTimeoutHTTP)}
 	conn, _, err := dialer.Dial(u, header)
 	if err != nil {
 		log.Printf("[logs] ws connection failed: %v", err)
@@ -168,100 +289,95 @@ func connectWS() error {
 	}
 	log.Printf("[logs] connected to control plane: %s", u)
 	wsConn = conn
+	go readControl(conn)
 	return nil
 }
 
+// GitPull fetches gtw-config and checks out the commit the control plane
+// wants this node on, or the head of the tracked branch if none is pinned.
 func GitPull() {
-	configDir := "/etc/caddy"
-	cmd := exec.Command("git", "-C", configDir, "pull", "--ff-only")
+	configDir := gatewayConfigDir
+	pullError = ""
 
-	output, err := cmd.CombinedOutput()
+	out, err := command(config.KeyTimeoutGitRemote, "git", "-C", configDir, "fetch", "--quiet", "origin").CombinedOutput()
 	if err != nil {
-		log.Printf("Git pull failed: %v\n%s", err, string(output))
+		log.Printf("Git fetch failed: %v\n%s", err, string(out))
+		pullError = failure("git fetch", err, out)
 		return
 	}
 
-	if bytes.Contains(output, []byte("Already up to date")) {
+	target, err := resolveTarget(configDir, fetchDesiredSHA())
+	if err != nil {
+		log.Printf("[deploy] %v", err)
+		pullError = err.Error()
 		return
 	}
 
-	log.Printf("Config updated via git pull:\n%s", string(output))
+	head := gitHead(configDir)
+	if head == target {
+		return
+	}
+
+	if err := verifyCommits(configDir, head, target); err != nil {
+		log.Printf("[verify] %v", err)
+		pullError = err.Error()
+		return
+	}
+
+	out, err = command(config.KeyTimeoutGit, "git", "-C", configDir, "checkout", "--quiet", "--detach", target).CombinedOutput()
+	if err != nil {
+		log.Printf("Git checkout of %s failed: %v\n%s", target, err, string(out))
+		pullError = failure("git checkout", err, out)
+		return
+	}
+
+	log.Printf("Config updated: %s → %s", shortSHA(head), shortSHA(target))
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 12 {
+		return sha[:12]
+	}
+	return sha
 }
 
 func ValidateAndReload() {
-	caddyfile := "/etc/caddy/Caddyfile"
 	lastError = ""
-	out, err := exec.Command("caddy", "validate", "--config", caddyfile).CombinedOutput()
+
+	admin := newCaddyAdmin()
+	caddyfile, err := prepareCaddyfile(admin)
 	if err != nil {
-		log.Printf("Validation failed: %v\n%s", err, string(out))
-		lastError = string(out)
+		log.Printf("[template] %v", err)
+		lastError = err.Error()
 		heartbeatOK = false
 		return
 	}
 
-	out, err = exec.Command("caddy", "reload", "--config", caddyfile).CombinedOutput()
+	if admin != nil {
+		err = reloadViaAdmin(admin, caddyfile)
+	} else {
+		err = reloadViaCLI(caddyfile)
+	}
 	if err != nil {
-		log.Printf("Reload failed: %v\n%s", err, string(out))
-		lastError = string(out)
+		log.Printf("Reload failed: %v", err)
+		lastError = err.Error()
 		heartbeatOK = false
+		reportDeployment(gatewayConfigDir, false)
 		return
 	}
 
+	resetCaddyVersion()
 	log.Println("Caddy reloaded successfully")
 	heartbeatOK = true
+	reportDeployment(gatewayConfigDir, true)
 }
 
-func sendHeartbeat() {
-	nodeID := viper.GetString(config.KeyNodeID)
-	nodeType := viper.GetString(config.KeyNodeType)
-	controlURL := viper.GetString(config.KeyControlURL)
-	configDir := "/etc/caddy"
-
-	sha, _ := exec.Command("git", "-C", configDir, "rev-parse", "HEAD").Output()
-	isHealthy, summary, healthData := getSystemMetrics(nodeType)
-
-	payload := map[string]interface{}{
-		"node_id":        nodeID,
-		"git_sha":        string(bytes.TrimSpace(sha)),
-		"agent_version":  currentVersion,
-		"caddy_version":  getCaddyVersion(),
-		"last_reload_ok": heartbeatOK,
-		"last_error":     lastError,
-		"node_type":      nodeType,
-		"is_healthy":     isHealthy,
-		"health_summary": summary,
-		"health_data":    healthData,
-		"timestamp":      time.Now().UTC().Format(time.RFC3339),
-	}
-	jsonBody, _ := json.Marshal(payload)
-	resp, err := http.Post(controlURL+"/api/heartbeat", "application/json", bytes.NewReader(jsonBody))
-	if err != nil {
-		log.Printf("[heartbeat] failed: %v", err)
-	} else {
-		if resp.StatusCode != 200 {
-			log.Printf("[heartbeat] server error: %s", resp.Status)
-		}
-		resp.Body.Close()
-	}
-
-	// Check for updates
-	resp, err = http.Get(controlURL + "/api/agent/latest-version")
-	if err == nil && resp.StatusCode == 200 {
-		defer resp.Body.Close()
-		var v struct {
-			Version string `json:"version"`
-		}
-		if json.NewDecoder(resp.Body).Decode(&v) == nil && v.Version != "" && v.Version != currentVersion {
-			tag := strings.TrimPrefix(v.Version, "v")
-			log.Printf("[update] triggering update %s → %s", currentVersion, v.Version)
-			go func() {
-				if err := SelfUpdate(tag, viper.GetBool(config.KeyVerbose)); err != nil {
-					log.Printf("[update] error: %v", err)
-				}
-			}()
-		}
-		resp.Body.Close()
+// lastErrorMessage combines pull and reload failures for reporting.
+func lastErrorMessage() string {
+	if pullError != "" && lastError != "" {
+		return pullError + "\n" + lastError
 	}
+	return pullError + lastError
 }
 
 func getSystemMetrics(nodeType string) (bool, string, map[string]interface{}) {
@@ -305,13 +421,51 @@ func getSystemMetrics(nodeType string) (bool, string, map[string]interface{}) {
 		data["uptime"] = uptime
 	}
 
-	// 5. Node Type specific checks
+	// 5. Clock offset
+	offset, err := getClockOffset()
+	if err == nil {
+		data["clock_offset_ms"] = offset.Milliseconds()
+		threshold := config.GetDuration(config.KeyClockDriftThreshold)
+		if threshold > 0 && (offset > threshold || offset < -threshold) {
+			isHealthy = false
+			summaryParts = append(summaryParts, fmt.Sprintf("Clock drift %s", offset.Round(time.Millisecond)))
+		}
+	}
+
+	// 6. Provisioning state
+	if rep := setup.LatestReportSummary(); rep != nil && rep.Status != "complete" {
+		summaryParts = append(summaryParts, fmt.Sprintf("Setup %s (pending: %s)", rep.Status, strings.Join(rep.PendingSteps, ", ")))
+	}
+
+	// 7. Node Type specific checks
 	if nodeType == "gateway" {
 		data["caddy_ok"] = heartbeatOK
 		if !heartbeatOK {
 			isHealthy = false
 			summaryParts = append(summaryParts, "Caddy reload failed")
 		}
+
+		if admin := newCaddyAdmin(); admin != nil {
+			if drift, err := detectConfigDrift(admin, caddyfilePath()); err == nil {
+				data["caddy_config_drift"] = drift
+				if drift {
+					summaryParts = append(summaryParts, "Running Caddy config differs from checkout")
+				}
+			}
+
+			if ups, err := admin.upstreams(); err == nil {
+				data["upstreams"] = ups
+				failing := []string{}
+				for _, u := range ups {
+					if fails, ok := u["fails"].(float64); ok && fails > 0 {
+						failing = append(failing, fmt.Sprintf("%v", u["address"]))
+					}
+				}
+				if len(failing) > 0 {
+					summaryParts = append(summaryParts, "Upstreams failing: "+strings.Join(failing, ", "))
+				}
+			}
+		}
 	}
 
 	summary := "All systems nominal"
@@ -395,13 +549,8 @@ func getUptime() (string, error) {
 	return fmt.Sprintf("%dm", minutes), nil
 }
 
-func getCaddyVersion() string {
-	out, _ := exec.Command("caddy", "version").Output()
-	return string(bytes.TrimSpace(out))
-}
-
 func GetLatestVersion(controlURL, currentVersion string) (string, error) {
-	resp, err := http.Get(controlURL + "/api/agent/latest-version")
+	resp, err := httpClient().Get(controlURL + "/api/agent/latest-version")
 	if err != nil {
 		return "", err
 	}
@@ -421,16 +570,20 @@ func GetLatestVersion(controlURL, currentVersion string) (string, error) {
 }
 
 func GetStatus() (map[string]interface{}, error) {
-	nodeID := viper.GetString(config.KeyNodeID)
-	nodeType := viper.GetString(config.KeyNodeType)
-	configDir := "/etc/caddy"
+	nodeID := config.GetString(config.KeyNodeID)
+	nodeType := config.GetString(config.KeyNodeType)
+	configDir := gatewayConfigDir
 
-	localSha, _ := exec.Command("git", "-C", configDir, "rev-parse", "HEAD").Output()
+	localSha, _ := command(config.KeyTimeoutGit, "git", "-C", configDir, "rev-parse", "HEAD").Output()
 	localShaStr := string(bytes.TrimSpace(localSha))
 
 	// Get remote SHA (ls-remote is fast and doesn't pull)
 	remoteShaStr := "unknown"
-	remoteCmd := exec.Command("git", "-C", configDir, "ls-remote", "origin", "HEAD")
+	remoteRef := "HEAD"
+	if branch := config.GetString(config.KeyConfigBranch); branch != "" {
+		remoteRef = "refs/heads/" + branch
+	}
+	remoteCmd := command(config.KeyTimeoutGitRemote, "git", "-C", configDir, "ls-remote", "origin", remoteRef)
 	if out, err := remoteCmd.CombinedOutput(); err == nil {
 		parts := strings.Fields(string(out))
 		if len(parts) > 0 {
@@ -440,12 +593,37 @@ func GetStatus() (map[string]interface{}, error) {
 		log.Printf("[status] failed to get remote sha: %v\n%s", err, string(out))
 	}
 
-	return map[string]interface{}{
-		"node_id":        nodeID,
-		"node_type":      nodeType,
-		"agent_version":  currentVersion,
-		"local_git_sha":  localShaStr,
-		"remote_git_sha": remoteShaStr,
-		"drift":          localShaStr != remoteShaStr && remoteShaStr != "unknown",
-	}, nil
+	// A pinned SHA from the control plane is the target, not branch head.
+	desired := fetchDesiredSHA()
+	drift := localShaStr != remoteShaStr && remoteShaStr != "unknown"
+	if desired != "" {
+		drift = !strings.HasPrefix(localShaStr, desired)
+	}
+
+	status := map[string]interface{}{
+		"node_id":         nodeID,
+		"node_type":       nodeType,
+		"agent_version":   currentVersion,
+		"local_git_sha":   localShaStr,
+		"remote_git_sha":  remoteShaStr,
+		"desired_git_sha": desired,
+		"drift":           drift,
+		"drained":         false,
+	}
+
+	if st := DrainInfo(); st != nil {
+		status["drained"] = true
+		status["drained_since"] = st.Since
+		status["drain_reason"] = st.Reason
+	}
+
+	if admin := newCaddyAdmin(); admin != nil && nodeType == "gateway" {
+		if drift, err := detectConfigDrift(admin, caddyfilePath()); err == nil {
+			status["caddy_config_drift"] = drift
+		} else {
+			log.Printf("[status] failed to compare running caddy config: %v", err)
+		}
+	}
+
+	return status, nil
 }
@@ -0,0 +1,231 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+var (
+	caddyVersionMu     sync.Mutex
+	caddyVersionCached string
+
+	// caddyAdminCached is reused while caddy-admin keeps its value, so its
+	// connections are too.
+	caddyAdminMu     sync.Mutex
+	caddyAdminCached *caddyAdmin
+)
+
+// caddyAdmin is a minimal client for the Caddy admin API.
+type caddyAdmin struct {
+	addr   string
+	client *http.Client
+	base   string
+}
+
+// newCaddyAdmin returns the client for the caddy-admin setting, built on
+// first use and whenever the setting changes. It returns nil when the admin
+// API is disabled, in which case callers fall back to the CLI.
+//
+// Accepted forms: "localhost:2019", "http://10.0.0.1:2019" and
+// "unix//run/caddy/admin.sock".
+func newCaddyAdmin() *caddyAdmin {
+	addr := strings.TrimSpace(config.GetString(config.KeyCaddyAdmin))
+	if addr == "" || addr == "off" {
+		return nil
+	}
+
+	caddyAdminMu.Lock()
+	defer caddyAdminMu.Unlock()
+	if caddyAdminCached != nil {
+		if caddyAdminCached.addr == addr {
+			return caddyAdminCached
+		}
+		caddyAdminCached.client.CloseIdleConnections()
+	}
+
+	transport := &http.Transport{}
+	base := addr
+	if strings.HasPrefix(addr, "unix/") {
+		socket := strings.TrimPrefix(addr, "unix/")
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+		// Caddy only accepts a loopback Host header on unix sockets.
+		base = "http://127.0.0.1"
+	} else if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		base = "http://" + addr
+	}
+
+	// The deadline is set per request, as caddy-timeout may change.
+	caddyAdminCached = &caddyAdmin{
+		addr:   addr,
+		client: &http.Client{Transport: transport},
+		base:   strings.TrimSuffix(base, "/"),
+	}
+	return caddyAdminCached
+}
+
+func (c *caddyAdmin) do(method, path, contentType string, body []byte) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout(config.KeyTimeoutCaddy))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return out, fmt.Errorf("caddy admin %s %s: HTTP %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+// adapt converts a Caddyfile to Caddy's native JSON config.
+func (c *caddyAdmin) adapt(caddyfile []byte) ([]byte, error) {
+	out, err := c.do(http.MethodPost, "/adapt", "text/caddyfile", caddyfile)
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(out, &res); err != nil {
+		return nil, fmt.Errorf("invalid adapt response: %w", err)
+	}
+	return res.Result, nil
+}
+
+// load replaces the running config. Caddy provisions the new config fully
+// before swapping, so an invalid config leaves the old one running.
+func (c *caddyAdmin) load(cfg []byte) error {
+	_, err := c.do(http.MethodPost, "/load", "application/json", cfg)
+	return err
+}
+
+// runningConfig returns the config Caddy is currently serving.
+func (c *caddyAdmin) runningConfig() ([]byte, error) {
+	return c.do(http.MethodGet, "/config/", "", nil)
+}
+
+// upstreams returns the reverse proxy upstream status as reported by Caddy.
+func (c *caddyAdmin) upstreams() ([]map[string]interface{}, error) {
+	out, err := c.do(http.MethodGet, "/reverse_proxy/upstreams", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	var ups []map[string]interface{}
+	if err := json.Unmarshal(out, &ups); err != nil {
+		return nil, fmt.Errorf("invalid upstreams response: %w", err)
+	}
+	return ups, nil
+}
+
+// reloadViaAdmin adapts the Caddyfile and loads the result through the admin API.
+func reloadViaAdmin(admin *caddyAdmin, caddyfile string) error {
+	src, err := os.ReadFile(caddyfile)
+	if err != nil {
+		return err
+	}
+	cfg, err := admin.adapt(src)
+	if err != nil {
+		return err
+	}
+	return admin.load(cfg)
+}
+
+// reloadViaCLI is the fallback used when the admin API is disabled.
+func reloadViaCLI(caddyfile string) error {
+	out, err := command(config.KeyTimeoutCaddy, "caddy", "validate", "--config", caddyfile, "--adapter", "caddyfile").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("validation failed: %v\n%s", err, string(out))
+	}
+	out, err = command(config.KeyTimeoutCaddy, "caddy", "reload", "--config", caddyfile, "--adapter", "caddyfile").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("reload failed: %v\n%s", err, string(out))
+	}
+	return nil
+}
+
+// detectConfigDrift reports whether the config Caddy is serving differs from
+// what the Caddyfile in the git checkout adapts to, i.e. someone changed the
+// running config out-of-band.
+func detectConfigDrift(admin *caddyAdmin, caddyfile string) (bool, error) {
+	src, err := os.ReadFile(caddyfile)
+	if err != nil {
+		return false, err
+	}
+	want, err := admin.adapt(src)
+	if err != nil {
+		return false, err
+	}
+	have, err := admin.runningConfig()
+	if err != nil {
+		return false, err
+	}
+
+	wantNorm, err := normalizeJSON(want)
+	if err != nil {
+		return false, err
+	}
+	haveNorm, err := normalizeJSON(have)
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(wantNorm, haveNorm), nil
+}
+
+// normalizeJSON re-encodes a JSON document so that key order and whitespace
+// do not affect comparisons.
+func normalizeJSON(b []byte) ([]byte, error) {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// getCaddyVersion returns the installed Caddy version. The admin API does not
+// expose it, so the CLI is queried once and cached until the next reload.
+func getCaddyVersion() string {
+	caddyVersionMu.Lock()
+	defer caddyVersionMu.Unlock()
+
+	if caddyVersionCached == "" {
+		out, _ := command(config.KeyTimeoutCaddy, "caddy", "version").Output()
+		caddyVersionCached = string(bytes.TrimSpace(out))
+	}
+	return caddyVersionCached
+}
+
+func resetCaddyVersion() {
+	caddyVersionMu.Lock()
+	caddyVersionCached = ""
+	caddyVersionMu.Unlock()
+}
@@ -0,0 +1,217 @@
+package agent
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/uverustech/infra-agent/internal/config"
+	"github.com/uverustech/infra-agent/internal/timedexec"
+)
+
+// fakeCaddy mimics the parts of the Caddy admin API the agent uses. A
+// Caddyfile containing "invalid" fails to adapt, a config containing "broken"
+// fails to load.
+type fakeCaddy struct {
+	running   []byte
+	loads     int
+	upstreams string
+}
+
+func (f *fakeCaddy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/adapt":
+		if r.Header.Get("Content-Type") != "text/caddyfile" {
+			http.Error(w, `{"error":"unsupported content type"}`, http.StatusBadRequest)
+			return
+		}
+		if strings.Contains(string(body), "invalid") {
+			http.Error(w, `{"error":"adapting config using caddyfile: unrecognized directive: invalid"}`, http.StatusBadRequest)
+			return
+		}
+		site := strings.TrimSpace(strings.SplitN(string(body), "{", 2)[0])
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"result": map[string]interface{}{"apps": map[string]interface{}{"http": map[string]interface{}{"site": site}}},
+		})
+	case r.Method == http.MethodPost && r.URL.Path == "/load":
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, `{"error":"unsupported content type"}`, http.StatusBadRequest)
+			return
+		}
+		if strings.Contains(string(body), "broken") {
+			http.Error(w, `{"error":"loading config: provisioning app http: broken"}`, http.StatusBadRequest)
+			return
+		}
+		f.running = body
+		f.loads++
+	case r.Method == http.MethodGet && r.URL.Path == "/config/":
+		w.Write(f.running)
+	case r.Method == http.MethodGet && r.URL.Path == "/reverse_proxy/upstreams":
+		io.WriteString(w, f.upstreams)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func useCaddyAdmin(t *testing.T, addr string) *caddyAdmin {
+	t.Helper()
+	t.Cleanup(viper.Reset)
+	viper.Set(config.KeyCaddyAdmin, addr)
+	viper.Set(config.KeyTimeoutCaddy, "5s")
+	admin := newCaddyAdmin()
+	if admin == nil {
+		t.Fatalf("newCaddyAdmin() = nil for %q", addr)
+	}
+	return admin
+}
+
+func writeCaddyfile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "Caddyfile")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReloadViaAdmin(t *testing.T) {
+	fake := &fakeCaddy{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	admin := useCaddyAdmin(t, srv.URL)
+
+	if err := reloadViaAdmin(admin, writeCaddyfile(t, "example.com {\n}\n")); err != nil {
+		t.Fatal(err)
+	}
+	if fake.loads != 1 || !strings.Contains(string(fake.running), `"site":"example.com"`) {
+		t.Fatalf("loaded %d configs, running %s", fake.loads, fake.running)
+	}
+
+	drift, err := detectConfigDrift(admin, writeCaddyfile(t, "example.com {\n}\n"))
+	if err != nil || drift {
+		t.Errorf("detectConfigDrift() = %v, %v for the loaded Caddyfile", drift, err)
+	}
+	drift, err = detectConfigDrift(admin, writeCaddyfile(t, "other.example.com {\n}\n"))
+	if err != nil || !drift {
+		t.Errorf("detectConfigDrift() = %v, %v for a changed Caddyfile", drift, err)
+	}
+}
+
+func TestReloadViaAdminErrors(t *testing.T) {
+	fake := &fakeCaddy{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	admin := useCaddyAdmin(t, srv.URL)
+
+	err := reloadViaAdmin(admin, writeCaddyfile(t, "example.com {\n\tinvalid\n}\n"))
+	if err == nil || !strings.Contains(err.Error(), "POST /adapt: HTTP 400") ||
+		!strings.Contains(err.Error(), "unrecognized directive") {
+		t.Errorf("adapt error = %v", err)
+	}
+
+	err = reloadViaAdmin(admin, writeCaddyfile(t, "broken.example.com {\n}\n"))
+	if err == nil || !strings.Contains(err.Error(), "POST /load: HTTP 400") {
+		t.Errorf("load error = %v", err)
+	}
+	if fake.loads != 0 {
+		t.Errorf("a failed reload loaded %d configs", fake.loads)
+	}
+
+	if err := reloadViaAdmin(admin, filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Errorf("missing Caddyfile error = %v", err)
+	}
+
+	srv.Close()
+	if err := reloadViaAdmin(admin, writeCaddyfile(t, "example.com {\n}\n")); err == nil {
+		t.Error("reload succeeded with the admin API down")
+	}
+}
+
+func TestCaddyAdminUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeCaddy{}
+	srv := httptest.NewUnstartedServer(fake)
+	srv.Listener = ln
+	srv.Start()
+	defer srv.Close()
+
+	admin := useCaddyAdmin(t, "unix/"+socket)
+	if err := reloadViaAdmin(admin, writeCaddyfile(t, "example.com {\n}\n")); err != nil {
+		t.Fatal(err)
+	}
+	if fake.loads != 1 {
+		t.Errorf("loaded %d configs over the socket", fake.loads)
+	}
+}
+
+func TestCaddyAdminReused(t *testing.T) {
+	slow := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-slow
+	}))
+	defer srv.Close()
+	defer close(slow)
+
+	admin := useCaddyAdmin(t, srv.URL)
+	if again := newCaddyAdmin(); again != admin {
+		t.Error("a second call built a new client for the same caddy-admin")
+	}
+
+	// caddy-timeout applies to the cached client as it changes.
+	viper.Set(config.KeyTimeoutCaddy, "50ms")
+	if _, err := newCaddyAdmin().runningConfig(); !timedexec.IsTimeout(err) {
+		t.Errorf("runningConfig() = %v, want a timeout", err)
+	}
+
+	viper.Set(config.KeyCaddyAdmin, "localhost:2019")
+	other := newCaddyAdmin()
+	if other == admin || other.base != "http://localhost:2019" {
+		t.Errorf("changed caddy-admin returned %+v", other)
+	}
+}
+
+func TestCaddyAdminOff(t *testing.T) {
+	t.Cleanup(viper.Reset)
+	viper.Set(config.KeyCaddyAdmin, "off")
+	if admin := newCaddyAdmin(); admin != nil {
+		t.Errorf("newCaddyAdmin() = %+v with the admin API off", admin)
+	}
+}
+
+func TestActiveConnections(t *testing.T) {
+	fake := &fakeCaddy{upstreams: `[
+		{"address": "10.0.0.1:8080", "num_requests": 3, "fails": 0},
+		{"address": "10.0.0.2:8080", "num_requests": 0, "fails": 1},
+		{"address": "unix//run/app.sock", "num_requests": 4, "fails": 0}
+	]`}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	useCaddyAdmin(t, srv.URL)
+
+	if n, err := activeConnections(); err != nil || n != 7 {
+		t.Errorf("activeConnections() = %d, %v, want 7", n, err)
+	}
+	if err := WaitForConnections(8, 0); err != nil {
+		t.Errorf("WaitForConnections(8) = %v", err)
+	}
+	if err := WaitForConnections(7, 0); err == nil || !strings.Contains(err.Error(), "still 7 active requests") {
+		t.Errorf("WaitForConnections(7) = %v", err)
+	}
+
+	srv.Close()
+	if _, err := activeConnections(); err == nil {
+		t.Error("activeConnections() succeeded with the admin API down")
+	}
+}
@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+// ntpEpochOffset is the number of seconds between 1900-01-01 and 1970-01-01.
+const ntpEpochOffset = 2208988800
+
+// The offset is cached; querying NTP on every 10s tick is unnecessary.
+const clockCheckInterval = 5 * time.Minute
+
+var (
+	clockMu      sync.Mutex
+	clockOffset  time.Duration
+	clockChecked time.Time
+	clockErr     error
+)
+
+// getClockOffset returns how far the local clock is from the first reachable
+// NTP server. Positive means the local clock is behind.
+func getClockOffset() (time.Duration, error) {
+	clockMu.Lock()
+	defer clockMu.Unlock()
+
+	if time.Since(clockChecked) < clockCheckInterval {
+		return clockOffset, clockErr
+	}
+	clockChecked = time.Now()
+
+	servers := config.GetStringSlice(config.KeyNTPServers)
+	if len(servers) == 0 {
+		clockErr = fmt.Errorf("no ntp-servers configured")
+		return 0, clockErr
+	}
+
+	for _, s := range servers {
+		offset, err := queryNTP(s)
+		if err == nil {
+			clockOffset, clockErr = offset, nil
+			return offset, nil
+		}
+		clockErr = err
+	}
+	return 0, clockErr
+}
+
+// resetClockCheck makes the next getClockOffset query NTP again, e.g. after
+// ntp-servers changed.
+func resetClockCheck() {
+	clockMu.Lock()
+	clockChecked = time.Time{}
+	clockMu.Unlock()
+}
+
+// queryNTP performs a single SNTP (RFC 4330) request and computes the clock
+// offset from the four timestamps.
+func queryNTP(server string) (time.Duration, error) {
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(server, "123"), 3*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	req := make([]byte, 48)
+	req[0] = 0x23 // LI=0, VN=4, Mode=3 (client)
+
+	t1 := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	resp := make([]byte, 48)
+	if _, err := conn.Read(resp); err != nil {
+		return 0, err
+	}
+	t4 := time.Now()
+
+	if resp[0]&0x07 != 4 {
+		return 0, fmt.Errorf("ntp %s: unexpected mode in response", server)
+	}
+	if resp[1] == 0 {
+		return 0, fmt.Errorf("ntp %s: kiss-of-death response", server)
+	}
+
+	t2 := ntpTime(resp[32:40])
+	t3 := ntpTime(resp[40:48])
+	return (t2.Sub(t1) + t3.Sub(t4)) / 2, nil
+}
+
+func ntpTime(b []byte) time.Time {
+	secs := int64(binary.BigEndian.Uint32(b[0:4])) - ntpEpochOffset
+	frac := int64(binary.BigEndian.Uint32(b[4:8]))
+	return time.Unix(secs, (frac*1e9)>>32)
+}
@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+var (
+	// desiredSHA is the gtw-config commit the control plane wants this node
+	// to run. Empty means track the branch head.
+	desiredSHA string
+	// pullError holds the last GitPull failure, e.g. a refused desired SHA.
+	pullError string
+
+	appliedSHA   string
+	lastProbes   []probeResult
+	lastDeployed string
+)
+
+type probeResult struct {
+	URL       string `json:"url"`
+	Status    int    `json:"status,omitempty"`
+	OK        bool   `json:"ok"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// fetchDesiredSHA asks the control plane which commit this node should run.
+// If the control plane is unreachable the previous answer is kept, so a
+// pinned canary does not jump to branch head while offline.
+func fetchDesiredSHA() string {
+	// The heartbeat response already carries it.
+	if heartbeatHasDesiredSHA {
+		return desiredSHA
+	}
+	controlURL := config.GetString(config.KeyControlURL)
+	nodeID := config.GetString(config.KeyNodeID)
+
+	resp, err := httpClient().Get(controlURL + "/api/nodes/" + url.PathEscape(nodeID) + "/desired-config")
+	if err != nil {
+		log.Printf("[deploy] failed to fetch desired sha: %v", err)
+		return desiredSHA
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		desiredSHA = ""
+		return desiredSHA
+	default:
+		log.Printf("[deploy] desired sha request failed: %s", resp.Status)
+		return desiredSHA
+	}
+
+	var body struct {
+		SHA string `json:"sha"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		log.Printf("[deploy] invalid desired sha response: %v", err)
+		return desiredSHA
+	}
+	desiredSHA = strings.TrimSpace(body.SHA)
+	return desiredSHA
+}
+
+// trackedRef is the remote-tracking ref the gateway follows.
+func trackedRef() string {
+	if branch := config.GetString(config.KeyConfigBranch); branch != "" {
+		return "origin/" + branch
+	}
+	return "origin/HEAD"
+}
+
+// resolveTarget returns the commit the checkout should be at after a fetch.
+// A desired SHA is only accepted if it is reachable from the tracked branch,
+// so the control plane cannot be used to deploy arbitrary commits.
+func resolveTarget(configDir, desired string) (string, error) {
+	ref := trackedRef()
+	if desired == "" {
+		out, err := command(config.KeyTimeoutGit, "git", "-C", configDir, "rev-parse", ref+"^{commit}").Output()
+		if err != nil {
+			return "", fmt.Errorf("cannot resolve %s: %v", ref, err)
+		}
+		return string(bytes.TrimSpace(out)), nil
+	}
+
+	out, err := command(config.KeyTimeoutGit, "git", "-C", configDir, "rev-parse", "--verify", "--quiet", desired+"^{commit}").Output()
+	if err != nil {
+		return "", fmt.Errorf("desired sha %s does not exist in the checkout", desired)
+	}
+	sha := string(bytes.TrimSpace(out))
+
+	if !isAncestor(configDir, sha, ref) {
+		return "", fmt.Errorf("desired sha %s is not reachable from %s, refusing", desired, ref)
+	}
+	return sha, nil
+}
+
+func gitHead(configDir string) string {
+	out, _ := command(config.KeyTimeoutGit, "git", "-C", configDir, "rev-parse", "HEAD").Output()
+	return string(bytes.TrimSpace(out))
+}
+
+// runProbes checks the configured URLs after a reload. Any response below
+// 500 counts as healthy.
+func runProbes() []probeResult {
+	urls := config.GetStringSlice(config.KeyProbeURLs)
+	results := make([]probeResult, 0, len(urls))
+	client := &http.Client{Timeout: callTimeout(config.KeyTimeoutHTTP)}
+
+	for _, u := range urls {
+		res := probeResult{URL: u}
+		start := time.Now()
+		resp, err := client.Get(u)
+		res.LatencyMS = time.Since(start).Milliseconds()
+		if err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Status = resp.StatusCode
+			res.OK = resp.StatusCode < 500
+			resp.Body.Close()
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// reportDeployment tells the control plane which commit is now applied and
+// how the post-reload probes went, so it can advance or halt a canary.
+// Reports are only sent when the applied commit or render changes.
+func reportDeployment(configDir string, reloadOK bool) {
+	head := gitHead(configDir)
+	key := fmt.Sprintf("%s/%s/%t", head, renderedHash, reloadOK)
+	if key == lastDeployed {
+		return
+	}
+
+	probes := []probeResult{}
+	if reloadOK {
+		appliedSHA = head
+		probes = runProbes()
+	}
+	lastProbes = probes
+	// The heartbeat carries the same data, so a failed report is not retried.
+	lastDeployed = key
+
+	payload := map[string]interface{}{
+		"node_id":      config.GetString(config.KeyNodeID),
+		"sha":          head,
+		"desired_sha":  desiredSHA,
+		"applied_sha":  appliedSHA,
+		"reload_ok":    reloadOK,
+		"error":        lastError,
+		"rendered_sha": renderedHash,
+		"probes":       probes,
+		"timestamp":    time.Now().UTC().Format(time.RFC3339),
+	}
+	jsonBody, _ := json.Marshal(payload)
+
+	controlURL := config.GetString(config.KeyControlURL)
+	resp, err := httpClient().Post(controlURL+"/api/gateway/deployments", "application/json", bytes.NewReader(jsonBody))
+	if err != nil {
+		log.Printf("[deploy] failed to report deployment: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("[deploy] deployment report rejected: %s", resp.Status)
+	}
+}
@@ -0,0 +1,192 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+// resetDeployState clears what the canary code keeps between iterations.
+func resetDeployState(t *testing.T) {
+	t.Cleanup(func() {
+		viper.Reset()
+		desiredSHA, pullError, appliedSHA, lastDeployed, lastError = "", "", "", "", ""
+		lastProbes = nil
+		heartbeatHasDesiredSHA = false
+	})
+	viper.Set(config.KeyNodeID, "svr-gtw-nd1")
+	viper.Set(config.KeyTimeoutGit, "30s")
+	viper.Set(config.KeyTimeoutGitRemote, "30s")
+	viper.Set(config.KeyTimeoutHTTP, "5s")
+}
+
+func TestFetchDesiredSHA(t *testing.T) {
+	resetDeployState(t)
+	var requests int
+	status, body := http.StatusOK, `{"sha": " abc123\n"}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/api/nodes/svr-gtw-nd1/desired-config" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+	viper.Set(config.KeyControlURL, srv.URL)
+
+	steps := []struct {
+		status int
+		body   string
+		want   string
+	}{
+		{http.StatusOK, `{"sha": " abc123\n"}`, "abc123"},
+		// Errors keep the pin rather than jumping to the branch head.
+		{http.StatusInternalServerError, "", "abc123"},
+		{http.StatusOK, "not json", "abc123"},
+		// 404 means the node is not pinned.
+		{http.StatusNotFound, "", ""},
+	}
+	for i, s := range steps {
+		status, body = s.status, s.body
+		if got := fetchDesiredSHA(); got != s.want {
+			t.Errorf("step %d (HTTP %d): desired sha = %q, want %q", i, s.status, got, s.want)
+		}
+	}
+
+	desiredSHA = "abc123"
+	srv.Close()
+	if got := fetchDesiredSHA(); got != "abc123" {
+		t.Errorf("control plane down: desired sha = %q, want the previous pin", got)
+	}
+
+	// Once heartbeats carry the pin, it is not polled.
+	requests = 0
+	heartbeatHasDesiredSHA, desiredSHA = true, "def456"
+	if got := fetchDesiredSHA(); got != "def456" || requests != 0 {
+		t.Errorf("with heartbeat pins: %q after %d requests", got, requests)
+	}
+}
+
+func TestGitPullPinned(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	dir := useGitEnv(t)
+	resetDeployState(t)
+	saved := gatewayConfigDir
+	t.Cleanup(func() { gatewayConfigDir = saved })
+	viper.Set(config.KeyConfigBranch, "main")
+	heartbeatHasDesiredSHA = true
+
+	bare := filepath.Join(dir, "origin.git")
+	work := filepath.Join(dir, "work")
+	runGit(t, dir, "init", "-q", "--bare", bare)
+	runGit(t, dir, "clone", "-q", bare, work)
+	c1 := gitCommit(t, work, "one", "")
+	c2 := gitCommit(t, work, "two", "")
+	c3 := gitCommit(t, work, "three", "")
+	runGit(t, work, "push", "-q", "origin", "HEAD:refs/heads/main")
+	runGit(t, work, "checkout", "-q", "-b", "side", c1)
+	side := gitCommit(t, work, "side", "")
+	runGit(t, work, "push", "-q", "origin", "side")
+
+	gatewayConfigDir = filepath.Join(dir, "checkout")
+	runGit(t, dir, "clone", "-q", "--branch", "main", bare, gatewayConfigDir)
+
+	tests := []struct {
+		desired, head, error string
+	}{
+		{c2, c2, ""},
+		// Only commits on the tracked branch can be pinned.
+		{side, c2, "is not reachable from origin/main"},
+		{"0123456789abcdef0123456789abcdef01234567", c2, "does not exist"},
+		{"", c3, ""},
+		{c1, c1, ""},
+	}
+	for _, tt := range tests {
+		desiredSHA = tt.desired
+		GitPull()
+		if head := gitHead(gatewayConfigDir); head != tt.head {
+			t.Errorf("desired %q: HEAD = %s, want %s", shortSHA(tt.desired), shortSHA(head), shortSHA(tt.head))
+		}
+		if tt.error == "" && pullError != "" || tt.error != "" && !strings.Contains(pullError, tt.error) {
+			t.Errorf("desired %q: pull error = %q, want %q", shortSHA(tt.desired), pullError, tt.error)
+		}
+	}
+
+	// New commits on the branch are fetched when the node tracks its head.
+	runGit(t, work, "checkout", "-q", "--detach", c3)
+	c4 := gitCommit(t, work, "four", "")
+	runGit(t, work, "push", "-q", "origin", "HEAD:refs/heads/main")
+	desiredSHA = ""
+	GitPull()
+	if head := gitHead(gatewayConfigDir); head != c4 || pullError != "" {
+		t.Errorf("tracking the branch: HEAD = %s (%q), want %s", shortSHA(head), pullError, shortSHA(c4))
+	}
+}
+
+func TestReportDeployment(t *testing.T) {
+	resetDeployState(t)
+	var mu sync.Mutex
+	var reports []map[string]interface{}
+	control := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&report)
+		mu.Lock()
+		reports = append(reports, report)
+		mu.Unlock()
+	}))
+	defer control.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	viper.Set(config.KeyControlURL, control.URL)
+	viper.Set(config.KeyProbeURLs, []string{healthy.URL, failing.URL})
+	configDir := t.TempDir()
+	desiredSHA = "abc123"
+
+	reportDeployment(configDir, true)
+	if len(reports) != 1 {
+		t.Fatalf("sent %d reports", len(reports))
+	}
+	r := reports[0]
+	if r["node_id"] != "svr-gtw-nd1" || r["desired_sha"] != "abc123" || r["reload_ok"] != true {
+		t.Errorf("report = %v", r)
+	}
+	probes, _ := r["probes"].([]interface{})
+	if len(probes) != 2 || probes[0].(map[string]interface{})["ok"] != true || probes[1].(map[string]interface{})["ok"] != false {
+		t.Errorf("probes = %v, want the healthy one ok and the 503 not", probes)
+	}
+
+	// Nothing changed: no second report.
+	reportDeployment(configDir, true)
+	if len(reports) != 1 {
+		t.Errorf("an unchanged deployment was reported again")
+	}
+
+	// A failed reload is reported without probing.
+	lastError = "validation failed"
+	reportDeployment(configDir, false)
+	if len(reports) != 2 {
+		t.Fatalf("sent %d reports, want the failed reload reported", len(reports))
+	}
+	if r := reports[1]; r["reload_ok"] != false || r["error"] != "validation failed" || len(r["probes"].([]interface{})) != 0 {
+		t.Errorf("failed reload report = %v", r)
+	}
+	if len(lastProbes) != 0 {
+		t.Errorf("probes of the previous reload kept: %v", lastProbes)
+	}
+}
@@ -0,0 +1,198 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+// drainState is persisted to disk so that the CLI and the running agent
+// (separate processes) agree on whether the node is drained.
+type drainState struct {
+	Since  time.Time `json:"since"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+func drainFile() string {
+	return filepath.Join(config.GetString(config.KeyStateDir), "drain.json")
+}
+
+// DrainInfo returns the current drain state, or nil if the node is in service.
+func DrainInfo() *drainState {
+	b, err := os.ReadFile(drainFile())
+	if err != nil {
+		return nil
+	}
+	var st drainState
+	if err := json.Unmarshal(b, &st); err != nil {
+		// A corrupt file still means someone asked for a drain.
+		return &drainState{}
+	}
+	return &st
+}
+
+func IsDrained() bool {
+	return DrainInfo() != nil
+}
+
+// Drain takes the node out of service: /health starts failing so Bunny DNS
+// stops routing here, and auto-pull/reload are suspended.
+func Drain(reason string) error {
+	if IsDrained() {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(drainFile()), 0755); err != nil {
+		return err
+	}
+	b, _ := json.Marshal(drainState{Since: time.Now().UTC(), Reason: reason})
+	if err := os.WriteFile(drainFile(), b, 0644); err != nil {
+		return fmt.Errorf("failed to write drain state: %w", err)
+	}
+	log.Printf("[drain] node drained (reason: %s)", reason)
+	return nil
+}
+
+// Undrain puts the node back in service.
+func Undrain() error {
+	if err := os.Remove(drainFile()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove drain state: %w", err)
+	}
+	log.Println("[drain] node back in service")
+	return nil
+}
+
+// WaitForConnections blocks until fewer than max requests are in flight, or
+// the timeout elapses.
+func WaitForConnections(max int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		n, err := activeConnections()
+		if err != nil {
+			return err
+		}
+		if n < max {
+			log.Printf("[drain] %d active requests, below threshold %d", n, max)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("still %d active requests after %s", n, timeout)
+		}
+		log.Printf("[drain] waiting for requests to drain: %d active", n)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// activeConnections asks Caddy how many requests it is proxying, summed over
+// its upstreams. Idle keep-alive connections do not hold up a drain, so they
+// are not counted. With the admin API off, the established connections on
+// the HTTP(S) ports are counted instead.
+func activeConnections() (int, error) {
+	admin := newCaddyAdmin()
+	if admin == nil {
+		return openHTTPConnections()
+	}
+	ups, err := admin.upstreams()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read active requests from Caddy: %w", err)
+	}
+	total := 0
+	for _, u := range ups {
+		if n, ok := u["num_requests"].(float64); ok {
+			total += int(n)
+		}
+	}
+	return total, nil
+}
+
+// openHTTPConnections counts established TCP connections whose local port
+// is 80 or 443, i.e. client connections held by Caddy.
+func openHTTPConnections() (int, error) {
+	total := 0
+	found := false
+	for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		found = true
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 4 || fields[3] != "01" { // 01 = ESTABLISHED
+				continue
+			}
+			idx := strings.LastIndex(fields[1], ":")
+			if idx < 0 {
+				continue
+			}
+			port, err := strconv.ParseUint(fields[1][idx+1:], 16, 16)
+			if err != nil {
+				continue
+			}
+			if port == 80 || port == 443 {
+				total++
+			}
+		}
+		f.Close()
+	}
+	if !found {
+		return 0, fmt.Errorf("cannot read /proc/net/tcp")
+	}
+	return total, nil
+}
+
+var (
+	healthMu     sync.Mutex
+	healthServer *http.Server
+)
+
+// serveHealth exposes /health for Bunny DNS. It returns 503 while drained.
+// Calling it again restarts the listener, e.g. after health-addr changed.
+func serveHealth() {
+	stopHealth()
+	addr := config.GetString(config.KeyHealthAddr)
+	if addr == "" || addr == "off" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		if IsDrained() {
+			http.Error(w, "DRAINED", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "OK")
+	})
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	healthMu.Lock()
+	healthServer = srv
+	healthMu.Unlock()
+
+	log.Printf("[health] listening on %s", addr)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("[health] server failed: %v", err)
+		}
+	}()
+}
+
+func stopHealth() {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	if healthServer != nil {
+		healthServer.Close()
+		healthServer = nil
+	}
+}
@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/uverustech/infra-agent/internal/config"
+	"github.com/uverustech/infra-agent/internal/timedexec"
+)
+
+// iterationBudget is how long one main loop iteration may take. It leaves
+// the watchdog ping room to go out after the last call has timed out.
+const iterationBudget = config.Watchdog * 3 / 4
+
+// iterationDeadline is when the running main loop iteration must be done, in
+// Unix nanoseconds, or 0 between iterations. The per-call deadlines add up to
+// more than the watchdog, so calls are cut short at it. Calls made by other
+// goroutines meanwhile (actions, the SSH reconcile) are capped as well.
+var iterationDeadline atomic.Int64
+
+// iteration runs one pass of the main loop under iterationBudget.
+func iteration(work func()) {
+	start := time.Now()
+	iterationDeadline.Store(start.Add(iterationBudget).UnixNano())
+	defer iterationDeadline.Store(0)
+	work()
+	if elapsed := time.Since(start); elapsed > iterationBudget {
+		log.Printf("[agent] iteration took %s, over its %s budget", elapsed.Round(time.Second), iterationBudget)
+	}
+}
+
+// callTimeout returns the timeout configured at timeoutKey, cut short at the
+// end of the running iteration.
+func callTimeout(timeoutKey string) time.Duration {
+	timeout := config.GetDuration(timeoutKey)
+	if end := iterationDeadline.Load(); end != 0 {
+		// Never 0: http.Client takes that as no timeout at all.
+		timeout = max(min(timeout, time.Until(time.Unix(0, end))), time.Millisecond)
+	}
+	return timeout
+}
+
+// command prepares name with args under the timeout configured at
+// timeoutKey (one of the config.KeyTimeout* keys).
+var command = func(timeoutKey, name string, args ...string) *timedexec.Cmd {
+	return timedexec.CommandTimeout(callTimeout(timeoutKey), name, args...)
+}
+
+// failure describes a failed command for last_error: timeouts as such,
+// anything else with the command's output.
+func failure(what string, err error, out []byte) string {
+	if timedexec.IsTimeout(err) {
+		return err.Error()
+	}
+	return what + " failed: " + strings.TrimSpace(string(out))
+}
+
+// httpClient returns the client for control plane calls, with the timeout
+// from http-timeout.
+func httpClient() *http.Client {
+	return &http.Client{Timeout: callTimeout(config.KeyTimeoutHTTP)}
+}
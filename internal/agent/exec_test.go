@@ -0,0 +1,41 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/uverustech/infra-agent/internal/config"
+	"github.com/uverustech/infra-agent/internal/timedexec"
+)
+
+func TestCallTimeout(t *testing.T) {
+	t.Cleanup(viper.Reset)
+	viper.Set(config.KeyTimeoutGitRemote, "1m")
+
+	if got := callTimeout(config.KeyTimeoutGitRemote); got != time.Minute {
+		t.Errorf("outside an iteration = %s, want the configured 1m", got)
+	}
+
+	iteration(func() {
+		if got := callTimeout(config.KeyTimeoutGitRemote); got != time.Minute {
+			t.Errorf("at the start of an iteration = %s, want 1m", got)
+		}
+		// 80s into the 90s budget only 10s are left.
+		iterationDeadline.Store(time.Now().Add(10 * time.Second).UnixNano())
+		if got := callTimeout(config.KeyTimeoutGitRemote); got > 10*time.Second || got < 9*time.Second {
+			t.Errorf("near the end of an iteration = %s, want about 10s", got)
+		}
+		// Past the budget calls time out at once rather than never.
+		iterationDeadline.Store(time.Now().Add(-time.Second).UnixNano())
+		if got := callTimeout(config.KeyTimeoutGitRemote); got != time.Millisecond {
+			t.Errorf("after the budget = %s, want 1ms", got)
+		}
+		if err := command(config.KeyTimeoutGitRemote, "sleep", "1").Run(); !timedexec.IsTimeout(err) {
+			t.Errorf("command after the budget: %v, want a timeout", err)
+		}
+	})
+	if iterationDeadline.Load() != 0 {
+		t.Error("iteration deadline left set")
+	}
+}
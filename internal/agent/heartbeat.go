@@ -0,0 +1,255 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uverustech/infra-agent/internal/config"
+	"github.com/uverustech/infra-agent/internal/setup"
+)
+
+// heartbeatResponse is the control plane's answer to a heartbeat. Every field
+// is optional, so one round-trip carries what the agent would otherwise poll
+// for separately, and commands reach nodes whose proxies block websockets.
+type heartbeatResponse struct {
+	// AgentVersion is the version the node should run.
+	AgentVersion string `json:"agent_version,omitempty"`
+	// DesiredSHA pins the gateway config commit; "" tracks the branch head
+	// and an absent field leaves the pin as it is.
+	DesiredSHA *string `json:"desired_sha,omitempty"`
+	// ConfigRevision is the current remote config revision. Config carries
+	// the document itself; if it is left out, a changed revision is fetched.
+	ConfigRevision *string              `json:"config_revision,omitempty"`
+	Config         *config.RemoteConfig `json:"config,omitempty"`
+	// Actions are run like websocket actions; their results are reported in
+	// the next heartbeat.
+	Actions []controlMessage `json:"actions,omitempty"`
+	// NextHeartbeat asks for a different interval (e.g. "2s" while a rollout
+	// is in progress); without it the configured heartbeat-interval applies.
+	NextHeartbeat string `json:"next_heartbeat,omitempty"`
+}
+
+var (
+	// heartbeatHasDesiredSHA and heartbeatHasConfig record whether the control
+	// plane answers heartbeats with the pinned SHA and config revision, in
+	// which case the dedicated requests for them are skipped. The former
+	// stays set once a response carried desired_sha, so a response without
+	// it keeps the pin instead of polling /desired-config, whose 404 would
+	// clear it.
+	heartbeatHasDesiredSHA bool
+	heartbeatHasConfig     bool
+
+	// suggestedInterval is the interval the ticker runs at because the
+	// control plane asked for it, or 0.
+	suggestedInterval time.Duration
+
+	resultsMu     sync.Mutex
+	actionResults []map[string]interface{}
+	// seenActions keeps the IDs of heartbeat actions started and not yet
+	// reported, since the control plane repeats an action until its result
+	// is delivered. An ID is dropped once a heartbeat carrying its result
+	// has been accepted.
+	seenActions = map[string]bool{}
+)
+
+// sendHeartbeat reports the node's state and returns the control plane's
+// answer, or nil if the request failed.
+func sendHeartbeat() *heartbeatResponse {
+	nodeID := config.GetString(config.KeyNodeID)
+	nodeType := config.GetString(config.KeyNodeType)
+	controlURL := config.GetString(config.KeyControlURL)
+	configDir := gatewayConfigDir
+
+	sha, _ := command(config.KeyTimeoutGit, "git", "-C", configDir, "rev-parse", "HEAD").Output()
+	isHealthy, summary, healthData := getSystemMetrics(nodeType)
+	results := takeActionResults()
+
+	payload := map[string]interface{}{
+		"node_id":        nodeID,
+		"git_sha":        string(bytes.TrimSpace(sha)),
+		"desired_sha":    desiredSHA,
+		"applied_sha":    appliedSHA,
+		"refused_sha":    refusedSHA,
+		"probe_results":  lastProbes,
+		"agent_version":  currentVersion,
+		"caddy_version":  getCaddyVersion(),
+		"last_reload_ok": heartbeatOK,
+		"last_error":     lastErrorMessage(),
+		"rendered_sha":   renderedHash,
+		"node_type":      nodeType,
+		"drained":        IsDrained(),
+		"is_healthy":     isHealthy,
+		"health_summary": summary,
+		"health_data":    healthData,
+		"setup":          setup.LatestReportSummary(),
+		"firewall_sha":   setup.FirewallRulesetHash(),
+		"config_rev":     config.RemoteRevision(),
+		"config_error":   remoteConfigError,
+		"action_results": results,
+		"timestamp":      time.Now().UTC().Format(time.RFC3339),
+	}
+	jsonBody, _ := json.Marshal(payload)
+	resp, err := httpClient().Post(controlURL+"/api/heartbeat", "application/json", bytes.NewReader(jsonBody))
+	if err != nil {
+		log.Printf("[heartbeat] failed: %v", err)
+		requeueActionResults(results)
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		log.Printf("[heartbeat] server error: %s", resp.Status)
+		requeueActionResults(results)
+		return nil
+	}
+	forgetActions(results)
+
+	var hr heartbeatResponse
+	body, _ := io.ReadAll(resp.Body)
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &hr); err != nil {
+			log.Printf("[heartbeat] invalid response: %v", err)
+		}
+	}
+	return &hr
+}
+
+// handleHeartbeatResponse acts on the control plane's answer to the
+// heartbeat of this iteration.
+func handleHeartbeatResponse(hr *heartbeatResponse, ticker *time.Ticker) {
+	if hr == nil {
+		return
+	}
+
+	if hr.AgentVersion != "" {
+		maybeUpdate(hr.AgentVersion)
+	} else {
+		// Control planes that predate the response schema.
+		if latest, err := GetLatestVersion(config.GetString(config.KeyControlURL), currentVersion); err == nil {
+			maybeUpdate(latest)
+		}
+	}
+
+	if hr.DesiredSHA != nil {
+		heartbeatHasDesiredSHA = true
+		if sha := strings.TrimSpace(*hr.DesiredSHA); sha != desiredSHA {
+			desiredSHA = sha
+			log.Printf("[deploy] control plane wants %q", desiredSHA)
+		}
+	}
+
+	heartbeatHasConfig = hr.ConfigRevision != nil || hr.Config != nil
+	switch {
+	case hr.Config != nil:
+		applyRemoteConfig(hr.Config, ticker)
+	case hr.ConfigRevision != nil && *hr.ConfigRevision != config.RemoteRevision():
+		syncRemoteConfig(ticker)
+	}
+
+	for _, action := range hr.Actions {
+		runHeartbeatAction(action)
+	}
+
+	suggestInterval(hr.NextHeartbeat, ticker)
+}
+
+// updating is set while a self-update runs; SelfUpdate restarts the service
+// when it succeeds.
+var updating atomic.Bool
+
+// maybeUpdate starts a self-update when version differs from the running one.
+func maybeUpdate(version string) {
+	if version == "" || version == currentVersion || !updating.CompareAndSwap(false, true) {
+		return
+	}
+	tag := strings.TrimPrefix(version, "v")
+	log.Printf("[update] triggering update %s → %s", currentVersion, version)
+	go func() {
+		if err := SelfUpdate(tag, config.GetBool(config.KeyVerbose)); err != nil {
+			log.Printf("[update] error: %v", err)
+			updating.Store(false)
+		}
+	}()
+}
+
+// runHeartbeatAction starts an action received in a heartbeat response,
+// unless it was started before.
+func runHeartbeatAction(msg controlMessage) {
+	resultsMu.Lock()
+	if msg.ID != "" && seenActions[msg.ID] {
+		resultsMu.Unlock()
+		return
+	}
+	if msg.ID != "" {
+		seenActions[msg.ID] = true
+	}
+	resultsMu.Unlock()
+
+	go func() {
+		result := map[string]interface{}{"id": msg.ID, "action": msg.Action, "ok": true}
+		if err := handleAction(msg.Action, msg.Params); err != nil {
+			log.Printf("[control] action %s failed: %v", msg.Action, err)
+			result["ok"] = false
+			result["error"] = err.Error()
+		}
+		requeueActionResults([]map[string]interface{}{result})
+	}()
+}
+
+func takeActionResults() []map[string]interface{} {
+	resultsMu.Lock()
+	defer resultsMu.Unlock()
+	results := actionResults
+	actionResults = nil
+	return results
+}
+
+// forgetActions drops the IDs of actions whose results the control plane
+// has received.
+func forgetActions(results []map[string]interface{}) {
+	resultsMu.Lock()
+	defer resultsMu.Unlock()
+	for _, r := range results {
+		if id, _ := r["id"].(string); id != "" {
+			delete(seenActions, id)
+		}
+	}
+}
+
+// requeueActionResults keeps results for the next heartbeat.
+func requeueActionResults(results []map[string]interface{}) {
+	if len(results) == 0 {
+		return
+	}
+	resultsMu.Lock()
+	actionResults = append(actionResults, results...)
+	resultsMu.Unlock()
+}
+
+// suggestInterval runs the ticker at the interval the control plane asked
+// for, bounded like heartbeat-interval, or goes back to heartbeat-interval.
+func suggestInterval(next string, ticker *time.Ticker) {
+	var d time.Duration
+	if next != "" {
+		parsed, err := time.ParseDuration(next)
+		if err != nil {
+			log.Printf("[heartbeat] ignoring next_heartbeat %q: %v", next, err)
+		} else {
+			d = min(max(parsed, time.Second), time.Minute)
+		}
+	}
+	if d == suggestedInterval {
+		return
+	}
+	suggestedInterval = d
+	if d == 0 {
+		d = config.GetDuration(config.KeyHeartbeatInterval)
+	}
+	log.Printf("[heartbeat] next heartbeats every %s", d)
+	ticker.Reset(d)
+}
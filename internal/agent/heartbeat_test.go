@@ -0,0 +1,183 @@
+package agent
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+// respond handles a heartbeat response given as JSON. agent_version is the
+// running version unless the response sets it, so no update starts.
+func respond(t *testing.T, body string, ticker *time.Ticker) {
+	t.Helper()
+	hr := heartbeatResponse{AgentVersion: currentVersion}
+	if err := json.Unmarshal([]byte(body), &hr); err != nil {
+		t.Fatal(err)
+	}
+	handleHeartbeatResponse(&hr, ticker)
+}
+
+func TestHeartbeatResponseDesiredSHA(t *testing.T) {
+	useControlPlane(t)
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	handleHeartbeatResponse(nil, ticker)
+	if heartbeatHasDesiredSHA {
+		t.Fatal("a failed heartbeat counted as carrying desired_sha")
+	}
+
+	respond(t, `{"desired_sha": " abc123\n"}`, ticker)
+	if desiredSHA != "abc123" || !heartbeatHasDesiredSHA {
+		t.Errorf("desired sha = %q", desiredSHA)
+	}
+	// An absent field keeps the pin.
+	respond(t, `{}`, ticker)
+	if desiredSHA != "abc123" || !heartbeatHasDesiredSHA {
+		t.Errorf("desired sha = %q after a response without it", desiredSHA)
+	}
+	respond(t, `{"desired_sha": ""}`, ticker)
+	if desiredSHA != "" {
+		t.Errorf("desired sha = %q, an empty one tracks the branch", desiredSHA)
+	}
+}
+
+func TestHeartbeatResponseNextHeartbeat(t *testing.T) {
+	useControlPlane(t)
+	viper.Set(config.KeyHeartbeatInterval, "10s")
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	tests := []struct {
+		next string
+		want time.Duration
+	}{
+		{"2s", 2 * time.Second},
+		{"100ms", time.Second},
+		{"10m", time.Minute},
+		{"soon", 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		respond(t, `{"next_heartbeat": "`+tt.next+`"}`, ticker)
+		if suggestedInterval != tt.want {
+			t.Errorf("next_heartbeat %q: interval = %s, want %s", tt.next, suggestedInterval, tt.want)
+		}
+	}
+}
+
+func TestHeartbeatResponseConfigRevision(t *testing.T) {
+	cp := useControlPlane(t)
+	viper.Set(config.KeyRemoteConfig, true)
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	respond(t, `{}`, ticker)
+	if heartbeatHasConfig {
+		t.Error("a response without config_revision counted as carrying it")
+	}
+	// The revision in effect is not fetched again.
+	respond(t, `{"config_revision": ""}`, ticker)
+	if !heartbeatHasConfig || len(cp.others) != 0 {
+		t.Errorf("unchanged revision: has config %v, requested %q", heartbeatHasConfig, cp.others)
+	}
+	respond(t, `{"config_revision": "r2"}`, ticker)
+	if want := []string{"/api/nodes/svr-nd1/agent-config"}; !reflect.DeepEqual(cp.others, want) {
+		t.Errorf("new revision: requested %q, want %q", cp.others, want)
+	}
+}
+
+func TestHeartbeatResponseConfig(t *testing.T) {
+	cp := useControlPlane(t)
+	config.Init()
+	viper.Set(config.KeyStateDir, t.TempDir())
+	t.Cleanup(func() { config.ClearRemote() })
+	cp.response = `{"agent_version": "` + currentVersion + `"}`
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	cfg, err := config.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeConfig = cfg
+
+	respond(t, `{"config": {"revision": "r2", "config": {"heartbeat-interval": "20s"}}}`, ticker)
+	if config.RemoteRevision() != "r2" || activeConfig.HeartbeatInterval != 20*time.Second {
+		t.Errorf("revision %q, heartbeat-interval %s", config.RemoteRevision(), activeConfig.HeartbeatInterval)
+	}
+	if n := len(cp.received()); n != 1 || cp.received()[0]["config_rev"] != "r2" {
+		t.Errorf("sent %d heartbeats after applying the config", n)
+	}
+
+	// An invalid document is rejected and reported.
+	respond(t, `{"config": {"revision": "r3", "config": {"heartbeat-interval": "1h"}}}`, ticker)
+	if config.RemoteRevision() != "r2" || remoteConfigError == "" {
+		t.Errorf("revision %q, error %q", config.RemoteRevision(), remoteConfigError)
+	}
+	if len(cp.others) != 0 {
+		t.Errorf("fetched %q although the response carried the document", cp.others)
+	}
+}
+
+func TestHeartbeatResponseActions(t *testing.T) {
+	cp := useControlPlane(t)
+	cp.response = `{"agent_version": "` + currentVersion + `"}`
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	pending := func() []map[string]interface{} {
+		resultsMu.Lock()
+		defer resultsMu.Unlock()
+		return append([]map[string]interface{}{}, actionResults...)
+	}
+	waitResults := func(n int) []map[string]interface{} {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for len(pending()) < n && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return pending()
+	}
+
+	// The control plane repeats an action until its result is delivered.
+	respond(t, `{"actions": [{"id": "a1", "action": "reboot"}]}`, ticker)
+	respond(t, `{"actions": [{"id": "a1", "action": "reboot"}]}`, ticker)
+	waitResults(1)
+	// Give a duplicate run time to report too.
+	time.Sleep(50 * time.Millisecond)
+	if results := pending(); len(results) != 1 || results[0]["id"] != "a1" || results[0]["ok"] != false {
+		t.Fatalf("results = %v", results)
+	}
+
+	// A heartbeat that fails keeps the results for the next one.
+	url := config.GetString(config.KeyControlURL)
+	viper.Set(config.KeyControlURL, "http://127.0.0.1:1")
+	if sendHeartbeat() != nil {
+		t.Fatal("heartbeat to a closed port succeeded")
+	}
+	if len(pending()) != 1 {
+		t.Fatalf("results dropped after a failed heartbeat: %v", pending())
+	}
+
+	viper.Set(config.KeyControlURL, url)
+	if sendHeartbeat() == nil {
+		t.Fatal("heartbeat failed")
+	}
+	sent := cp.received()[0]["action_results"].([]interface{})
+	if len(sent) != 1 || sent[0].(map[string]interface{})["error"] != `unknown action "reboot"` {
+		t.Errorf("sent results %v", sent)
+	}
+	if len(pending()) != 0 || seenActions["a1"] {
+		t.Error("a delivered result is still pending")
+	}
+
+	// Once delivered, the same ID runs again if the control plane resends it.
+	respond(t, `{"actions": [{"id": "a1", "action": "reboot"}]}`, ticker)
+	if len(waitResults(1)) != 1 {
+		t.Error("a resent action did not run")
+	}
+}
@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+// sdNotify sends a state string such as "READY=1" to systemd over the socket
+// in NOTIFY_SOCKET. It is a no-op when the agent is not run by systemd with
+// Type=notify.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A leading @ denotes a socket in the abstract namespace.
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogEnabled reports whether systemd expects WATCHDOG=1 pings from this
+// process (WatchdogSec= in the unit).
+func watchdogEnabled() bool {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return false
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return false
+	}
+	return true
+}
+
+// notifyAlive is called once per completed main loop iteration: it pings the
+// watchdog and publishes a one-line status for `systemctl status`. A wedged
+// iteration (e.g. a hung git fetch) stops the pings and systemd restarts us.
+func notifyAlive() {
+	state := "STATUS=" + statusSummary()
+	if watchdogEnabled() {
+		state = "WATCHDOG=1\n" + state
+	}
+	sdNotify(state)
+}
+
+func statusSummary() string {
+	var parts []string
+	if IsDrained() {
+		parts = append(parts, "drained")
+	}
+	if msg := lastErrorMessage(); msg != "" {
+		msg = strings.SplitN(msg, "\n", 2)[0]
+		if len(msg) > 80 {
+			msg = msg[:80] + "…"
+		}
+		parts = append(parts, "error: "+msg)
+	} else {
+		parts = append(parts, "ok")
+	}
+	if config.GetString(config.KeyNodeType) == "gateway" && appliedSHA != "" {
+		parts = append(parts, "config "+shortSHA(appliedSHA))
+	}
+	return strings.Join(parts, ", ")
+}
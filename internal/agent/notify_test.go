@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+// listenNotify stands in for systemd: it listens on a unixgram socket and
+// points NOTIFY_SOCKET at it.
+func listenNotify(t *testing.T, name string) *net.UnixConn {
+	t.Helper()
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("no datagram received: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestSDNotify(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "notify")
+	conn := listenNotify(t, socket)
+	t.Setenv("NOTIFY_SOCKET", socket)
+
+	if err := sdNotify("READY=1\nSTATUS=starting"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readNotify(t, conn); got != "READY=1\nSTATUS=starting" {
+		t.Errorf("datagram = %q", got)
+	}
+}
+
+func TestSDNotifyAbstractSocket(t *testing.T) {
+	name := "infra-agent-test-" + strconv.Itoa(os.Getpid())
+	conn := listenNotify(t, "\x00"+name)
+	t.Setenv("NOTIFY_SOCKET", "@"+name)
+
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readNotify(t, conn); got != "READY=1" {
+		t.Errorf("datagram = %q", got)
+	}
+}
+
+func TestSDNotifyWithoutSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("sdNotify() without NOTIFY_SOCKET = %v", err)
+	}
+}
+
+func TestNotifyAlive(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "notify")
+	conn := listenNotify(t, socket)
+	t.Setenv("NOTIFY_SOCKET", socket)
+	t.Cleanup(viper.Reset)
+	viper.Set(config.KeyStateDir, t.TempDir())
+	viper.Set(config.KeyNodeType, "gateway")
+
+	savedErr, savedPull, savedSHA := lastError, pullError, appliedSHA
+	t.Cleanup(func() { lastError, pullError, appliedSHA = savedErr, savedPull, savedSHA })
+	lastError, pullError, appliedSHA = "", "", "0123456789abcdef0123"
+
+	t.Setenv("WATCHDOG_USEC", "120000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	notifyAlive()
+	if got, want := readNotify(t, conn), "WATCHDOG=1\nSTATUS=ok, config 0123456789ab"; got != want {
+		t.Errorf("datagram = %q, want %q", got, want)
+	}
+
+	// The watchdog is meant for another process: only the status is sent.
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	lastError = "reload failed: caddy exited\nfull output"
+	notifyAlive()
+	if got, want := readNotify(t, conn), "STATUS=error: reload failed: caddy exited, config 0123456789ab"; got != want {
+		t.Errorf("datagram = %q, want %q", got, want)
+	}
+
+	t.Setenv("WATCHDOG_USEC", "")
+	t.Setenv("WATCHDOG_PID", "")
+	lastError = ""
+	notifyAlive()
+	if got, want := readNotify(t, conn), "STATUS=ok, config 0123456789ab"; got != want {
+		t.Errorf("datagram = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+// activeConfig is the configuration the agent last accepted. Most settings
+// are read where they are used and take effect on the next use; reloadConfig
+// handles the ones held by long-lived state (connections, listeners, timers).
+var activeConfig *config.Config
+
+// reloadRequests carries config file changes and SIGHUPs to the main loop,
+// which applies them between iterations.
+var reloadRequests = make(chan string, 1)
+
+func requestReload(reason string) {
+	select {
+	case reloadRequests <- reason:
+	default:
+	}
+}
+
+// watchReloadTriggers requests a reload when the config file changes or the
+// agent receives SIGHUP (systemctl reload infra-agent).
+func watchReloadTriggers() {
+	if err := config.Watch(func() { requestReload("config file changed") }); err != nil {
+		log.Printf("[config] cannot watch config file: %v", err)
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			requestReload("SIGHUP")
+		}
+	}()
+}
+
+// Keys whose change needs more than re-reading the value on next use.
+var (
+	controlKeys   = []string{config.KeyControlURL, config.KeyNodeID, config.KeyTimeoutHTTP}
+	sshKeys       = []string{config.KeySSHKeys, config.KeySSHKeyURL, config.KeySSHKeysReconcile, config.KeySSHCAKeyURL, config.KeySSHPrincipals, config.KeyGithubToken}
+	clockKeys     = []string{config.KeyNTPServers, config.KeyClockDriftThreshold}
+	healthKeys    = []string{config.KeyHealthAddr, config.KeyNodeType}
+	caddyfileKeys = []string{config.KeyCaddyTemplate, config.KeyCaddyRendered, config.KeyCaddyAdmin, config.KeyRegion, config.KeyLabels, config.KeySecretsDir}
+	restartKeys   = []string{config.KeyStateDir}
+	setupKeys     = []string{config.KeyPermitRootLogin, config.KeyAllowUsers, config.KeyDisableServices, config.KeyPackages, config.KeyTimezone, config.KeyUsers, config.KeyGroups, config.KeyUsersURL, config.KeyFirewall}
+)
+
+// reloadConfig re-reads the config file and applies what changed. An invalid
+// file is rejected and the agent keeps running with the previous settings.
+func reloadConfig(reason string, ticker *time.Ticker) {
+	log.Printf("[config] reloading (%s)", reason)
+	cfg, err := config.Reload()
+	if err != nil {
+		log.Printf("[config] new configuration rejected, keeping the previous one:\n%v", err)
+		return
+	}
+	applyConfig(cfg, ticker)
+}
+
+// applyConfig makes cfg the active configuration and applies what changed
+// since the previous one.
+func applyConfig(cfg *config.Config, ticker *time.Ticker) {
+	changed := config.Diff(activeConfig, cfg)
+	activeConfig = cfg
+	if len(changed) == 0 {
+		log.Println("[config] no changes")
+		return
+	}
+	log.Printf("[config] changed: %s", strings.Join(changed, ", "))
+
+	if changedAny(changed, config.KeyHeartbeatInterval) {
+		ticker.Reset(cfg.HeartbeatInterval)
+		suggestedInterval = 0
+		log.Printf("[config] heartbeat interval is now %s", cfg.HeartbeatInterval)
+	}
+	if changedAny(changed, controlKeys...) {
+		log.Println("[config] reconnecting to the control plane")
+		closeWS()
+	}
+	if changedAny(changed, config.KeyLogUnits) {
+		restartLogs()
+	}
+	if changedAny(changed, sshKeys...) {
+		wakeSSHReconcile()
+	}
+	if changedAny(changed, healthKeys...) {
+		if cfg.NodeType == "gateway" {
+			serveHealth()
+		} else {
+			stopHealth()
+		}
+	}
+	if changedAny(changed, caddyfileKeys...) && cfg.NodeType == "gateway" && !IsDrained() {
+		ValidateAndReload()
+	}
+	if changedAny(changed, restartKeys...) {
+		log.Printf("[config] %s take effect after a restart", strings.Join(restartKeys, ", "))
+	}
+	if changedAny(changed, setupKeys...) {
+		log.Println("[config] setup settings changed; run 'infra-agent setup' to apply them")
+	}
+
+	// Report health against the new thresholds straight away. The answer is
+	// handled like any other: it may carry actions or a new pin.
+	if changedAny(changed, clockKeys...) {
+		resetClockCheck()
+	}
+	handleHeartbeatResponse(sendHeartbeat(), ticker)
+	notifyAlive()
+}
+
+func changedAny(changed []string, keys ...string) bool {
+	for _, key := range keys {
+		for _, c := range changed {
+			if c == key {
+				return true
+			}
+		}
+	}
+	return false
+}
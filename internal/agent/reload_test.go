@@ -0,0 +1,106 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+// controlPlane stands in for the control plane: it records heartbeats and
+// answers them with response. Other endpoints return 404 and are recorded in
+// others.
+type controlPlane struct {
+	mu         sync.Mutex
+	heartbeats []map[string]interface{}
+	others     []string
+	response   string
+}
+
+func (c *controlPlane) received() []map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]map[string]interface{}{}, c.heartbeats...)
+}
+
+// useControlPlane points the agent at a fake control plane and resets the
+// state heartbeat responses change.
+func useControlPlane(t *testing.T) *controlPlane {
+	t.Helper()
+	cp := &controlPlane{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/heartbeat" {
+			cp.mu.Lock()
+			cp.others = append(cp.others, r.URL.Path)
+			cp.mu.Unlock()
+			http.NotFound(w, r)
+			return
+		}
+		var hb map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&hb)
+		cp.mu.Lock()
+		cp.heartbeats = append(cp.heartbeats, hb)
+		response := cp.response
+		cp.mu.Unlock()
+		w.Write([]byte(response))
+	}))
+	t.Setenv("NOTIFY_SOCKET", "")
+	// Responses answer with this version, so no self-update starts.
+	savedVersion := currentVersion
+	currentVersion = "1.0.0"
+	t.Cleanup(func() {
+		srv.Close()
+		currentVersion = savedVersion
+		viper.Reset()
+		activeConfig, remoteConfigError = nil, ""
+		desiredSHA, heartbeatHasDesiredSHA, heartbeatHasConfig, suggestedInterval = "", false, false, 0
+		resultsMu.Lock()
+		actionResults, seenActions = nil, map[string]bool{}
+		resultsMu.Unlock()
+	})
+	viper.Set(config.KeyControlURL, srv.URL)
+	viper.Set(config.KeyNodeID, "svr-nd1")
+	viper.Set(config.KeyTimeoutGit, "5s")
+	viper.Set(config.KeyTimeoutHTTP, "5s")
+	viper.Set(config.KeyCaddyAdmin, "off")
+	return cp
+}
+
+func TestApplyConfigHandlesHeartbeatResponse(t *testing.T) {
+	cp := useControlPlane(t)
+	cp.response = `{"desired_sha": "abc123", "next_heartbeat": "2s"}`
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	activeConfig = &config.Config{Region: "eu-1", HeartbeatInterval: 10 * time.Second}
+	applyConfig(&config.Config{Region: "eu-2", HeartbeatInterval: 10 * time.Second}, ticker)
+	if n := len(cp.received()); n != 1 {
+		t.Fatalf("sent %d heartbeats after a change, want 1", n)
+	}
+	if desiredSHA != "abc123" || !heartbeatHasDesiredSHA {
+		t.Errorf("desired sha = %q, the heartbeat response was dropped", desiredSHA)
+	}
+	if suggestedInterval != 2*time.Second {
+		t.Errorf("suggested interval = %s, want 2s", suggestedInterval)
+	}
+
+	// The configured interval replaces the one the control plane suggested.
+	cp.response = `{}`
+	applyConfig(&config.Config{Region: "eu-2", HeartbeatInterval: 20 * time.Second}, ticker)
+	if suggestedInterval != 0 {
+		t.Errorf("suggested interval = %s after heartbeat-interval changed", suggestedInterval)
+	}
+	if activeConfig.HeartbeatInterval != 20*time.Second {
+		t.Errorf("active config not replaced: %+v", activeConfig)
+	}
+
+	applyConfig(&config.Config{Region: "eu-2", HeartbeatInterval: 20 * time.Second}, ticker)
+	if n := len(cp.received()); n != 2 {
+		t.Errorf("sent %d heartbeats, an unchanged config must not send one", n)
+	}
+}
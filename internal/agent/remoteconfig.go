@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+// remoteConfigError is why the last remote config was rejected, reported in
+// the heartbeat until a valid revision arrives.
+var remoteConfigError string
+
+// syncRemoteConfig fetches the configuration the control plane manages for
+// this node and applies it when its revision changed. The node keeps its
+// current settings while the control plane is unreachable.
+func syncRemoteConfig(ticker *time.Ticker) {
+	if !config.GetBool(config.KeyRemoteConfig) {
+		if config.RemoteRevision() != "" {
+			log.Println("[config] remote-config disabled, dropping the remote layer")
+			clearRemoteConfig(ticker)
+		}
+		return
+	}
+
+	controlURL := config.GetString(config.KeyControlURL)
+	nodeID := config.GetString(config.KeyNodeID)
+	u := controlURL + "/api/nodes/" + url.PathEscape(nodeID) + "/agent-config?node_type=" +
+		url.QueryEscape(config.GetString(config.KeyNodeType))
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return
+	}
+	if rev := config.RemoteRevision(); rev != "" {
+		req.Header.Set("If-None-Match", `"`+rev+`"`)
+	}
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		log.Printf("[config] failed to fetch remote config: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return
+	case http.StatusNotFound:
+		if config.RemoteRevision() != "" {
+			log.Println("[config] node is no longer remote-managed, dropping the remote layer")
+			clearRemoteConfig(ticker)
+		}
+		return
+	default:
+		log.Printf("[config] remote config request failed: %s", resp.Status)
+		return
+	}
+
+	var doc config.RemoteConfig
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		log.Printf("[config] invalid remote config response: %v", err)
+		return
+	}
+	applyRemoteConfig(&doc, ticker)
+}
+
+// applyRemoteConfig applies doc unless its revision is already active.
+func applyRemoteConfig(doc *config.RemoteConfig, ticker *time.Ticker) {
+	if doc.Revision == "" || doc.Revision == config.RemoteRevision() {
+		return
+	}
+	doc.FetchedAt = time.Now().UTC()
+	cfg, err := config.ApplyRemote(doc)
+	if cfg == nil {
+		log.Printf("[config] %v", err)
+		remoteConfigError = err.Error()
+		return
+	}
+	if err != nil {
+		log.Printf("[config] failed to persist remote config: %v", err)
+	}
+	remoteConfigError = ""
+	log.Printf("[config] applying remote config revision %s", doc.Revision)
+	applyConfig(cfg, ticker)
+}
+
+func clearRemoteConfig(ticker *time.Ticker) {
+	cfg, err := config.ClearRemote()
+	remoteConfigError = ""
+	if err != nil {
+		log.Printf("[config] %v", err)
+		return
+	}
+	applyConfig(cfg, ticker)
+}
@@ -0,0 +1,161 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+// gatewayConfigDir is the gtw-config checkout. It is a variable so tests can
+// point it at a temporary directory.
+var gatewayConfigDir = "/etc/caddy"
+
+// defaultCaddyfile is the Caddyfile in the checkout, loaded when no template
+// is configured.
+func defaultCaddyfile() string {
+	return filepath.Join(gatewayConfigDir, "Caddyfile")
+}
+
+// renderedHash is the sha256 of the last successfully rendered Caddyfile.
+var renderedHash string
+
+// templateData is exposed to Caddyfile templates as the dot value.
+type templateData struct {
+	NodeID   string
+	NodeType string
+	Region   string
+	Labels   map[string]string
+}
+
+// caddyfilePath returns the Caddyfile Caddy should load: the rendered output
+// when templating is enabled, otherwise the Caddyfile in the checkout.
+func caddyfilePath() string {
+	if config.GetString(config.KeyCaddyTemplate) == "" {
+		return defaultCaddyfile()
+	}
+	return config.GetString(config.KeyCaddyRendered)
+}
+
+// prepareCaddyfile renders the node's Caddyfile from the template in the git
+// checkout, if one is configured. The output is validated before it replaces
+// the previous render, so a broken template never reaches Caddy.
+func prepareCaddyfile(admin *caddyAdmin) (string, error) {
+	tmplName := config.GetString(config.KeyCaddyTemplate)
+	if tmplName == "" {
+		return defaultCaddyfile(), nil
+	}
+
+	tmplPath := filepath.Join(gatewayConfigDir, filepath.Clean("/"+tmplName))
+	out := config.GetString(config.KeyCaddyRendered)
+
+	rendered, err := renderTemplate(tmplPath)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(rendered)
+	hash := hex.EncodeToString(sum[:])
+
+	if existing, err := os.ReadFile(out); err == nil && bytes.Equal(existing, rendered) {
+		renderedHash = hash
+		return out, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(out), ".Caddyfile-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	// Rendered output may contain secrets.
+	if err := tmp.Chmod(0640); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if _, err := tmp.Write(rendered); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	if err := validateCaddyfile(admin, tmp.Name(), rendered); err != nil {
+		return "", fmt.Errorf("rendered Caddyfile is invalid: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), out); err != nil {
+		return "", err
+	}
+	renderedHash = hash
+	log.Printf("[template] rendered %s → %s (sha256 %s)", tmplPath, out, hash[:12])
+	return out, nil
+}
+
+func renderTemplate(path string) ([]byte, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template: %w", err)
+	}
+
+	funcs := template.FuncMap{
+		"secret": readSecret,
+		"label": func(key string) string {
+			return config.GetStringMapString(config.KeyLabels)[key]
+		},
+	}
+
+	tmpl, err := template.New(filepath.Base(path)).Funcs(funcs).Option("missingkey=error").Parse(string(src))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template: %w", err)
+	}
+
+	data := templateData{
+		NodeID:   config.GetString(config.KeyNodeID),
+		NodeType: config.GetString(config.KeyNodeType),
+		Region:   config.GetString(config.KeyRegion),
+		Labels:   config.GetStringMapString(config.KeyLabels),
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to render template: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// readSecret returns the contents of a file in the secrets directory. Names
+// are confined to that directory.
+func readSecret(name string) (string, error) {
+	if name == "" || strings.Contains(name, "/") || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid secret name %q", name)
+	}
+	b, err := os.ReadFile(filepath.Join(config.GetString(config.KeySecretsDir), name))
+	if err != nil {
+		return "", fmt.Errorf("secret %q: %w", name, err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+func validateCaddyfile(admin *caddyAdmin, path string, content []byte) error {
+	if admin != nil {
+		_, err := admin.adapt(content)
+		return err
+	}
+	out, err := command(config.KeyTimeoutCaddy, "caddy", "validate", "--config", path, "--adapter", "caddyfile").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v\n%s", err, string(out))
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+// useTemplate writes a template into a temp checkout and configures the
+// node it is rendered for.
+func useTemplate(t *testing.T, name, src string) (rendered string) {
+	t.Helper()
+	dir := t.TempDir()
+	saved := gatewayConfigDir
+	t.Cleanup(func() {
+		gatewayConfigDir = saved
+		renderedHash = ""
+		viper.Reset()
+	})
+	gatewayConfigDir = filepath.Join(dir, "checkout")
+	os.MkdirAll(gatewayConfigDir, 0755)
+	os.WriteFile(filepath.Join(gatewayConfigDir, name), []byte(src), 0644)
+
+	secrets := filepath.Join(dir, "secrets")
+	os.Mkdir(secrets, 0700)
+	os.WriteFile(filepath.Join(secrets, "basic-auth"), []byte("s3cret\n"), 0600)
+
+	rendered = filepath.Join(dir, "state", "Caddyfile")
+	viper.Set(config.KeyCaddyTemplate, name)
+	viper.Set(config.KeyCaddyRendered, rendered)
+	viper.Set(config.KeySecretsDir, secrets)
+	viper.Set(config.KeyNodeID, "svr-gtw-nd1")
+	viper.Set(config.KeyNodeType, "gateway")
+	viper.Set(config.KeyRegion, "eu-1")
+	viper.Set(config.KeyLabels, map[string]string{"tier": "edge"})
+	return rendered
+}
+
+func TestRenderTemplate(t *testing.T) {
+	useTemplate(t, "Caddyfile.tmpl", "")
+	tests := []struct {
+		src, want, error string
+	}{
+		{"{{.NodeID}} {{.NodeType}} {{.Region}}", "svr-gtw-nd1 gateway eu-1", ""},
+		{`{{.Labels.tier}} {{label "tier"}} [{{label "missing"}}]`, "edge edge []", ""},
+		{`{{secret "basic-auth"}}`, "s3cret", ""},
+		{`{{.Labels.missing}}`, "", "map has no entry"},
+		{`{{secret "../shadow"}}`, "", "invalid secret name"},
+		{`{{secret ".hidden"}}`, "", "invalid secret name"},
+		{`{{secret "absent"}}`, "", `secret "absent"`},
+		{`{{.Nope}}`, "", "can't evaluate field Nope"},
+		{`{{if}}`, "", "failed to parse template"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(gatewayConfigDir, "t.tmpl")
+		os.WriteFile(path, []byte(tt.src), 0644)
+		out, err := renderTemplate(path)
+		if tt.error != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.error) {
+				t.Errorf("%s: error = %v, want %q", tt.src, err, tt.error)
+			}
+			continue
+		}
+		if err != nil || string(out) != tt.want {
+			t.Errorf("%s = %q, %v, want %q", tt.src, out, err, tt.want)
+		}
+	}
+}
+
+func TestPrepareCaddyfile(t *testing.T) {
+	rendered := useTemplate(t, "Caddyfile.tmpl", "{{.NodeID}}.example.com {\n\tbasic_auth {\n\t\tops {{secret \"basic-auth\"}}\n\t}\n}\n")
+	fake := &fakeCaddy{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	admin := useCaddyAdmin(t, srv.URL)
+
+	path, err := prepareCaddyfile(admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != rendered || caddyfilePath() != rendered {
+		t.Errorf("loads %s, want the rendered %s", path, rendered)
+	}
+	data, _ := os.ReadFile(rendered)
+	if !strings.Contains(string(data), "svr-gtw-nd1.example.com {") || !strings.Contains(string(data), "ops s3cret") {
+		t.Errorf("rendered:\n%s", data)
+	}
+	// The render holds secrets.
+	if info, _ := os.Stat(rendered); info.Mode().Perm() != 0640 {
+		t.Errorf("rendered mode = %v, want 0640", info.Mode().Perm())
+	}
+	first := renderedHash
+	if len(first) != 64 {
+		t.Errorf("rendered hash = %q", first)
+	}
+
+	// A render Caddy rejects leaves the previous one in place.
+	os.WriteFile(filepath.Join(gatewayConfigDir, "Caddyfile.tmpl"), []byte("invalid {{.NodeID}}\n"), 0644)
+	if _, err := prepareCaddyfile(admin); err == nil || !strings.Contains(err.Error(), "rendered Caddyfile is invalid") {
+		t.Fatalf("error = %v, want the adapt failure", err)
+	}
+	if after, _ := os.ReadFile(rendered); string(after) != string(data) || renderedHash != first {
+		t.Errorf("an invalid render replaced the previous one:\n%s", after)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(rendered), ".Caddyfile-*")); len(leftovers) != 0 {
+		t.Errorf("temp files left: %q", leftovers)
+	}
+
+	// Without a template the checkout's Caddyfile is loaded as is.
+	viper.Set(config.KeyCaddyTemplate, "")
+	if path, err := prepareCaddyfile(admin); err != nil || path != filepath.Join(gatewayConfigDir, "Caddyfile") {
+		t.Errorf("without a template = %s, %v", path, err)
+	}
+}
+
+// caddy-template is a path inside the checkout, even with ../ in it.
+func TestPrepareCaddyfileConfinedToCheckout(t *testing.T) {
+	useTemplate(t, "Caddyfile.tmpl", "example.com {\n}\n")
+	outside := filepath.Join(filepath.Dir(gatewayConfigDir), "outside.tmpl")
+	os.WriteFile(outside, []byte("example.com {\n}\n"), 0644)
+	viper.Set(config.KeyCaddyTemplate, "../outside.tmpl")
+
+	if _, err := prepareCaddyfile(nil); err == nil || !strings.Contains(err.Error(), "failed to read template") {
+		t.Errorf("error = %v, want the template outside the checkout to be unreadable", err)
+	}
+}
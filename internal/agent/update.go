@@ -6,9 +6,10 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"runtime"
 	"time"
+
+	"github.com/uverustech/infra-agent/internal/config"
 )
 
 func SelfUpdate(tag string, verbose bool) error {
@@ -17,6 +18,26 @@ func SelfUpdate(tag string, verbose bool) error {
 		return fmt.Errorf("could not determine executable path: %w", err)
 	}
 
+	if err := DownloadRelease(tag, exe); err != nil {
+		return err
+	}
+
+	log.Printf("[update] successfully replaced binary → restarting service")
+	// Using systemctl restart is best for systemd-managed services
+	go func() {
+		time.Sleep(1 * time.Second)
+		if err := command(config.KeyTimeoutCommand, "sudo", "systemctl", "restart", "infra-agent").Run(); err != nil {
+			log.Printf("[update] failed to restart service via systemctl: %v (trying to exit instead)", err)
+			os.Exit(0)
+		}
+	}()
+	return nil
+}
+
+// DownloadRelease fetches the release binary for this architecture to dest,
+// checks that it runs and atomically replaces dest with it. An empty tag
+// means the latest release.
+func DownloadRelease(tag, dest string) error {
 	// Normalize tag (ensure it doesn't have 'v' prefix for the URL if needed,
 	// but the user's release assets seem to be under /v1.x.x/infra-agent-linux-...)
 	// Release artifact name: infra-agent-linux-amd64 or infra-agent-linux-arm64
@@ -27,10 +48,14 @@ func SelfUpdate(tag string, verbose bool) error {
 
 	assetName := fmt.Sprintf("infra-agent-linux-%s", arch)
 	url := fmt.Sprintf("https://github.com/uverustech/infra-agent/releases/download/v%s/%s", tag, assetName)
+	if tag == "" {
+		url = fmt.Sprintf("https://github.com/uverustech/infra-agent/releases/latest/download/%s", assetName)
+	}
 
 	log.Printf("[update] downloading %s from %s", assetName, url)
 
-	resp, err := http.Get(url)
+	client := &http.Client{Timeout: config.GetDuration(config.KeyTimeoutDownload)}
+	resp, err := client.Get(url)
 	if err != nil {
 		return fmt.Errorf("http get failed: %w", err)
 	}
@@ -40,7 +65,7 @@ func SelfUpdate(tag string, verbose bool) error {
 		return fmt.Errorf("download failed: HTTP %d (tag v%s might not exist yet)", resp.StatusCode, tag)
 	}
 
-	tmp := exe + ".NEW"
+	tmp := dest + ".NEW"
 	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
 	if err != nil {
 		return fmt.Errorf("failed to create temp file %s: %w", tmp, err)
@@ -55,25 +80,15 @@ func SelfUpdate(tag string, verbose bool) error {
 	f.Close()
 
 	// Verify the new binary (basic check)
-	verifyCmd := exec.Command(tmp, "version")
+	verifyCmd := command(config.KeyTimeoutCommand, tmp, "version")
 	if out, err := verifyCmd.CombinedOutput(); err != nil {
 		os.Remove(tmp)
 		return fmt.Errorf("downloaded binary failed verification: %v (%s)", err, string(out))
 	}
 
-	if err := os.Rename(tmp, exe); err != nil {
+	if err := os.Rename(tmp, dest); err != nil {
 		os.Remove(tmp)
 		return fmt.Errorf("failed to replace binary: %w", err)
 	}
-
-	log.Printf("[update] successfully replaced binary → restarting service")
-	// Using systemctl restart is best for systemd-managed services
-	go func() {
-		time.Sleep(1 * time.Second)
-		if err := exec.Command("sudo", "systemctl", "restart", "infra-agent").Run(); err != nil {
-			log.Printf("[update] failed to restart service via systemctl: %v (trying to exit instead)", err)
-			os.Exit(0)
-		}
-	}()
 	return nil
 }
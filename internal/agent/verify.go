@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/uverustech/infra-agent/internal/config"
+	"github.com/uverustech/infra-agent/internal/timedexec"
+)
+
+// Signature policies for require-signed-commits.
+const (
+	signaturePolicyOff  = "off"
+	signaturePolicyHead = "head"
+	signaturePolicyAll  = "all"
+)
+
+// refusedSHA is the last commit GitPull refused to apply because of its
+// signature. It is cleared once a verified commit is applied.
+var refusedSHA string
+
+// verifyCommits enforces the signature policy on the commits between the
+// current HEAD and target. With "head" only the target must be signed; with
+// "all" every new commit must be, so an unsigned commit cannot be hidden
+// behind a signed one. Under "all" a target that neither descends from HEAD
+// nor is one of its ancestors means history was rewritten, and is refused.
+func verifyCommits(configDir, head, target string) error {
+	policy := config.GetString(config.KeyRequireSigned)
+	switch policy {
+	case "", signaturePolicyOff:
+		return nil
+	case signaturePolicyHead, signaturePolicyAll:
+	default:
+		return fmt.Errorf("unknown require-signed-commits policy %q", policy)
+	}
+
+	commits := []string{target}
+	if policy == signaturePolicyAll && head != "" {
+		if !isAncestor(configDir, head, target) && !isAncestor(configDir, target, head) {
+			refusedSHA = target
+			return fmt.Errorf("%s does not descend from the current commit %s, history was rewritten, refusing", shortSHA(target), shortSHA(head))
+		}
+		out, err := command(config.KeyTimeoutGit, "git", "-C", configDir, "rev-list", head+".."+target).Output()
+		if err != nil {
+			return fmt.Errorf("failed to list new commits: %v", err)
+		}
+		// Going back to an ancestor lists nothing; the target is still checked.
+		if listed := strings.Fields(string(out)); len(listed) > 0 {
+			commits = listed
+		}
+	}
+
+	for _, sha := range commits {
+		if err := verifyCommit(configDir, sha); err != nil {
+			refusedSHA = target
+			return err
+		}
+	}
+	refusedSHA = ""
+	return nil
+}
+
+// verifyCommit checks a single commit against the allowed SSH signers file
+// and/or the GPG keyring in gpg-home. git verify-commit fails for unsigned
+// commits as well as for signatures from keys it does not trust.
+func verifyCommit(configDir, sha string) error {
+	args := []string{"-C", configDir}
+	if signers := config.GetString(config.KeyAllowedSigners); signers != "" {
+		args = append(args, "-c", "gpg.ssh.allowedSignersFile="+signers)
+	}
+	args = append(args, "verify-commit", sha)
+
+	cmd := command(config.KeyTimeoutGit, "git", args...)
+	if home := config.GetString(config.KeyGPGHome); home != "" {
+		cmd.Env = append(os.Environ(), "GNUPGHOME="+home)
+	}
+	out, err := cmd.CombinedOutput()
+	if timedexec.IsTimeout(err) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("commit %s is unsigned or not signed by an allowed key, refusing: %s", shortSHA(sha), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func isAncestor(configDir, ancestor, sha string) bool {
+	return command(config.KeyTimeoutGit, "git", "-C", configDir, "merge-base", "--is-ancestor", ancestor, sha).Run() == nil
+}
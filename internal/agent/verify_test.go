@@ -0,0 +1,148 @@
+package agent
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// useGitEnv isolates git from the user's configuration and returns a temp
+// dir to work in.
+func useGitEnv(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(dir, "gitconfig"))
+	t.Setenv("GIT_AUTHOR_NAME", "ops")
+	t.Setenv("GIT_AUTHOR_EMAIL", "ops@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "ops")
+	t.Setenv("GIT_COMMITTER_EMAIL", "ops@example.com")
+	return dir
+}
+
+// signingKey generates an ed25519 key and returns the private key path and
+// the public key line.
+func signingKey(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", name, "-f", path).CombinedOutput(); err != nil {
+		t.Fatalf("ssh-keygen: %v\n%s", err, out)
+	}
+	pub, err := os.ReadFile(path + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, strings.TrimSpace(string(pub))
+}
+
+// gitCommit adds a commit in work, signed with key unless key is "".
+func gitCommit(t *testing.T, work, message, key string) string {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(work, "Caddyfile"), []byte(message+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, work, "add", "Caddyfile")
+	args := []string{"commit", "-q", "-m", message}
+	if key != "" {
+		args = append([]string{"-c", "gpg.format=ssh", "-c", "user.signingkey=" + key}, append(args, "-S")...)
+	}
+	runGit(t, work, args...)
+	return runGit(t, work, "rev-parse", "HEAD")
+}
+
+const unsignedRefusal = "unsigned or not signed by an allowed key"
+
+// TestVerifyCommits pushes signed, unsigned and wrongly signed commits to a
+// bare repo and checks them in a clone of it, as GitPull does after a fetch.
+func TestVerifyCommits(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen not available")
+	}
+	dir := useGitEnv(t)
+
+	allowed, allowedPub := signingKey(t, dir, "allowed")
+	other, _ := signingKey(t, dir, "other")
+	signers := filepath.Join(dir, "allowed_signers")
+	if err := os.WriteFile(signers, []byte("ops@example.com "+allowedPub+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bare := filepath.Join(dir, "origin.git")
+	work := filepath.Join(dir, "work")
+	runGit(t, dir, "init", "-q", "--bare", bare)
+	runGit(t, dir, "clone", "-q", bare, work)
+
+	base := gitCommit(t, work, "base", allowed)
+	unsigned := gitCommit(t, work, "unsigned", "")
+	signed := gitCommit(t, work, "signed", allowed)
+	wrongKey := gitCommit(t, work, "wrong key", other)
+	runGit(t, work, "push", "-q", "origin", "HEAD:refs/heads/main")
+	// A force-push replacing the unsigned history with a signed commit.
+	runGit(t, work, "checkout", "-q", "-b", "rewritten", base)
+	rewritten := gitCommit(t, work, "rewritten", allowed)
+	runGit(t, work, "push", "-q", "origin", "HEAD:refs/heads/rewritten")
+
+	checkout := filepath.Join(dir, "checkout")
+	runGit(t, dir, "clone", "-q", "--branch", "main", bare, checkout)
+	runGit(t, checkout, "fetch", "-q", "origin", "rewritten")
+
+	t.Cleanup(viper.Reset)
+	viper.Set(config.KeyAllowedSigners, signers)
+	viper.Set(config.KeyTimeoutGit, "30s")
+
+	tests := []struct {
+		policy       string
+		head, target string
+		ok           bool
+		refusal      string
+	}{
+		{signaturePolicyOff, base, unsigned, true, ""},
+		{signaturePolicyHead, base, signed, true, ""},
+		{signaturePolicyHead, base, unsigned, false, unsignedRefusal},
+		{signaturePolicyHead, signed, wrongKey, false, unsignedRefusal},
+		// The signed tip does not vouch for the unsigned commit before it.
+		{signaturePolicyAll, base, signed, false, unsignedRefusal},
+		{signaturePolicyAll, unsigned, signed, true, ""},
+		{signaturePolicyAll, signed, wrongKey, false, unsignedRefusal},
+		// Rolling back to a signed ancestor checks only that commit.
+		{signaturePolicyAll, signed, base, true, ""},
+		{signaturePolicyAll, signed, unsigned, false, unsignedRefusal},
+		// A signed commit on rewritten history is refused under "all" only.
+		{signaturePolicyHead, signed, rewritten, true, ""},
+		{signaturePolicyAll, signed, rewritten, false, "history was rewritten"},
+	}
+	for _, tt := range tests {
+		viper.Set(config.KeyRequireSigned, tt.policy)
+		err := verifyCommits(checkout, tt.head, tt.target)
+		if tt.ok {
+			if err != nil {
+				t.Errorf("%s %s..%s: %v", tt.policy, shortSHA(tt.head), shortSHA(tt.target), err)
+			} else if refusedSHA != "" {
+				t.Errorf("%s %s..%s: refusedSHA = %s after a verified commit", tt.policy, shortSHA(tt.head), shortSHA(tt.target), refusedSHA)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.refusal) {
+			t.Errorf("%s %s..%s: error = %v", tt.policy, shortSHA(tt.head), shortSHA(tt.target), err)
+		}
+		if refusedSHA != tt.target {
+			t.Errorf("%s %s..%s: refusedSHA = %q, want the target", tt.policy, shortSHA(tt.head), shortSHA(tt.target), refusedSHA)
+		}
+	}
+	refusedSHA = ""
+}
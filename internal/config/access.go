@@ -0,0 +1,79 @@
+package config
+
+import (
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Viper is not safe for concurrent use, and the agent changes its settings
+// at runtime (config reload, remote config) from the main loop while other
+// goroutines read them: the health handler, the SSH reconcile, log streaming
+// and actions. Settings are therefore read through the accessors below, and
+// the writes this package makes after startup hold mu.
+var mu sync.RWMutex
+
+func read[T any](get func(string) T, key string) T {
+	mu.RLock()
+	defer mu.RUnlock()
+	return get(key)
+}
+
+func GetString(key string) string          { return read(viper.GetString, key) }
+func GetBool(key string) bool              { return read(viper.GetBool, key) }
+func GetDuration(key string) time.Duration { return read(viper.GetDuration, key) }
+func GetStringSlice(key string) []string   { return read(viper.GetStringSlice, key) }
+func GetStringMapString(key string) map[string]string {
+	return read(viper.GetStringMapString, key)
+}
+func GetStringMapStringSlice(key string) map[string][]string {
+	return read(viper.GetStringMapStringSlice, key)
+}
+func InConfig(key string) bool { return read(viper.InConfig, key) }
+
+// Get returns the value of key. Maps are copied, since viper hands out the
+// maps it keeps its layers in.
+func Get(key string) interface{} {
+	mu.RLock()
+	defer mu.RUnlock()
+	return copyValue(viper.Get(key))
+}
+
+// UnmarshalKey decodes the value of key into out.
+func UnmarshalKey(key string, out interface{}) error {
+	mu.RLock()
+	defer mu.RUnlock()
+	return viper.UnmarshalKey(key, out)
+}
+
+// ConfigFileUsed returns the path of the config file in use, or "".
+func ConfigFileUsed() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return viper.ConfigFileUsed()
+}
+
+func unmarshal(out interface{}) error {
+	mu.RLock()
+	defer mu.RUnlock()
+	return viper.Unmarshal(out)
+}
+
+func allSettings() map[string]interface{} {
+	mu.RLock()
+	defer mu.RUnlock()
+	return viper.AllSettings()
+}
+
+func copyValue(value interface{}) interface{} {
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return value
+	}
+	c := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		c[k] = copyValue(v)
+	}
+	return c
+}
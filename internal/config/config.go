@@ -1,57 +1,177 @@
 package config
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 )
 
 func Init() {
+	mu.Lock()
+	defer mu.Unlock()
 	viper.SetEnvPrefix("INFRA")
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 	viper.AutomaticEnv()
+	setDefaults(viper.GetViper())
+}
 
-	// Default values
-	viper.SetDefault(KeyControlURL, "https://control.uvrs.xyz")
-	viper.SetDefault(KeyNodeType, "server")
-	viper.SetDefault(KeySSHKeyURL, "https://github.com/uverustech/secrets/ssh-keys/uvr-ops/uvr_ops.pub")
-	viper.SetDefault(KeyAutoPull, true)
+// setDefaults registers the default of every option on v.
+func setDefaults(v *viper.Viper) {
+	v.SetDefault(KeyControlURL, "https://control.uvrs.xyz")
+	v.SetDefault(KeyNodeType, "server")
+	v.SetDefault(KeySSHKeyURL, "https://github.com/uverustech/secrets/ssh-keys/uvr-ops/uvr_ops.pub")
+	v.SetDefault(KeyAutoPull, true)
+	v.SetDefault(KeyCaddyAdmin, "localhost:2019")
+	v.SetDefault(KeyCaddyRendered, "/var/lib/infra-agent/Caddyfile")
+	v.SetDefault(KeySecretsDir, "/etc/infra-agent/secrets")
+	v.SetDefault(KeyStateDir, "/var/lib/infra-agent")
+	v.SetDefault(KeyHealthAddr, "127.0.0.1:9180")
+	v.SetDefault(KeyHeartbeatInterval, "10s")
+	v.SetDefault(KeyRemoteConfig, true)
+	v.SetDefault(KeyRequireSigned, "off")
+	// Root keeps key-based access: the ssh step installs keys for root.
+	v.SetDefault(KeyPermitRootLogin, "prohibit-password")
+	v.SetDefault(KeyDisableServices, []string{"avahi-daemon", "cups", "rpcbind", "bluetooth"})
+	v.SetDefault(KeyPackages+".base", []string{"git", "curl", "jq"})
+	v.SetDefault(KeyPackages+".node-types", map[string][]string{"gateway": {"caddy"}})
+	v.SetDefault(KeyTimezone, "UTC")
+	v.SetDefault(KeyNTPServers, []string{"time.cloudflare.com", "ntp.ubuntu.com"})
+	v.SetDefault(KeyClockDriftThreshold, "500ms")
+	v.SetDefault(KeySSHKeysReconcile, "5m")
+	v.SetDefault(KeyTimeoutGit, "30s")
+	v.SetDefault(KeyTimeoutGitRemote, "1m")
+	v.SetDefault(KeyTimeoutCaddy, "30s")
+	v.SetDefault(KeyTimeoutHTTP, "10s")
+	v.SetDefault(KeyTimeoutDownload, "5m")
+	v.SetDefault(KeyTimeoutCommand, "30s")
+	// The firewall is opt-in: a default-deny policy on a node whose ports
+	// are not declared would cut it off.
+	v.SetDefault(KeyFirewall+".enabled", false)
+	v.SetDefault(KeyFirewall+".default-policy", "drop")
+	v.SetDefault(KeyFirewall+".confirm-timeout", "2m")
+	v.SetDefault(KeyFirewall+".base", []map[string]interface{}{{"port": "22", "comment": "ssh"}})
+	v.SetDefault(KeyFirewall+".node-types", map[string]interface{}{
+		"gateway": []map[string]interface{}{{"port": "80"}, {"port": "443"}, {"port": "443", "proto": "udp"}},
+	})
 }
 
 func Load() error {
-	viper.SetConfigName("infra-agent")
-	viper.SetConfigType("yaml")
-	viper.AddConfigPath(".")
-	viper.AddConfigPath("/etc/infra-agent")
+	// The remote layer sits below the file; state-dir, where it is kept, is
+	// not remote-managed.
+	defer LoadRemote()
 
-	if err := viper.ReadInConfig(); err != nil {
+	if err := readInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
 			return nil
 		}
 		return fmt.Errorf("failed to read config: %w", err)
 	}
-	log.Printf("Using config file: %s", viper.ConfigFileUsed())
+	file := ConfigFileUsed()
+	log.Printf("Using config file: %s", file)
+	loaded, _ = os.ReadFile(file)
+	if keys := PlaintextSecrets(); len(keys) > 0 {
+		log.Printf("Warning: %s is readable by all users and contains %s in plaintext; move it to the secret store with 'infra-agent config set %s <value>'",
+			file, strings.Join(keys, ", "), keys[0])
+	}
 	return nil
 }
 
-func Save() error {
-	filename := viper.ConfigFileUsed()
-	if filename == "" {
-		// Try to use /etc/infra-agent/infra-agent.yaml if writable, otherwise local
-		const defaultPath = "/etc/infra-agent"
-		const defaultFile = defaultPath + "/infra-agent.yaml"
+func readInConfig() error {
+	mu.Lock()
+	defer mu.Unlock()
+	viper.SetConfigName("infra-agent")
+	viper.SetConfigType("yaml")
+	viper.AddConfigPath(".")
+	viper.AddConfigPath("/etc/infra-agent")
+	return viper.ReadInConfig()
+}
+
+// loaded is the content of the config file currently in effect, restored
+// when a reload is rejected.
+var loaded []byte
 
-		if err := os.MkdirAll(defaultPath, 0755); err == nil {
-			filename = defaultFile
-		} else {
-			filename = "infra-agent.yaml"
+// Reload re-reads the config file and validates the result. If the file
+// cannot be parsed or is invalid, the previous settings are restored and the
+// error returned.
+func Reload() (*Config, error) {
+	file := ConfigFileUsed()
+	if file == "" {
+		return Current()
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	cfg, err := readConfig(data)
+	if err != nil {
+		if _, rerr := readConfig(loaded); rerr != nil {
+			log.Printf("Failed to restore previous config: %v", rerr)
 		}
+		return nil, err
+	}
+	loaded = data
+	return cfg, nil
+}
+
+func readConfig(data []byte) (*Config, error) {
+	mu.Lock()
+	err := viper.ReadConfig(bytes.NewReader(data))
+	mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", ConfigFileUsed(), err)
+	}
+	return Current()
+}
+
+// Watch calls onChange when the config file is written or replaced (editors
+// often save by renaming a new file over the old one, so the directory is
+// watched). Bursts of events are coalesced. Without a config file it does
+// nothing.
+func Watch(onChange func()) error {
+	file := ConfigFileUsed()
+	if file == "" {
+		return nil
+	}
+	file = filepath.Clean(file)
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
 	}
-	log.Printf("Saving configuration to: %s", filename)
-	return viper.WriteConfigAs(filename)
+	if err := w.Add(filepath.Dir(file)); err != nil {
+		w.Close()
+		return err
+	}
+	go func() {
+		var pending *time.Timer
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(ev.Name) != file || ev.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+				if pending != nil {
+					pending.Stop()
+				}
+				pending = time.AfterFunc(500*time.Millisecond, onChange)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Config watch error: %v", err)
+			}
+		}
+	}()
+	return nil
 }
 
 func MaskSecret(s string) string {
@@ -0,0 +1,221 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultConfigDir  = "/etc/infra-agent"
+	defaultConfigFile = defaultConfigDir + "/infra-agent.yaml"
+)
+
+// configPath is the file `config set` and `config unset` edit: the one that
+// was loaded, or /etc/infra-agent/infra-agent.yaml (falling back to the
+// working directory if /etc is not writable).
+func configPath() string {
+	if file := ConfigFileUsed(); file != "" {
+		return file
+	}
+	if err := os.MkdirAll(defaultConfigDir, 0755); err == nil {
+		return defaultConfigFile
+	}
+	return "infra-agent.yaml"
+}
+
+// Set stores value at key in the config file and reloads it. Only that key
+// is written: comments, key order and the other settings in the file are
+// kept, and defaults, flags and environment variables stay out of it. Secret
+// options go to the secret store instead.
+func Set(key string, value interface{}) error {
+	if IsSecret(key) {
+		return setSecret(key, fmt.Sprint(value))
+	}
+	path := configPath()
+	doc, err := readDoc(path)
+	if err != nil {
+		return err
+	}
+	var node yaml.Node
+	if err := node.Encode(value); err != nil {
+		return err
+	}
+	setNode(root(doc), strings.Split(key, "."), &node)
+	return writeDoc(path, doc)
+}
+
+// Unset removes key from the config file, so that the next source in line
+// (environment, default) applies. Secret options are removed from the secret
+// store as well. It reports whether the key was present.
+func Unset(key string) (bool, error) {
+	removed, err := unsetInFile(key)
+	if err != nil || !IsSecret(key) {
+		return removed, err
+	}
+	stored, err := unsetSecret(key)
+	return removed || stored, err
+}
+
+func unsetInFile(key string) (bool, error) {
+	path := configPath()
+	doc, err := readDoc(path)
+	if err != nil {
+		return false, err
+	}
+	if !deleteNode(root(doc), strings.Split(key, ".")) {
+		return false, nil
+	}
+	return true, writeDoc(path, doc)
+}
+
+func readDoc(path string) (*yaml.Node, error) {
+	doc := &yaml.Node{Kind: yaml.DocumentNode}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return doc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, doc); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return doc, nil
+}
+
+// root returns the top-level mapping of doc, creating it for an empty file.
+func root(doc *yaml.Node) *yaml.Node {
+	if len(doc.Content) == 0 {
+		doc.Kind = yaml.DocumentNode
+		doc.Content = []*yaml.Node{{Kind: yaml.MappingNode}}
+	}
+	return doc.Content[0]
+}
+
+func setNode(m *yaml.Node, path []string, value *yaml.Node) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			m.Content[i+1] = value
+			return
+		}
+		if m.Content[i+1].Kind != yaml.MappingNode {
+			m.Content[i+1] = &yaml.Node{Kind: yaml.MappingNode}
+		}
+		setNode(m.Content[i+1], path[1:], value)
+		return
+	}
+	key := &yaml.Node{Kind: yaml.ScalarNode, Value: path[0]}
+	if len(path) == 1 {
+		m.Content = append(m.Content, key, value)
+		return
+	}
+	child := &yaml.Node{Kind: yaml.MappingNode}
+	m.Content = append(m.Content, key, child)
+	setNode(child, path[1:], value)
+}
+
+func deleteNode(m *yaml.Node, path []string) bool {
+	if m.Kind != yaml.MappingNode {
+		return false
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			m.Content = append(m.Content[:i], m.Content[i+2:]...)
+			return true
+		}
+		return deleteNode(m.Content[i+1], path[1:])
+	}
+	return false
+}
+
+// writeDoc replaces the config file with doc, keeping its permissions, and
+// makes viper read it again.
+func writeDoc(path string, doc *yaml.Node) error {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	enc.Close()
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".infra-agent-*.yaml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	log.Printf("Saved configuration to: %s", path)
+
+	mu.Lock()
+	viper.SetConfigFile(path)
+	err = viper.ReadInConfig()
+	mu.Unlock()
+	if err != nil {
+		return err
+	}
+	loaded = buf.Bytes()
+	return nil
+}
+
+// fileString returns the scalar value of the top-level key in the config
+// file, or "".
+func fileString(key string) string {
+	doc, err := readDoc(ConfigFileUsed())
+	if err != nil || len(doc.Content) == 0 {
+		return ""
+	}
+	m := doc.Content[0]
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key && m.Content[i+1].Kind == yaml.ScalarNode {
+			return m.Content[i+1].Value
+		}
+	}
+	return ""
+}
+
+// fileLine returns the line of the top-level key in the config file, or 0.
+func fileLine(key string) int {
+	doc, err := readDoc(ConfigFileUsed())
+	if err != nil || len(doc.Content) == 0 {
+		return 0
+	}
+	m := doc.Content[0]
+	top := strings.SplitN(key, ".", 2)[0]
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == top {
+			return m.Content[i].Line
+		}
+	}
+	return 0
+}
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// useConfigFile loads content as the config file from a temp dir and returns
+// its path. Systemd credentials are cleared.
+func useConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	viper.Reset()
+	Init()
+	t.Cleanup(func() {
+		setRemoteLayer(nil)
+		viper.Reset()
+	})
+	t.Setenv("CREDENTIALS_DIRECTORY", "")
+	path := filepath.Join(t.TempDir(), "infra-agent.yaml")
+	if err := os.WriteFile(path, []byte(content), 0640); err != nil {
+		t.Fatal(err)
+	}
+	viper.SetConfigFile(path)
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSetKeepsFile(t *testing.T) {
+	path := useConfigFile(t, "# node identity\nnode-id: gw-1 # set by install\nheartbeat-interval: 10s\n")
+
+	if err := Set(KeyHeartbeatInterval, "20s"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Set(KeyFirewall+".enabled", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := Set(KeyLogUnits, []string{"caddy"}); err != nil {
+		t.Fatal(err)
+	}
+	want := "# node identity\nnode-id: gw-1 # set by install\nheartbeat-interval: 20s\nfirewall:\n  enabled: true\nlog-units:\n  - caddy\n"
+	if data, _ := os.ReadFile(path); string(data) != want {
+		t.Errorf("config file:\n%s\nwant:\n%s", data, want)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0640 {
+		t.Errorf("mode = %v, want 0640", info.Mode().Perm())
+	}
+	// Defaults are not written out, and the file is read again.
+	if GetString(KeyHeartbeatInterval) != "20s" || !GetBool(KeyFirewall+".enabled") {
+		t.Error("viper was not reloaded")
+	}
+
+	removed, err := Unset(KeyHeartbeatInterval)
+	if err != nil || !removed {
+		t.Fatalf("Unset() = %v, %v", removed, err)
+	}
+	if removed, err := Unset(KeyHeartbeatInterval); err != nil || removed {
+		t.Errorf("second Unset() = %v, %v", removed, err)
+	}
+	if removed, err := Unset(KeyFirewall + ".default-policy"); err != nil || removed {
+		t.Errorf("Unset() of a missing sub-key = %v, %v", removed, err)
+	}
+	if removed, _ := Unset(KeyFirewall + ".enabled"); !removed {
+		t.Error("sub-key not removed")
+	}
+	if GetString(KeyHeartbeatInterval) != "10s" {
+		t.Errorf("%s = %q after unset, want the default", KeyHeartbeatInterval, GetString(KeyHeartbeatInterval))
+	}
+}
+
+func TestSetCreatesFile(t *testing.T) {
+	path := useConfigFile(t, "")
+	os.Remove(path)
+
+	if err := Set(KeyNodeID, "gw-2"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "node-id: gw-2\n" {
+		t.Errorf("config file = %q", data)
+	}
+}
@@ -1,5 +1,12 @@
 package config
 
+import "time"
+
+// Watchdog is the WatchdogSec of the agent's systemd unit. The main loop
+// must complete an iteration within it, so the agent runs each iteration
+// under a deadline below it.
+const Watchdog = 120 * time.Second
+
 const (
 	KeyNodeID      = "node-id"
 	KeyNodeType    = "node-type"
@@ -9,4 +16,53 @@ const (
 	KeyVerbose     = "verbose"
 	KeyAutoConfirm = "yes"
 	KeyAutoPull    = "auto-pull"
+	KeyCaddyAdmin  = "caddy-admin"
+
+	KeyCaddyTemplate = "caddy-template"
+	KeyCaddyRendered = "caddy-rendered-path"
+	KeyRegion        = "region"
+	KeyLabels        = "labels"
+	KeySecretsDir    = "secrets-dir"
+
+	KeyStateDir   = "state-dir"
+	KeyHealthAddr = "health-addr"
+
+	KeyHeartbeatInterval = "heartbeat-interval"
+	KeyLogUnits          = "log-units"
+	KeyRemoteConfig      = "remote-config"
+
+	KeyConfigBranch = "config-branch"
+	KeyProbeURLs    = "probe-urls"
+
+	KeyRequireSigned  = "require-signed-commits"
+	KeyAllowedSigners = "allowed-signers"
+	KeyGPGHome        = "gpg-home"
+
+	KeyPermitRootLogin = "hardening-permit-root-login"
+	KeyAllowUsers      = "hardening-allow-users"
+	KeyDisableServices = "hardening-disable-services"
+
+	KeyPackages = "packages"
+
+	KeyTimezone            = "timezone"
+	KeyNTPServers          = "ntp-servers"
+	KeyClockDriftThreshold = "clock-drift-threshold"
+
+	KeySSHKeys          = "ssh-keys"
+	KeySSHKeysReconcile = "ssh-keys-reconcile-interval"
+	KeySSHCAKeyURL      = "ssh-ca-key-url"
+	KeySSHPrincipals    = "ssh-principals"
+
+	KeyUsers    = "users"
+	KeyGroups   = "groups"
+	KeyUsersURL = "users-url"
+
+	KeyFirewall = "firewall"
+
+	KeyTimeoutGit       = "git-timeout"
+	KeyTimeoutGitRemote = "git-remote-timeout"
+	KeyTimeoutCaddy     = "caddy-timeout"
+	KeyTimeoutHTTP      = "http-timeout"
+	KeyTimeoutDownload  = "download-timeout"
+	KeyTimeoutCommand   = "command-timeout"
 )
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Setting is the effective value of one option and the source it came from,
+// following viper's precedence: flag, environment, config file, the remote
+// config, then the secret store and systemd credentials for secrets, and the
+// default.
+type Setting struct {
+	Key    string      `json:"key"`
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`           // flag, env, file, remote, store, credential, default or unset
+	Origin string      `json:"origin,omitempty"` // e.g. --node-id, INFRA_NODE_ID, /etc/infra-agent/infra-agent.yaml:3
+	Secret bool        `json:"secret,omitempty"`
+}
+
+// Settings resolves every option, sorted by key. flags are the command's
+// flags (bound flags count only when given on the command line); nil skips
+// them.
+func Settings(flags *pflag.FlagSet) []Setting {
+	var settings []Setting
+	for _, o := range options() {
+		settings = append(settings, Resolve(o.Key, flags))
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Key < settings[j].Key })
+	return settings
+}
+
+// Resolve returns the effective value of key and where it was set.
+func Resolve(key string, flags *pflag.FlagSet) Setting {
+	s := Setting{Key: key, Value: Get(key), Secret: IsSecret(key)}
+	if _, ok := s.Value.(map[string]interface{}); ok {
+		// Get returns only the highest layer of a map; AllSettings merges
+		// the file's sub-keys with the defaults the way they are read.
+		s.Value = allSettings()[key]
+	}
+	switch {
+	case flags != nil && flags.Lookup(key) != nil && flags.Lookup(key).Changed:
+		s.Source, s.Origin = "flag", "--"+key
+	case os.Getenv(EnvVar(key)) != "":
+		s.Source, s.Origin = "env", EnvVar(key)
+	case InConfig(key):
+		s.Source, s.Origin = "file", ConfigFileUsed()
+		if line := fileLine(key); line > 0 {
+			s.Origin = fmt.Sprintf("%s:%d", s.Origin, line)
+		}
+	case remoteSets(key):
+		s.Source, s.Origin = "remote", "control plane revision "+RemoteRevision()
+	case s.Secret:
+		value, source, err := secretValue(key)
+		switch {
+		case err != nil || value == "":
+			s.Source = "unset"
+		case source == "store":
+			s.Value, s.Source, s.Origin = value, "store", secretStorePath()
+		default:
+			s.Value, s.Source, s.Origin = value, "credential", credentialPath(key)
+		}
+	case defaults().IsSet(key):
+		s.Source = "default"
+	default:
+		s.Source = "unset"
+	}
+	return s
+}
+
+// Masked returns s with a secret value shortened for display.
+func (s Setting) Masked() Setting {
+	if str, ok := s.Value.(string); ok && s.Secret && str != "" {
+		s.Value = MaskSecret(str)
+	}
+	return s
+}
+
+// EnvVar is the environment variable viper reads key from.
+func EnvVar(key string) string {
+	return "INFRA_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+}
+
+// IsSecret reports whether key holds a credential that must not be printed.
+func IsSecret(key string) bool {
+	o, ok := lookupOption(strings.SplitN(key, ".", 2)[0])
+	return ok && o.Field.Tag.Get("secret") == "true"
+}
+
+// Default returns the default value of key, or nil if it has none.
+func Default(key string) interface{} {
+	return defaults().Get(key)
+}
+
+// ChangedFromDefaults returns the options whose effective value differs from
+// their default, compared after decoding so that "10s" from a file and a
+// 10s default are equal.
+func ChangedFromDefaults() ([]string, error) {
+	var def, cur Config
+	if err := defaults().Unmarshal(&def); err != nil {
+		return nil, err
+	}
+	if err := unmarshal(&cur); err != nil {
+		return nil, err
+	}
+	changed := Diff(&def, &cur)
+	sort.Strings(changed)
+	return changed, nil
+}
+
+func defaults() *viper.Viper {
+	v := viper.New()
+	setDefaults(v)
+	return v
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestResolve(t *testing.T) {
+	path := useConfigFile(t, "node-id: gw-1\ntimezone: Europe/Berlin\nfirewall:\n  enabled: true\n")
+	setRemoteLayer(&RemoteConfig{Revision: "r7", Config: map[string]interface{}{KeyClockDriftThreshold: "1s", KeyTimezone: "UTC"}})
+	t.Setenv(EnvVar(KeyLogUnits), "caddy")
+	creds := t.TempDir()
+	os.WriteFile(filepath.Join(creds, KeyGithubToken), []byte("ghp_0123456789abcdef\n"), 0600)
+	t.Setenv("CREDENTIALS_DIRECTORY", creds)
+
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.String(KeyRegion, "", "")
+	flags.String(KeyNodeType, "", "")
+	flags.Parse([]string{"--region", "eu"})
+
+	tests := []struct {
+		key    string
+		source string
+		origin string
+	}{
+		{KeyRegion, "flag", "--region"},
+		// A flag that was not given does not count.
+		{KeyNodeType, "default", ""},
+		{KeyLogUnits, "env", "INFRA_LOG_UNITS"},
+		{KeyNodeID, "file", path + ":1"},
+		// The file wins over the remote layer.
+		{KeyTimezone, "file", path + ":2"},
+		{KeyFirewall, "file", path + ":3"},
+		{KeyClockDriftThreshold, "remote", "control plane revision r7"},
+		{KeyGithubToken, "credential", filepath.Join(creds, KeyGithubToken)},
+		{KeyHealthAddr, "default", ""},
+		{KeyLabels, "unset", ""},
+	}
+	for _, tt := range tests {
+		s := Resolve(tt.key, flags)
+		if s.Source != tt.source || s.Origin != tt.origin {
+			t.Errorf("%s: source %s (%s), want %s (%s)", tt.key, s.Source, s.Origin, tt.source, tt.origin)
+		}
+	}
+
+	// A map is reported merged with its defaults.
+	fw := Resolve(KeyFirewall, nil).Value.(map[string]interface{})
+	if fw["enabled"] != true || fw["default-policy"] != "drop" {
+		t.Errorf("firewall = %v", fw)
+	}
+
+	token := Resolve(KeyGithubToken, nil)
+	if !token.Secret || token.Value != "ghp_0123456789abcdef" || token.Masked().Value != "ghp_....cdef" {
+		t.Errorf("token = %+v, masked %v", token, token.Masked().Value)
+	}
+	if s := Resolve(KeyNodeID, nil).Masked(); s.Value != "gw-1" {
+		t.Errorf("masked non-secret = %v", s.Value)
+	}
+
+	settings := Settings(nil)
+	if len(settings) != len(options()) || settings[0].Key > settings[1].Key {
+		t.Errorf("Settings() returned %d unsorted settings", len(settings))
+	}
+}
+
+func TestChangedFromDefaults(t *testing.T) {
+	// 10s in the file equals the 10s default once decoded.
+	useConfigFile(t, "heartbeat-interval: 10s\ntimezone: Europe/Berlin\nfirewall:\n  enabled: true\n")
+
+	changed, err := ChangedFromDefaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{KeyFirewall, KeyTimezone}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("ChangedFromDefaults() = %q, want %q", changed, want)
+	}
+	if Default(KeyTimezone) != "UTC" || Default(KeyRegion) != nil {
+		t.Errorf("Default() = %v, %v", Default(KeyTimezone), Default(KeyRegion))
+	}
+}
@@ -0,0 +1,169 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// RemoteConfig is the configuration the control plane wants for this node.
+// It is layered between the config file and the defaults: every key set
+// locally (flag, environment, config file) still wins, so a node can
+// override a fleet-wide value one key at a time.
+type RemoteConfig struct {
+	Revision  string                 `json:"revision"`
+	Config    map[string]interface{} `json:"config"`
+	FetchedAt time.Time              `json:"fetched_at"`
+}
+
+// remoteLocked are the keys the control plane cannot set: the node's
+// identity and type, the way back to the control plane, local-only
+// switches, everything that decides who can log in or which config commits
+// are trusted, what gets installed as root, and the paths and endpoints the
+// root agent reads, writes or sends rendered secrets to. A compromised
+// control plane must not be able to grant itself root on the fleet or turn
+// off the signature check.
+var remoteLocked = []string{
+	KeyNodeID, KeyNodeType, KeyControlURL, KeyStateDir, KeyRemoteConfig, KeyAutoConfirm, KeyVerbose,
+	KeyRequireSigned, KeyAllowedSigners, KeyGPGHome, KeyConfigBranch,
+	KeySSHKeys, KeySSHKeyURL, KeySSHKeysReconcile, KeySSHCAKeyURL, KeySSHPrincipals,
+	KeyUsers, KeyGroups, KeyUsersURL, KeyFirewall,
+	KeyPermitRootLogin, KeyAllowUsers, KeyDisableServices,
+	KeyPackages,
+	KeyCaddyAdmin, KeyCaddyTemplate, KeyCaddyRendered, KeySecretsDir, KeyHealthAddr,
+}
+
+// remoteAllowed reports whether the remote layer may set key. Sub-keys
+// (packages.repositories) are locked with their option.
+func remoteAllowed(key string) bool {
+	option := strings.SplitN(key, ".", 2)[0]
+	return CheckKey(key) == nil && !IsSecret(key) && !containsString(remoteLocked, option)
+}
+
+// remote is the applied document; remoteLeaves its flattened values.
+var (
+	remote       *RemoteConfig
+	remoteLeaves map[string]interface{}
+)
+
+func remoteConfigFile() string {
+	return filepath.Join(GetString(KeyStateDir), "remote-config.json")
+}
+
+// RemoteRevision returns the revision of the applied remote config, or "".
+func RemoteRevision() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	if remote == nil {
+		return ""
+	}
+	return remote.Revision
+}
+
+// LoadRemote applies the last remote config received, so a node that boots
+// without reaching the control plane runs with the fleet settings it had.
+func LoadRemote() {
+	data, err := os.ReadFile(remoteConfigFile())
+	if err != nil {
+		return
+	}
+	var doc RemoteConfig
+	if err := json.Unmarshal(data, &doc); err != nil {
+		log.Printf("Ignoring %s: %v", remoteConfigFile(), err)
+		return
+	}
+	setRemoteLayer(&doc)
+}
+
+// ApplyRemote validates the configuration that results from doc and, if it
+// is valid, makes doc the remote layer and persists it. Otherwise the
+// previous layer is kept.
+func ApplyRemote(doc *RemoteConfig) (*Config, error) {
+	previous := remote
+	setRemoteLayer(doc)
+	cfg, err := Current()
+	if err != nil {
+		setRemoteLayer(previous)
+		return nil, fmt.Errorf("remote config %s rejected:\n%w", doc.Revision, err)
+	}
+	data, _ := json.MarshalIndent(doc, "", "  ")
+	if err := os.MkdirAll(filepath.Dir(remoteConfigFile()), 0755); err != nil {
+		return cfg, err
+	}
+	return cfg, os.WriteFile(remoteConfigFile(), data, 0600)
+}
+
+// ClearRemote drops the remote layer, e.g. when the control plane no longer
+// manages this node, and returns the resulting configuration.
+func ClearRemote() (*Config, error) {
+	setRemoteLayer(nil)
+	if err := os.Remove(remoteConfigFile()); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return Current()
+}
+
+// setRemoteLayer installs doc's values as viper defaults, restoring the
+// built-in default of every key the previous document set.
+func setRemoteLayer(doc *RemoteConfig) {
+	mu.Lock()
+	defer mu.Unlock()
+	base := defaults()
+	for key := range remoteLeaves {
+		viper.SetDefault(key, base.Get(key))
+	}
+	remote, remoteLeaves = doc, nil
+	if doc == nil {
+		return
+	}
+
+	remoteLeaves = map[string]interface{}{}
+	var ignored []string
+	for key, value := range doc.Config {
+		if !remoteAllowed(key) {
+			ignored = append(ignored, key)
+			continue
+		}
+		flatten(key, value, remoteLeaves)
+	}
+	if len(ignored) > 0 {
+		sort.Strings(ignored)
+		log.Printf("Remote config %s: ignoring %s", doc.Revision, strings.Join(ignored, ", "))
+	}
+	for key, value := range remoteLeaves {
+		viper.SetDefault(key, value)
+	}
+}
+
+// flatten splits nested maps into dotted leaf keys, so that a remote
+// firewall.enabled leaves the other firewall defaults in place.
+func flatten(key string, value interface{}, out map[string]interface{}) {
+	m, ok := value.(map[string]interface{})
+	if !ok || len(m) == 0 {
+		out[key] = value
+		return
+	}
+	for k, v := range m {
+		flatten(key+"."+k, v, out)
+	}
+}
+
+// remoteSets reports whether the remote layer sets key or one of its
+// sub-keys.
+func remoteSets(key string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	for leaf := range remoteLeaves {
+		if leaf == key || strings.HasPrefix(leaf, key+".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func useRemote(t *testing.T, doc map[string]interface{}) {
+	t.Helper()
+	viper.Reset()
+	Init()
+	t.Cleanup(func() {
+		setRemoteLayer(nil)
+		viper.Reset()
+	})
+	setRemoteLayer(&RemoteConfig{Revision: "r1", Config: doc})
+}
+
+func TestRemoteLockedKeysIgnored(t *testing.T) {
+	doc := map[string]interface{}{}
+	for _, key := range remoteLocked {
+		doc[key] = "from-remote"
+	}
+	doc[KeyGithubToken] = "from-remote"
+	doc[KeyHeartbeatInterval] = "30s"
+	useRemote(t, doc)
+
+	base := defaults()
+	for _, key := range append(remoteLocked, KeyGithubToken) {
+		if got, want := viper.Get(key), base.Get(key); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s = %v, want the default %v", key, got, want)
+		}
+		if remoteSets(key) {
+			t.Errorf("remoteSets(%s) = true for a locked key", key)
+		}
+	}
+	if got := GetString(KeyHeartbeatInterval); got != "30s" {
+		t.Errorf("%s = %q, the unlocked key was not applied", KeyHeartbeatInterval, got)
+	}
+}
+
+// Sub-keys are locked with their option, whether sent nested or dotted.
+func TestRemoteLockedSubKeysIgnored(t *testing.T) {
+	useRemote(t, map[string]interface{}{
+		KeyPackages: map[string]interface{}{
+			"repositories": []interface{}{map[string]interface{}{
+				"name": "evil", "uri": "https://evil.example/deb", "key-url": "https://evil.example/key",
+			}},
+		},
+		KeyPackages + ".base":       []interface{}{"backdoor"},
+		KeyFirewall + ".enabled":    false,
+		KeyFirewall + ".node-types": map[string]interface{}{},
+	})
+
+	if got := GetStringSlice(KeyPackages + ".base"); !reflect.DeepEqual(got, []string{"git", "curl", "jq"}) {
+		t.Errorf("packages.base = %q", got)
+	}
+	if got := Get(KeyPackages + ".repositories"); got != nil {
+		t.Errorf("packages.repositories = %v", got)
+	}
+	if remoteSets(KeyPackages) || remoteSets(KeyFirewall) {
+		t.Error("remote layer set a locked option through a sub-key")
+	}
+}
+
+func TestRemoteLayerReplaced(t *testing.T) {
+	useRemote(t, map[string]interface{}{KeyHeartbeatInterval: "30s", KeyLogUnits: []interface{}{"caddy"}})
+	setRemoteLayer(&RemoteConfig{Revision: "r2", Config: map[string]interface{}{KeyHeartbeatInterval: "20s"}})
+
+	if got := GetString(KeyHeartbeatInterval); got != "20s" {
+		t.Errorf("%s = %q, want the new revision's value", KeyHeartbeatInterval, got)
+	}
+	if got := Get(KeyLogUnits); got != nil {
+		t.Errorf("%s = %v, a key dropped by the new revision was kept", KeyLogUnits, got)
+	}
+	if RemoteRevision() != "r2" {
+		t.Errorf("revision = %q", RemoteRevision())
+	}
+}
@@ -0,0 +1,449 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Config is the typed view of the agent configuration. Field tags drive
+// decoding (mapstructure), validation (format, enum) and the JSON Schema
+// printed by `config schema` (desc). Structured settings that belong to a
+// setup step (packages, firewall, users) are only checked for their shape
+// here; the step validates their contents.
+type Config struct {
+	NodeID      string `mapstructure:"node-id" desc:"Unique node name, e.g. svr-gtw-nd1.uvrs.xyz"`
+	NodeType    string `mapstructure:"node-type" format:"node-type" desc:"gateway, server or service, optionally with a subtype (server:build)"`
+	ControlURL  string `mapstructure:"control-url" format:"url" desc:"Control plane base URL"`
+	GithubToken string `mapstructure:"github-token" secret:"true" desc:"Token for private GitHub repository files"`
+	SSHKeyURL   string `mapstructure:"ssh-key-url" format:"url" desc:"Key file installed when ssh-keys is not set"`
+	Verbose     bool   `mapstructure:"verbose" desc:"Verbose output"`
+	AutoConfirm bool   `mapstructure:"yes" desc:"Answer yes to setup prompts"`
+	AutoPull    bool   `mapstructure:"auto-pull" desc:"Pull and reload the gateway config every tick"`
+
+	CaddyAdmin    string            `mapstructure:"caddy-admin" format:"caddy-admin" desc:"Caddy admin API: host:port, http://host:port, unix//path or off"`
+	CaddyTemplate string            `mapstructure:"caddy-template" desc:"Caddyfile template in the config checkout"`
+	CaddyRendered string            `mapstructure:"caddy-rendered-path" desc:"Where the rendered Caddyfile is written"`
+	Region        string            `mapstructure:"region" desc:"Region exposed to templates and principals"`
+	Labels        map[string]string `mapstructure:"labels" desc:"Free-form node labels"`
+	SecretsDir    string            `mapstructure:"secrets-dir" desc:"Directory read by the template secret function"`
+	StateDir      string            `mapstructure:"state-dir" desc:"Agent state directory"`
+	HealthAddr    string            `mapstructure:"health-addr" format:"hostport" desc:"Listen address of the /health endpoint"`
+
+	HeartbeatInterval time.Duration `mapstructure:"heartbeat-interval" range:"1s,1m" desc:"Main loop interval: pull, reload and heartbeat"`
+	LogUnits          []string      `mapstructure:"log-units" desc:"systemd units whose journal is streamed to the control plane (default: all)"`
+	RemoteConfig      bool          `mapstructure:"remote-config" desc:"Apply the configuration the control plane manages for this node"`
+
+	ConfigBranch string   `mapstructure:"config-branch" desc:"Branch of the config repo to follow (default: origin's default branch)"`
+	ProbeURLs    []string `mapstructure:"probe-urls" format:"url" desc:"URLs probed after each reload"`
+
+	RequireSigned  string `mapstructure:"require-signed-commits" enum:"off,head,all" desc:"Which config commits must carry a trusted signature"`
+	AllowedSigners string `mapstructure:"allowed-signers" desc:"git allowed signers file for SSH signatures"`
+	GPGHome        string `mapstructure:"gpg-home" desc:"GNUPGHOME with trusted keys for GPG signatures"`
+
+	PermitRootLogin string   `mapstructure:"hardening-permit-root-login" enum:"yes,no,prohibit-password,forced-commands-only" desc:"sshd PermitRootLogin"`
+	AllowUsers      []string `mapstructure:"hardening-allow-users" desc:"sshd AllowUsers"`
+	DisableServices []string `mapstructure:"hardening-disable-services" desc:"Services disabled by the hardening step"`
+
+	Packages map[string]interface{} `mapstructure:"packages" desc:"Declared packages: base, node-types, pinned, remove, repositories"`
+
+	Timezone            string        `mapstructure:"timezone" desc:"IANA time zone"`
+	NTPServers          []string      `mapstructure:"ntp-servers" desc:"NTP servers for time sync and the clock check"`
+	ClockDriftThreshold time.Duration `mapstructure:"clock-drift-threshold" desc:"Clock offset reported as unhealthy"`
+
+	SSHKeys          map[string][]string `mapstructure:"ssh-keys" desc:"Key sources per local user"`
+	SSHKeysReconcile time.Duration       `mapstructure:"ssh-keys-reconcile-interval" zero:"off" desc:"How often the agent re-applies SSH keys and CA (0 disables)"`
+	SSHCAKeyURL      string              `mapstructure:"ssh-ca-key-url" desc:"Source of the trusted user CA key(s)"`
+	SSHPrincipals    map[string][]string `mapstructure:"ssh-principals" desc:"Certificate principals per local user"`
+
+	Users    []map[string]interface{} `mapstructure:"users" desc:"Declared local users"`
+	Groups   []map[string]interface{} `mapstructure:"groups" desc:"Declared local groups"`
+	UsersURL string                   `mapstructure:"users-url" format:"url" desc:"Users file in the private config repo"`
+
+	Firewall map[string]interface{} `mapstructure:"firewall" desc:"Host firewall policy: enabled, default-policy, confirm-timeout, base, node-types"`
+
+	// Deadlines of calls made by the main loop must leave it time to ping the
+	// watchdog, or systemd kills the agent before the timeout is reported.
+	// Together they can exceed it; the agent cuts them short at the end of
+	// the iteration.
+	TimeoutGit       time.Duration `mapstructure:"git-timeout" watchdog:"true" desc:"Deadline for local git commands"`
+	TimeoutGitRemote time.Duration `mapstructure:"git-remote-timeout" watchdog:"true" desc:"Deadline for git fetch and ls-remote"`
+	TimeoutCaddy     time.Duration `mapstructure:"caddy-timeout" watchdog:"true" desc:"Deadline for caddy commands and admin API calls"`
+	TimeoutHTTP      time.Duration `mapstructure:"http-timeout" watchdog:"true" desc:"Deadline for control plane requests"`
+	TimeoutDownload  time.Duration `mapstructure:"download-timeout" desc:"Deadline for release downloads"`
+	TimeoutCommand   time.Duration `mapstructure:"command-timeout" watchdog:"true" desc:"Deadline for other commands"`
+}
+
+var nodeTypePattern = regexp.MustCompile(`^(gateway|server|service)(:[a-z0-9][a-z0-9-]*)*$`)
+
+// option is one top-level key of Config.
+type option struct {
+	Key   string
+	Field reflect.StructField
+}
+
+func options() []option {
+	t := reflect.TypeOf(Config{})
+	opts := make([]option, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		opts = append(opts, option{Key: f.Tag.Get("mapstructure"), Field: f})
+	}
+	return opts
+}
+
+func lookupOption(key string) (option, bool) {
+	for _, o := range options() {
+		if o.Key == key {
+			return o, true
+		}
+	}
+	return option{}, false
+}
+
+// Current decodes the effective configuration (flags, environment, config
+// file and defaults) and validates it.
+func Current() (*Config, error) {
+	var cfg Config
+	if err := unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	if errs := cfg.Validate(); len(errs) > 0 {
+		return &cfg, ValidationError(errs)
+	}
+	return &cfg, nil
+}
+
+// ValidationError lists every invalid setting found by Current.
+type ValidationError []error
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Validate checks every field against its format and enum tags.
+func (c *Config) Validate() []error {
+	var errs []error
+	v := reflect.ValueOf(*c)
+	for i, o := range options() {
+		field := v.Field(i)
+		if d, ok := field.Interface().(time.Duration); ok {
+			if err := checkDuration(o.Field, d); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", o.Key, err))
+			}
+			continue
+		}
+		var values []string
+		switch field.Kind() {
+		case reflect.String:
+			values = []string{field.String()}
+		case reflect.Slice:
+			if s, ok := field.Interface().([]string); ok {
+				values = s
+			}
+		}
+		for _, value := range values {
+			if err := checkValue(o.Field, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", o.Key, err))
+			}
+		}
+	}
+	return errs
+}
+
+// checkValue validates one string value. Empty values mean "unset" and are
+// accepted.
+func checkValue(f reflect.StructField, value string) error {
+	if value == "" {
+		return nil
+	}
+	if enum := f.Tag.Get("enum"); enum != "" && !containsString(strings.Split(enum, ","), value) {
+		return fmt.Errorf("%q is not one of %s", value, strings.ReplaceAll(enum, ",", ", "))
+	}
+	switch f.Tag.Get("format") {
+	case "url":
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%q is not an http(s) URL", value)
+		}
+	case "hostport":
+		if _, _, err := net.SplitHostPort(value); err != nil {
+			return fmt.Errorf("%q is not host:port", value)
+		}
+	case "caddy-admin":
+		if value == "off" || strings.HasPrefix(value, "unix//") {
+			return nil
+		}
+		if strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://") {
+			return checkValue(reflect.StructField{Tag: `format:"url"`}, value)
+		}
+		if _, _, err := net.SplitHostPort(value); err != nil {
+			return fmt.Errorf("%q is not host:port, http(s)://host:port, unix//path or off", value)
+		}
+	case "node-type":
+		if !nodeTypePattern.MatchString(value) {
+			return fmt.Errorf("%q is not gateway, server or service, optionally with :subtype", value)
+		}
+	}
+	return nil
+}
+
+// checkDuration rejects durations that are not positive (0 is accepted for
+// options tagged zero:"off", where it turns the feature off), durations of
+// watchdog-tagged options that reach the systemd watchdog and, for options
+// with a range tag ("min,max"), durations outside it.
+func checkDuration(f reflect.StructField, d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("must not be negative")
+	}
+	if d == 0 && f.Tag.Get("zero") != "off" {
+		return fmt.Errorf("must be positive")
+	}
+	if f.Tag.Get("watchdog") == "true" && d >= Watchdog {
+		return fmt.Errorf("%s must be shorter than the %s systemd watchdog", d, Watchdog)
+	}
+	bounds := strings.Split(f.Tag.Get("range"), ",")
+	if len(bounds) != 2 {
+		return nil
+	}
+	lo, _ := time.ParseDuration(bounds[0])
+	hi, _ := time.ParseDuration(bounds[1])
+	if d < lo || d > hi {
+		return fmt.Errorf("%s is not between %s and %s", d, lo, hi)
+	}
+	return nil
+}
+
+// Diff returns the keys whose values differ between two configurations.
+func Diff(old, new *Config) []string {
+	var keys []string
+	ov, nv := reflect.ValueOf(*old), reflect.ValueOf(*new)
+	for i, o := range options() {
+		if !reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			keys = append(keys, o.Key)
+		}
+	}
+	return keys
+}
+
+// UnknownKeys returns the top-level keys of the config file that are not
+// configuration options.
+func UnknownKeys() ([]string, error) {
+	file := ConfigFileUsed()
+	if file == "" {
+		return nil, nil
+	}
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var unknown []string
+	for _, key := range v.AllKeys() {
+		top := strings.SplitN(key, ".", 2)[0]
+		if _, ok := lookupOption(top); !ok && !seen[top] {
+			seen[top] = true
+			unknown = append(unknown, top)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+// CheckKey returns an error for keys that are not configuration options,
+// suggesting the closest one. Nested keys such as firewall.enabled are
+// accepted below object-valued options.
+func CheckKey(key string) error {
+	parts := strings.SplitN(key, ".", 2)
+	o, ok := lookupOption(parts[0])
+	if !ok {
+		if s := Suggest(parts[0]); s != "" {
+			return fmt.Errorf("unknown config key %q, did you mean %q?", key, s)
+		}
+		return fmt.Errorf("unknown config key %q (see 'infra-agent config schema')", key)
+	}
+	if len(parts) > 1 && o.Field.Type.Kind() != reflect.Map {
+		return fmt.Errorf("config key %q has no sub-keys", parts[0])
+	}
+	return nil
+}
+
+// Suggest returns the option closest to key, or "" if none is close.
+func Suggest(key string) string {
+	best, bestDist := "", 4
+	for _, o := range options() {
+		if d := editDistance(key, o.Key); d < bestDist {
+			best, bestDist = o.Key, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// Coerce converts a command-line value to the type of the option at key, so
+// `config set auto-pull false` stores a boolean. Lists accept a JSON array or
+// comma-separated values; maps and objects a JSON object. Values of nested
+// keys are stored as booleans or numbers when they look like one.
+func Coerce(key, value string) (interface{}, error) {
+	if err := CheckKey(key); err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(key, ".", 2)
+	o, _ := lookupOption(parts[0])
+	if len(parts) > 1 {
+		return coerceScalar(value), nil
+	}
+
+	t := o.Field.Type
+	switch {
+	case t == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q is not a duration (e.g. 30s, 5m)", key, value)
+		}
+		if err := checkDuration(o.Field, d); err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		return value, nil
+	case t.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q is not a boolean (true or false)", key, value)
+		}
+		return b, nil
+	case t.Kind() == reflect.String:
+		if err := checkValue(o.Field, value); err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		return value, nil
+	case t == reflect.TypeOf([]string{}):
+		var list []string
+		if strings.HasPrefix(strings.TrimSpace(value), "[") {
+			if err := json.Unmarshal([]byte(value), &list); err != nil {
+				return nil, fmt.Errorf("%s: invalid JSON array: %w", key, err)
+			}
+		} else {
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+		}
+		for _, item := range list {
+			if err := checkValue(o.Field, item); err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+		}
+		return list, nil
+	default:
+		var v interface{}
+		if err := json.Unmarshal([]byte(value), &v); err != nil {
+			return nil, fmt.Errorf("%s takes a JSON value (or edit the config file): %w", key, err)
+		}
+		return v, nil
+	}
+}
+
+func coerceScalar(value string) interface{} {
+	if b, err := strconv.ParseBool(value); err == nil {
+		return b
+	}
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return n
+	}
+	return value
+}
+
+// Schema returns a JSON Schema describing the config file.
+func Schema() map[string]interface{} {
+	props := map[string]interface{}{}
+	for _, o := range options() {
+		p := typeSchema(o.Field.Type)
+		if desc := o.Field.Tag.Get("desc"); desc != "" {
+			p["description"] = desc
+		}
+		if enum := o.Field.Tag.Get("enum"); enum != "" {
+			p["enum"] = strings.Split(enum, ",")
+		}
+		switch o.Field.Tag.Get("format") {
+		case "url":
+			if p["type"] == "array" {
+				p["items"] = map[string]interface{}{"type": "string", "format": "uri"}
+			} else {
+				p["format"] = "uri"
+			}
+		case "node-type":
+			p["pattern"] = nodeTypePattern.String()
+		}
+		if o.Field.Tag.Get("secret") == "true" {
+			p["writeOnly"] = true
+		}
+		props[o.Key] = p
+	}
+	return map[string]interface{}{
+		"$schema":              "https://json-schema.org/draft/2020-12/schema",
+		"title":                "infra-agent configuration",
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+}
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == reflect.TypeOf(time.Duration(0)):
+		return map[string]interface{}{"type": "string", "pattern": `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() == reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() == reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case t.Kind() == reflect.Map && t.Elem().Kind() != reflect.Interface:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	default:
+		return map[string]interface{}{"type": "object"}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,249 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func field(t *testing.T, key string) reflect.StructField {
+	t.Helper()
+	o, ok := lookupOption(key)
+	if !ok {
+		t.Fatalf("no option %s", key)
+	}
+	return o.Field
+}
+
+func TestCheckDuration(t *testing.T) {
+	tests := []struct {
+		key   string
+		d     time.Duration
+		error string
+	}{
+		{KeyTimeoutGit, 30 * time.Second, ""},
+		{KeyTimeoutGit, 0, "must be positive"},
+		{KeyTimeoutHTTP, -time.Second, "must not be negative"},
+		{KeyTimeoutCaddy, Watchdog, "shorter than the 2m0s systemd watchdog"},
+		// download-timeout is not a main loop deadline.
+		{KeyTimeoutDownload, 5 * time.Minute, ""},
+		{KeyTimeoutDownload, 0, "must be positive"},
+		{KeyClockDriftThreshold, 0, "must be positive"},
+		// 0 turns the reconcile off.
+		{KeySSHKeysReconcile, 0, ""},
+		{KeySSHKeysReconcile, -time.Minute, "must not be negative"},
+		{KeyHeartbeatInterval, 10 * time.Second, ""},
+		{KeyHeartbeatInterval, 500 * time.Millisecond, "not between 1s and 1m0s"},
+		{KeyHeartbeatInterval, 2 * time.Minute, "not between 1s and 1m0s"},
+	}
+	for _, tt := range tests {
+		err := checkDuration(field(t, tt.key), tt.d)
+		if tt.error == "" {
+			if err != nil {
+				t.Errorf("%s=%s: %v", tt.key, tt.d, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.error) {
+			t.Errorf("%s=%s: error = %v, want %q", tt.key, tt.d, err, tt.error)
+		}
+	}
+}
+
+func TestCheckValue(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		error string
+	}{
+		{KeyControlURL, "", ""},
+		{KeyControlURL, "https://control.example.com", ""},
+		{KeyControlURL, "control.example.com", "not an http(s) URL"},
+		{KeyControlURL, "ftp://control.example.com", "not an http(s) URL"},
+		{KeyHealthAddr, "127.0.0.1:8081", ""},
+		{KeyHealthAddr, "8081", "not host:port"},
+		{KeyCaddyAdmin, "off", ""},
+		{KeyCaddyAdmin, "unix//run/caddy/admin.sock", ""},
+		{KeyCaddyAdmin, "localhost:2019", ""},
+		{KeyCaddyAdmin, "http://localhost:2019", ""},
+		{KeyCaddyAdmin, "http://", "not an http(s) URL"},
+		{KeyCaddyAdmin, "localhost", "unix//path or off"},
+		{KeyNodeType, "gateway", ""},
+		{KeyNodeType, "server:build:arm64", ""},
+		{KeyNodeType, "worker", "not gateway, server or service"},
+		{KeyNodeType, "server:Build", "not gateway, server or service"},
+		{KeyRequireSigned, "head", ""},
+		{KeyRequireSigned, "some", `"some" is not one of off, head, all`},
+		{KeyPermitRootLogin, "without-password", "is not one of"},
+	}
+	for _, tt := range tests {
+		err := checkValue(field(t, tt.key), tt.value)
+		if tt.error == "" {
+			if err != nil {
+				t.Errorf("%s=%q: %v", tt.key, tt.value, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.error) {
+			t.Errorf("%s=%q: error = %v, want %q", tt.key, tt.value, err, tt.error)
+		}
+	}
+}
+
+func TestCurrent(t *testing.T) {
+	viper.Reset()
+	Init()
+	t.Cleanup(viper.Reset)
+
+	cfg, err := Current()
+	if err != nil {
+		t.Fatalf("defaults are invalid: %v", err)
+	}
+	if cfg.HeartbeatInterval != 10*time.Second || cfg.Firewall["enabled"] != false || cfg.Firewall["default-policy"] != "drop" {
+		t.Errorf("decoded defaults: %+v", cfg)
+	}
+
+	viper.Set(KeyNodeType, "worker")
+	viper.Set(KeyProbeURLs, []string{"https://ok.example", "not-a-url"})
+	viper.Set(KeyTimeoutGit, "3m")
+	_, err = Current()
+	var verr ValidationError
+	if !errors.As(err, &verr) || len(verr) != 3 {
+		t.Fatalf("Current() error = %v, want 3 validation errors", err)
+	}
+	for i, prefix := range []string{KeyNodeType + ":", KeyProbeURLs + ":", KeyTimeoutGit + ":"} {
+		if !strings.HasPrefix(verr[i].Error(), prefix) {
+			t.Errorf("error %d = %v, want it to start with %q", i, verr[i], prefix)
+		}
+	}
+	if got := strings.Count(err.Error(), "\n"); got != 2 {
+		t.Errorf("errors are not one per line: %q", err.Error())
+	}
+
+	viper.Set(KeyHeartbeatInterval, "often")
+	if _, err := Current(); err == nil || !strings.HasPrefix(err.Error(), "invalid configuration:") {
+		t.Errorf("undecodable duration: error = %v", err)
+	}
+}
+
+func TestCheckKey(t *testing.T) {
+	tests := []struct {
+		key   string
+		error string
+	}{
+		{KeyHeartbeatInterval, ""},
+		{KeyFirewall + ".enabled", ""},
+		{KeyLabels + ".team", ""},
+		{"heartbeat-intervall", `did you mean "heartbeat-interval"?`},
+		{"node_id", `did you mean "node-id"?`},
+		{"completely-unrelated", "see 'infra-agent config schema'"},
+		{KeyNodeID + ".x", `config key "node-id" has no sub-keys`},
+	}
+	for _, tt := range tests {
+		err := CheckKey(tt.key)
+		if tt.error == "" {
+			if err != nil {
+				t.Errorf("CheckKey(%q) = %v", tt.key, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.error) {
+			t.Errorf("CheckKey(%q) = %v, want %q", tt.key, err, tt.error)
+		}
+	}
+}
+
+func TestCoerce(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		want  interface{}
+		error string
+	}{
+		{KeyAutoPull, "false", false, ""},
+		{KeyAutoPull, "nope", nil, "not a boolean"},
+		{KeyHeartbeatInterval, "30s", "30s", ""},
+		{KeyHeartbeatInterval, "30", nil, "not a duration"},
+		{KeyHeartbeatInterval, "5m", nil, "not between"},
+		{KeyNodeType, "server:build", "server:build", ""},
+		{KeyNodeType, "worker", nil, "node-type:"},
+		{KeyLogUnits, "caddy, infra-agent,", []string{"caddy", "infra-agent"}, ""},
+		{KeyLogUnits, `["caddy"]`, []string{"caddy"}, ""},
+		{KeyLogUnits, `["caddy"`, nil, "invalid JSON array"},
+		{KeyProbeURLs, "https://a.example,b.example", nil, `"b.example" is not an http(s) URL`},
+		{KeyLabels, `{"team":"edge"}`, map[string]interface{}{"team": "edge"}, ""},
+		{KeyLabels, "team=edge", nil, "takes a JSON value"},
+		{KeyFirewall + ".enabled", "true", true, ""},
+		{KeyFirewall + ".confirm-timeout", "90", int64(90), ""},
+		{KeyFirewall + ".default-policy", "accept", "accept", ""},
+		{"auto-pul", "true", nil, "did you mean"},
+	}
+	for _, tt := range tests {
+		got, err := Coerce(tt.key, tt.value)
+		if tt.error != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.error) {
+				t.Errorf("Coerce(%s, %q) error = %v, want %q", tt.key, tt.value, err, tt.error)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Coerce(%s, %q) = %#v, %v, want %#v", tt.key, tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := &Config{NodeID: "gw-1", LogUnits: []string{"caddy"}, HeartbeatInterval: 10 * time.Second}
+	new := *old
+	new.LogUnits = []string{"caddy", "sshd"}
+	new.HeartbeatInterval = 20 * time.Second
+	if got, want := Diff(old, &new), []string{KeyHeartbeatInterval, KeyLogUnits}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff() = %q, want %q", got, want)
+	}
+	if got := Diff(old, old); len(got) != 0 {
+		t.Errorf("Diff() of the same config = %q", got)
+	}
+}
+
+func TestUnknownKeys(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	file := filepath.Join(t.TempDir(), "infra-agent.yaml")
+	os.WriteFile(file, []byte("node-id: gw-1\nfirewall:\n  enabled: true\nheartbeat_interval: 5s\nextras:\n  a: 1\n  b: 2\n"), 0644)
+	viper.SetConfigFile(file)
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := UnknownKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"extras", "heartbeat_interval"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("UnknownKeys() = %q, want %q", got, want)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	props := Schema()["properties"].(map[string]interface{})
+	if len(props) != len(options()) {
+		t.Errorf("schema has %d properties for %d options", len(props), len(options()))
+	}
+	tests := map[string]map[string]interface{}{
+		KeyAutoPull:      {"type": "boolean"},
+		KeyRequireSigned: {"type": "string", "enum": []string{"off", "head", "all"}},
+		KeyControlURL:    {"type": "string", "format": "uri"},
+		KeyProbeURLs:     {"type": "array", "items": map[string]interface{}{"type": "string", "format": "uri"}},
+		KeyGithubToken:   {"type": "string", "writeOnly": true},
+		KeySSHKeys:       {"type": "object", "additionalProperties": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}}},
+		KeyFirewall:      {"type": "object"},
+	}
+	for key, want := range tests {
+		got := props[key].(map[string]interface{})
+		for k, v := range want {
+			if !reflect.DeepEqual(got[k], v) {
+				t.Errorf("%s %s = %#v, want %#v", key, k, got[k], v)
+			}
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Secret options (tagged secret:"true" in Config) are never written to the
+// config file by `config set`. Their value is looked up in order:
+//   - a flag, an environment variable or the config file, as for any option
+//   - the secret store, a 0600 file next to the config file whose values are
+//     encrypted with a key derived from /etc/machine-id
+//   - a systemd credential ($CREDENTIALS_DIRECTORY/<key>, see LoadCredential=)
+//
+// A value of the form file:/path is replaced by the content of that file.
+// The machine key keeps the store useless on another machine (e.g. in a
+// backup); it does not protect it from root on this one.
+
+const (
+	secretStoreName = "secret-store.yaml"
+	encPrefix       = "enc:v1:"
+)
+
+// Secret returns the value of a secret option, resolving file: references
+// and encrypted values.
+func Secret(key string) (string, error) {
+	value, _, err := secretValue(key)
+	return value, err
+}
+
+// secretValue returns the resolved value and the source it came from:
+// "" (flag, env or config file), "store" or "credential".
+func secretValue(key string) (string, string, error) {
+	raw, source := GetString(key), ""
+	if raw == "" {
+		stored, err := readSecretStore()
+		if err != nil {
+			return "", "", err
+		}
+		if raw = stored[key]; raw != "" {
+			source = "store"
+		}
+	}
+	if raw == "" {
+		data, err := os.ReadFile(credentialPath(key))
+		if err == nil {
+			return strings.TrimSpace(string(data)), "credential", nil
+		}
+	}
+	value, err := expandSecret(raw)
+	if err != nil {
+		return "", source, fmt.Errorf("%s: %w", key, err)
+	}
+	return value, source, nil
+}
+
+func expandSecret(raw string) (string, error) {
+	if strings.HasPrefix(raw, encPrefix) {
+		plain, err := decryptSecret(raw)
+		if err != nil {
+			return "", err
+		}
+		raw = plain
+	}
+	if path, ok := strings.CutPrefix(raw, "file:"); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return raw, nil
+}
+
+// credentialPath is where systemd places the credential named key, or "".
+func credentialPath(key string) string {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, key)
+}
+
+// secretStorePath is next to the config file in use, or in /etc/infra-agent.
+func secretStorePath() string {
+	dir := defaultConfigDir
+	if file := ConfigFileUsed(); file != "" {
+		dir = filepath.Dir(file)
+	}
+	return filepath.Join(dir, secretStoreName)
+}
+
+func readSecretStore() (map[string]string, error) {
+	stored := map[string]string{}
+	data, err := os.ReadFile(secretStorePath())
+	if os.IsNotExist(err) {
+		return stored, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", secretStorePath(), err)
+	}
+	return stored, nil
+}
+
+func writeSecretStore(stored map[string]string) error {
+	data, err := yaml.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	path := secretStorePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".secret-store-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	// CreateTemp creates the file 0600; it stays so after the rename.
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// setSecret encrypts value into the secret store and removes a plaintext
+// copy of key from the config file.
+func setSecret(key, value string) error {
+	stored, err := readSecretStore()
+	if err != nil {
+		return err
+	}
+	enc, err := encryptSecret(value)
+	if err != nil {
+		return err
+	}
+	stored[key] = enc
+	if err := writeSecretStore(stored); err != nil {
+		return err
+	}
+	log.Printf("Saved %s to the secret store: %s", key, secretStorePath())
+	removed, err := unsetInFile(key)
+	if removed {
+		log.Printf("Removed the plaintext %s from %s", key, ConfigFileUsed())
+	}
+	return err
+}
+
+// unsetSecret removes key from the secret store.
+func unsetSecret(key string) (bool, error) {
+	stored, err := readSecretStore()
+	if err != nil {
+		return false, err
+	}
+	if _, ok := stored[key]; !ok {
+		return false, nil
+	}
+	delete(stored, key)
+	return true, writeSecretStore(stored)
+}
+
+// machineKey derives the secret store key from the machine ID.
+func machineKey() ([]byte, error) {
+	var id []byte
+	var err error
+	for _, path := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		if id, err = os.ReadFile(path); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot derive the secret store key: %w", err)
+	}
+	sum := sha256.Sum256([]byte("infra-agent secret store v1\x00" + strings.TrimSpace(string(id))))
+	return sum[:], nil
+}
+
+func secretCipher() (cipher.AEAD, error) {
+	key, err := machineKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptSecret(plain string) (string, error) {
+	gcm, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plain), nil)
+	return encPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptSecret(enc string) (string, error) {
+	gcm, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(enc, encPrefix))
+	if err != nil || len(data) < gcm.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt value (was it encrypted on another machine?)")
+	}
+	return string(plain), nil
+}
+
+// PlaintextSecrets returns the secret options stored as plain values in the
+// config file, if that file is readable by other users.
+func PlaintextSecrets() []string {
+	file := ConfigFileUsed()
+	info, err := os.Stat(file)
+	if err != nil || info.Mode().Perm()&0004 == 0 {
+		return nil
+	}
+	var keys []string
+	for _, o := range options() {
+		if !IsSecret(o.Key) || !InConfig(o.Key) {
+			continue
+		}
+		if v := fileString(o.Key); v != "" && !strings.HasPrefix(v, "file:") && !strings.HasPrefix(v, encPrefix) {
+			keys = append(keys, o.Key)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSetSecret(t *testing.T) {
+	path := useConfigFile(t, "node-id: gw-1\ngithub-token: ghp_plaintext\n")
+
+	if err := Set(KeyGithubToken, "ghp_0123456789abcdef"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "node-id: gw-1\n" {
+		t.Errorf("plaintext token left in the config file: %q", data)
+	}
+	store := filepath.Join(filepath.Dir(path), secretStoreName)
+	data, err := os.ReadFile(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), encPrefix) || strings.Contains(string(data), "ghp_0123456789abcdef") {
+		t.Errorf("secret store holds %q", data)
+	}
+	if info, _ := os.Stat(store); info.Mode().Perm() != 0600 {
+		t.Errorf("secret store mode = %v", info.Mode().Perm())
+	}
+
+	if got, err := Secret(KeyGithubToken); err != nil || got != "ghp_0123456789abcdef" {
+		t.Errorf("Secret() = %q, %v", got, err)
+	}
+	if s := Resolve(KeyGithubToken, nil); s.Source != "store" || s.Origin != store {
+		t.Errorf("source = %s (%s)", s.Source, s.Origin)
+	}
+
+	removed, err := Unset(KeyGithubToken)
+	if err != nil || !removed {
+		t.Fatalf("Unset() = %v, %v", removed, err)
+	}
+	if got, _ := Secret(KeyGithubToken); got != "" {
+		t.Errorf("Secret() after unset = %q", got)
+	}
+}
+
+func TestSecretSources(t *testing.T) {
+	useConfigFile(t, "")
+	creds := t.TempDir()
+	os.WriteFile(filepath.Join(creds, KeyGithubToken), []byte("from-credential\n"), 0600)
+	t.Setenv("CREDENTIALS_DIRECTORY", creds)
+
+	if got, _ := Secret(KeyGithubToken); got != "from-credential" {
+		t.Errorf("credential: %q", got)
+	}
+
+	// The environment wins, and a file: value is read.
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(tokenFile, []byte("from-file\n"), 0600)
+	t.Setenv(EnvVar(KeyGithubToken), "file:"+tokenFile)
+	if got, _ := Secret(KeyGithubToken); got != "from-file" {
+		t.Errorf("file reference: %q", got)
+	}
+	t.Setenv(EnvVar(KeyGithubToken), "file:"+tokenFile+".missing")
+	if _, err := Secret(KeyGithubToken); err == nil || !strings.HasPrefix(err.Error(), KeyGithubToken+":") {
+		t.Errorf("missing file: error = %v", err)
+	}
+
+	enc, err := encryptSecret("from-env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(EnvVar(KeyGithubToken), enc)
+	if got, _ := Secret(KeyGithubToken); got != "from-env" {
+		t.Errorf("encrypted value: %q", got)
+	}
+	tampered := enc[:len(enc)-4] + "AAAA"
+	t.Setenv(EnvVar(KeyGithubToken), tampered)
+	if _, err := Secret(KeyGithubToken); err == nil || !strings.Contains(err.Error(), "cannot decrypt") {
+		t.Errorf("tampered value: error = %v", err)
+	}
+}
+
+func TestPlaintextSecrets(t *testing.T) {
+	path := useConfigFile(t, "github-token: ghp_plaintext\n")
+	if got := PlaintextSecrets(); got != nil {
+		t.Errorf("0640 file: %q", got)
+	}
+	os.Chmod(path, 0644)
+	if got := PlaintextSecrets(); !reflect.DeepEqual(got, []string{KeyGithubToken}) {
+		t.Errorf("0644 file: %q", got)
+	}
+
+	path = useConfigFile(t, "github-token: file:/etc/infra-agent/token\n")
+	os.Chmod(path, 0644)
+	if got := PlaintextSecrets(); got != nil {
+		t.Errorf("file reference reported: %q", got)
+	}
+}
@@ -0,0 +1,309 @@
+// Package install provisions a fresh node: it persists the node identity,
+// installs the agent binary and systemd unit, runs setup and, on gateways,
+// checks out the Caddy config repo. Every step is idempotent, so re-running
+// install on a provisioned node only fixes what is missing.
+package install
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/uverustech/infra-agent/internal/agent"
+	"github.com/uverustech/infra-agent/internal/config"
+	"github.com/uverustech/infra-agent/internal/setup"
+)
+
+const (
+	BinaryPath        = "/usr/local/bin/infra-agent"
+	UnitPath          = "/etc/systemd/system/infra-agent.service"
+	defaultConfigRepo = "git@github.com:uverustech/gtw-config.git"
+)
+
+// The paths install writes to. They are variables so tests can point them at
+// a temporary directory.
+var (
+	binaryPath       = BinaryPath
+	unitPath         = UnitPath
+	gatewayConfigDir = "/etc/caddy"
+)
+
+// nodeTypes are offered by the interactive prompt; any other value can be
+// entered as a custom type.
+var nodeTypes = []string{
+	"gateway",
+	"server:build",
+	"server:applications",
+	"server:banking",
+	"server",
+	"service:analytics",
+}
+
+var unitFile = `[Unit]
+Description=Uverus Infra Agent
+After=network.target
+
+[Service]
+Type=notify
+NotifyAccess=main
+ExecStart=` + BinaryPath + `
+ExecReload=/bin/kill -HUP $MAINPID
+# The main loop pings the watchdog every heartbeat-interval (at most 1m); a
+# loop stuck this long (e.g. on a hung git fetch) gets the agent restarted.
+WatchdogSec=` + strconv.Itoa(int(config.Watchdog.Seconds())) + `
+# Secrets can be passed as systemd credentials instead of the secret store:
+# LoadCredential=github-token:/path/to/token
+Restart=always
+RestartSec=5
+LimitNOFILE=1048576
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// Flags registers the install command's flags.
+func Flags(cmd *cobra.Command) {
+	cmd.Flags().String("config-repo", defaultConfigRepo, "Git repository cloned into /etc/caddy on gateways")
+	cmd.Flags().String("release", "", "Download this agent release (e.g. 1.4.0, or \"latest\") instead of installing the running binary")
+	cmd.Flags().Bool("skip-setup", false, "Do not run the setup steps")
+}
+
+// Run is the install command.
+func Run(cmd *cobra.Command, args []string) error {
+	autoConfirm := config.GetBool(config.KeyAutoConfirm)
+	in := bufio.NewReader(os.Stdin)
+	interactive := !autoConfirm && isTerminal(os.Stdin)
+
+	nodeID, err := resolveNodeID(in, interactive)
+	if err != nil {
+		return err
+	}
+	nodeType := resolveNodeType(cmd, in, interactive)
+	if _, err := config.Coerce(config.KeyNodeType, nodeType); err != nil {
+		return err
+	}
+	fmt.Printf("Node will register as: %s (Type: %s)\n", nodeID, nodeType)
+
+	for key, value := range map[string]string{config.KeyNodeID: nodeID, config.KeyNodeType: nodeType} {
+		if err := config.Set(key, value); err != nil {
+			return fmt.Errorf("failed to save config: %w", err)
+		}
+	}
+
+	release, _ := cmd.Flags().GetString("release")
+	if err := installBinary(release); err != nil {
+		return err
+	}
+
+	if skip, _ := cmd.Flags().GetBool("skip-setup"); !skip {
+		fmt.Println("Running system setup...")
+		setupCmd := exec.Command(binaryPath, "setup", "--yes")
+		setupCmd.Stdout, setupCmd.Stderr = os.Stdout, os.Stderr
+		if err := setupCmd.Run(); err != nil {
+			fmt.Printf("Warning: system setup failed: %v (re-run with 'infra-agent setup --resume')\n", err)
+		}
+	}
+
+	if nodeType == "gateway" {
+		repo, _ := cmd.Flags().GetString("config-repo")
+		if err := checkoutGatewayConfig(repo, in, autoConfirm); err != nil {
+			return err
+		}
+	}
+
+	if err := installUnit(); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	fmt.Println("All done! The agent is running.")
+	fmt.Printf("Node ID: %s\n", nodeID)
+	if nodeType == "gateway" {
+		fmt.Printf("Health check: http://%s/health → should return OK\n", nodeID)
+	}
+	return nil
+}
+
+// resolveNodeID uses the configured node ID, prompting with the host name as
+// default when there is none.
+func resolveNodeID(in *bufio.Reader, interactive bool) (string, error) {
+	nodeID := config.GetString(config.KeyNodeID)
+	if nodeID == "" {
+		hostname, _ := os.Hostname()
+		if out, err := exec.Command("hostname", "-f").Output(); err == nil {
+			hostname = strings.TrimSpace(string(out))
+		}
+		nodeID = hostname
+		if interactive {
+			nodeID = prompt(in, fmt.Sprintf("Enter Node ID (e.g. svr-gtw-nd1.uvrs.xyz) [%s]: ", hostname), hostname)
+		}
+	}
+	if nodeID == "" || nodeID == "localhost" {
+		return "", fmt.Errorf("cannot detect a proper hostname. Set the node ID with --node-id or INFRA_NODE_ID")
+	}
+	return nodeID, nil
+}
+
+// resolveNodeType uses the node type from the flag, environment or config
+// file, and otherwise asks for one.
+func resolveNodeType(cmd *cobra.Command, in *bufio.Reader, interactive bool) string {
+	nodeType := config.GetString(config.KeyNodeType)
+	explicit := cmd.Flags().Changed(config.KeyNodeType) || config.InConfig(config.KeyNodeType) ||
+		os.Getenv("INFRA_NODE_TYPE") != ""
+	if explicit || !interactive {
+		return nodeType
+	}
+
+	fmt.Println("Select Node Type:")
+	for i, t := range nodeTypes {
+		fmt.Printf("%d) %s\n", i+1, t)
+	}
+	fmt.Printf("%d) custom\n", len(nodeTypes)+1)
+	choice := prompt(in, fmt.Sprintf("Choice [1-%d] (default server): ", len(nodeTypes)+1), "")
+	for i, t := range nodeTypes {
+		if choice == fmt.Sprint(i+1) {
+			return t
+		}
+	}
+	if choice == fmt.Sprint(len(nodeTypes)+1) {
+		// Ask again rather than save a type that config validation rejects.
+		for {
+			custom := prompt(in, "Enter custom node type (e.g. server:ci): ", "")
+			if custom == "" {
+				break
+			}
+			if _, err := config.Coerce(config.KeyNodeType, custom); err != nil {
+				fmt.Printf("Invalid node type: %v\n", err)
+				continue
+			}
+			return custom
+		}
+	}
+	return "server"
+}
+
+// installBinary puts the agent at BinaryPath: the requested release, or a
+// copy of the running binary. An identical binary is left alone.
+func installBinary(release string) error {
+	if release != "" {
+		if release == "latest" {
+			release = ""
+		}
+		fmt.Println("Downloading infra-agent binary...")
+		return agent.DownloadRelease(strings.TrimPrefix(release, "v"), binaryPath)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("could not determine executable path: %w", err)
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	if exe == binaryPath {
+		return nil
+	}
+	data, err := os.ReadFile(exe)
+	if err != nil {
+		return err
+	}
+	if current, err := os.ReadFile(binaryPath); err == nil && bytes.Equal(current, data) {
+		return nil
+	}
+	fmt.Printf("Installing infra-agent binary to %s...\n", binaryPath)
+	return setup.WriteFileAtomic(binaryPath, data, 0755)
+}
+
+// checkoutGatewayConfig clones the config repo into /etc/caddy. A checkout of
+// the same repo is kept as is; anything else there is moved aside, but only
+// after confirmation.
+func checkoutGatewayConfig(repo string, in *bufio.Reader, autoConfirm bool) error {
+	if origin, err := exec.Command("git", "-C", gatewayConfigDir, "remote", "get-url", "origin").Output(); err == nil {
+		if strings.TrimSpace(string(origin)) == repo {
+			fmt.Printf("%s already holds %s\n", gatewayConfigDir, repo)
+			return nil
+		}
+	}
+
+	if entries, err := os.ReadDir(gatewayConfigDir); err == nil && len(entries) > 0 {
+		backup := fmt.Sprintf("%s.bak-%s", gatewayConfigDir, time.Now().UTC().Format("20060102T150405Z"))
+		msg := fmt.Sprintf("%s already exists and is not a checkout of %s. Move it to %s and clone?", gatewayConfigDir, repo, backup)
+		if !autoConfirm && !confirm(in, msg) {
+			return fmt.Errorf("refusing to replace existing %s", gatewayConfigDir)
+		}
+		if err := os.Rename(gatewayConfigDir, backup); err != nil {
+			return fmt.Errorf("failed to move %s aside: %w", gatewayConfigDir, err)
+		}
+		fmt.Printf("Moved existing %s to %s\n", gatewayConfigDir, backup)
+	} else if err == nil {
+		os.Remove(gatewayConfigDir)
+	}
+
+	// Clone next to the target so a failed clone leaves nothing half-done.
+	tmp := gatewayConfigDir + ".clone"
+	os.RemoveAll(tmp)
+	fmt.Printf("Cloning %s into %s...\n", repo, gatewayConfigDir)
+	out, err := exec.Command("git", "clone", "--quiet", repo, tmp).CombinedOutput()
+	if err != nil {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("failed to clone %s (check the node's SSH key): %v\n%s", repo, err, string(out))
+	}
+	return os.Rename(tmp, gatewayConfigDir)
+}
+
+// installUnit writes the systemd unit if it differs and (re)starts the agent.
+// Node ID and type come from the config file, not the unit environment.
+func installUnit() error {
+	if current, err := os.ReadFile(unitPath); err != nil || string(current) != unitFile {
+		fmt.Println("Writing systemd service...")
+		if err := setup.WriteFileAtomic(unitPath, []byte(unitFile), 0644); err != nil {
+			return err
+		}
+		if err := run("systemctl", "daemon-reload"); err != nil {
+			return err
+		}
+	}
+	if err := run("systemctl", "enable", "infra-agent"); err != nil {
+		return err
+	}
+	return run("systemctl", "restart", "infra-agent")
+}
+
+// run runs a command, with its output in the error. It is a variable so tests
+// can record the systemctl calls instead of making them.
+var run = func(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v\n%s", name, strings.Join(args, " "), err, string(out))
+	}
+	return nil
+}
+
+func prompt(in *bufio.Reader, message, def string) string {
+	fmt.Print(message)
+	line, err := in.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return def
+	}
+	if line = strings.TrimSpace(line); line != "" {
+		return line
+	}
+	return def
+}
+
+func confirm(in *bufio.Reader, message string) bool {
+	return strings.ToLower(prompt(in, message+" (y/n): ", "n")) == "y"
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,160 @@
+package install
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// useTempPaths points the install targets at a temp dir and records the
+// commands run instead of running them.
+func useTempPaths(t *testing.T) (string, *[]string) {
+	t.Helper()
+	dir := t.TempDir()
+	savedBinary, savedUnit, savedConfig, savedRun := binaryPath, unitPath, gatewayConfigDir, run
+	t.Cleanup(func() {
+		binaryPath, unitPath, gatewayConfigDir, run = savedBinary, savedUnit, savedConfig, savedRun
+	})
+	binaryPath = filepath.Join(dir, "bin", "infra-agent")
+	unitPath = filepath.Join(dir, "systemd", "infra-agent.service")
+	gatewayConfigDir = filepath.Join(dir, "caddy")
+
+	var calls []string
+	run = func(name string, args ...string) error {
+		calls = append(calls, strings.Join(append([]string{name}, args...), " "))
+		return nil
+	}
+	return dir, &calls
+}
+
+func inode(t *testing.T, path string) uint64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Sys().(*syscall.Stat_t).Ino
+}
+
+func TestInstallBinary(t *testing.T) {
+	useTempPaths(t)
+
+	if err := installBinary(""); err != nil {
+		t.Fatal(err)
+	}
+	exe, _ := os.Executable()
+	want, _ := os.ReadFile(exe)
+	got, err := os.ReadFile(binaryPath)
+	if err != nil || string(got) != string(want) {
+		t.Fatalf("installed binary differs from the running one (%v)", err)
+	}
+	if info, _ := os.Stat(binaryPath); info.Mode().Perm() != 0755 {
+		t.Errorf("binary mode = %v", info.Mode().Perm())
+	}
+
+	// Re-running with an identical binary leaves the file alone.
+	before := inode(t, binaryPath)
+	if err := installBinary(""); err != nil {
+		t.Fatal(err)
+	}
+	if inode(t, binaryPath) != before {
+		t.Error("an identical binary was rewritten")
+	}
+
+	if err := os.WriteFile(binaryPath, []byte("old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := installBinary(""); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(binaryPath); string(got) != string(want) {
+		t.Error("an outdated binary was not replaced")
+	}
+}
+
+func TestInstallUnit(t *testing.T) {
+	_, calls := useTempPaths(t)
+
+	if err := installUnit(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(unitPath); string(got) != unitFile {
+		t.Fatalf("unit file = %q", got)
+	}
+	want := []string{"systemctl daemon-reload", "systemctl enable infra-agent", "systemctl restart infra-agent"}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Errorf("first install ran %q, want %q", *calls, want)
+	}
+
+	// An unchanged unit is neither rewritten nor reloaded, but the agent is
+	// still enabled and restarted.
+	*calls = nil
+	before := inode(t, unitPath)
+	if err := installUnit(); err != nil {
+		t.Fatal(err)
+	}
+	if inode(t, unitPath) != before {
+		t.Error("an unchanged unit was rewritten")
+	}
+	want = []string{"systemctl enable infra-agent", "systemctl restart infra-agent"}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Errorf("re-run ran %q, want %q", *calls, want)
+	}
+}
+
+func git(t *testing.T, args ...string) {
+	t.Helper()
+	if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+}
+
+func TestCheckoutGatewayConfig(t *testing.T) {
+	dir, _ := useTempPaths(t)
+	t.Setenv("HOME", dir)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(dir, "gitconfig"))
+
+	repo := filepath.Join(dir, "gtw-config.git")
+	git(t, "init", "-q", "--bare", repo)
+
+	if err := checkoutGatewayConfig(repo, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(gatewayConfigDir, ".git")); err != nil {
+		t.Fatalf("no checkout in %s: %v", gatewayConfigDir, err)
+	}
+
+	// A checkout of the same repo is kept as is, local files included.
+	marker := filepath.Join(gatewayConfigDir, "local-only")
+	if err := os.WriteFile(marker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkoutGatewayConfig(repo, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("re-run replaced the checkout: %v", err)
+	}
+	if backups, _ := filepath.Glob(gatewayConfigDir + ".bak-*"); len(backups) != 0 {
+		t.Errorf("re-run moved the checkout aside: %v", backups)
+	}
+
+	// A checkout of another repo is only moved aside once confirmed.
+	other := filepath.Join(dir, "other.git")
+	git(t, "init", "-q", "--bare", other)
+	if err := checkoutGatewayConfig(other, bufio.NewReader(strings.NewReader("n\n")), false); err == nil {
+		t.Fatal("replaced a checkout of another repo without confirmation")
+	}
+	if err := checkoutGatewayConfig(other, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if backups, _ := filepath.Glob(gatewayConfigDir + ".bak-*"); len(backups) != 1 {
+		t.Errorf("backups = %v, want the previous checkout", backups)
+	}
+}
@@ -0,0 +1,198 @@
+package install
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/uverustech/infra-agent/internal/config"
+	"github.com/uverustech/infra-agent/internal/setup"
+)
+
+// configDir holds the agent config and secret store. It is a variable so
+// tests can use a temp dir.
+var configDir = "/etc/infra-agent"
+
+// UninstallFlags registers the uninstall command's flags.
+func UninstallFlags(cmd *cobra.Command) {
+	cmd.Flags().String("reason", "", "Reason sent to the control plane with the decommission notice")
+	cmd.Flags().String("archive", "", "Write config, state and agent logs to this .tar.gz before removing them")
+	cmd.Flags().Bool("keep-access", false, "Keep managed users, SSH keys and SSH CA so the node stays reachable")
+	cmd.Flags().Bool("keep-gateway-config", false, "Keep the config checkout in /etc/caddy")
+}
+
+// Uninstall is the uninstall command. It tells the control plane first, so
+// the missing heartbeats that follow are not alerted on, then removes the
+// agent and everything its setup steps manage.
+func Uninstall(cmd *cobra.Command, args []string) error {
+	autoConfirm := config.GetBool(config.KeyAutoConfirm)
+	nodeID := config.GetString(config.KeyNodeID)
+	nodeType := config.GetString(config.KeyNodeType)
+	reason, _ := cmd.Flags().GetString("reason")
+	archive, _ := cmd.Flags().GetString("archive")
+	keepAccess, _ := cmd.Flags().GetBool("keep-access")
+	keepGateway, _ := cmd.Flags().GetBool("keep-gateway-config")
+
+	removeGateway := nodeType == "gateway" && !keepGateway
+	fmt.Printf("This will decommission %s and remove infra-agent:\n", nodeID)
+	fmt.Println("  - stop and disable the infra-agent service")
+	if keepAccess {
+		fmt.Println("  - revert managed setup (firewall, hardening); users, SSH keys and SSH CA are kept")
+	} else {
+		fmt.Println("  - revert managed setup (firewall, hardening, SSH CA, SSH keys, users)")
+	}
+	if removeGateway {
+		fmt.Printf("  - remove the config checkout %s\n", gatewayConfigDir)
+	}
+	fmt.Printf("  - remove %s, %s and %s\n", configDir, config.GetString(config.KeyStateDir), binaryPath)
+	if !autoConfirm && !confirm(bufio.NewReader(os.Stdin), "Continue?") {
+		return fmt.Errorf("uninstall aborted")
+	}
+
+	if nodeID != "" {
+		if err := notifyDecommission(nodeID, reason); err != nil {
+			fmt.Printf("Warning: failed to notify control plane: %v\n", err)
+		}
+	}
+
+	if archive != "" {
+		if err := writeArchive(archive, removeGateway); err != nil {
+			return fmt.Errorf("failed to write archive, nothing was removed: %w", err)
+		}
+		fmt.Printf("Archived config, state and logs to %s\n", archive)
+	}
+
+	exec.Command("systemctl", "disable", "--now", "infra-agent").Run()
+	if err := os.Remove(unitPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	exec.Command("systemctl", "daemon-reload").Run()
+
+	// Carry on after a failed revert: a half-removed agent is worse than one
+	// with a leftover file, and the failures are reported at the end.
+	revertErr := setup.RevertAll(keepAccess)
+
+	paths := []string{configDir, config.GetString(config.KeyStateDir), binaryPath}
+	if removeGateway {
+		paths = append(paths, gatewayConfigDir)
+	}
+	for _, path := range paths {
+		if err := os.RemoveAll(path); err != nil {
+			fmt.Printf("Warning: failed to remove %s: %v\n", path, err)
+		}
+	}
+
+	if revertErr != nil {
+		return fmt.Errorf("infra-agent removed, but some setup changes could not be reverted:\n%w", revertErr)
+	}
+	fmt.Println("infra-agent removed")
+	return nil
+}
+
+func notifyDecommission(nodeID, reason string) error {
+	controlURL := config.GetString(config.KeyControlURL)
+	payload, _ := json.Marshal(map[string]interface{}{
+		"node_id":   nodeID,
+		"reason":    reason,
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	})
+	client := &http.Client{Timeout: config.GetDuration(config.KeyTimeoutHTTP)}
+	resp, err := client.Post(controlURL+"/api/nodes/"+nodeID+"/decommission", "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// writeArchive stores the agent config, state directory, gateway checkout
+// (when it is about to be removed) and the agent's journal in a tarball.
+func writeArchive(path string, withGateway bool) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	dirs := []string{configDir, config.GetString(config.KeyStateDir)}
+	if withGateway {
+		dirs = append(dirs, gatewayConfigDir)
+	}
+	for _, dir := range dirs {
+		if err := addTree(tw, dir); err != nil {
+			return err
+		}
+	}
+
+	logs, _ := exec.Command("journalctl", "-u", "infra-agent", "--no-pager", "-o", "short-iso").Output()
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    "logs/infra-agent.log",
+		Mode:    0600,
+		Size:    int64(len(logs)),
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(logs); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// addTree adds the regular files and directories under root, skipping it if
+// it does not exist.
+func addTree(tw *tar.Writer, root string) error {
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(path[1:])
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+}
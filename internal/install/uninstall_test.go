@@ -0,0 +1,128 @@
+package install
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+// archiveEntries returns the regular files in a .tar.gz by name.
+func archiveEntries(t *testing.T, path string) map[string]string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	entries := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, _ := io.ReadAll(tr)
+		entries[hdr.Name] = string(data)
+	}
+}
+
+func TestWriteArchive(t *testing.T) {
+	dir, _ := useTempPaths(t)
+	savedConfig := configDir
+	t.Cleanup(func() {
+		configDir = savedConfig
+		viper.Reset()
+	})
+	configDir = filepath.Join(dir, "etc")
+	stateDir := filepath.Join(dir, "state")
+	viper.Set(config.KeyStateDir, stateDir)
+
+	for path, content := range map[string]string{
+		filepath.Join(configDir, "infra-agent.yaml"):        "node-id: nd1\n",
+		filepath.Join(stateDir, "setup-state.json"):         "{}\n",
+		filepath.Join(gatewayConfigDir, "Caddyfile"):        "example.com {\n}\n",
+		filepath.Join(gatewayConfigDir, "sites", "app.txt"): "app\n",
+	} {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(content), 0644)
+	}
+	// Symlinks are skipped rather than followed.
+	os.Symlink("/etc/shadow", filepath.Join(stateDir, "link"))
+
+	for _, withGateway := range []bool{false, true} {
+		archive := filepath.Join(dir, "archive.tar.gz")
+		if err := writeArchive(archive, withGateway); err != nil {
+			t.Fatal(err)
+		}
+		entries := archiveEntries(t, archive)
+		var files []string
+		for name := range entries {
+			files = append(files, name)
+		}
+		sort.Strings(files)
+
+		rel := func(path string) string { return filepath.ToSlash(path[1:]) }
+		want := []string{"logs/infra-agent.log", rel(configDir) + "/infra-agent.yaml", rel(stateDir) + "/setup-state.json"}
+		if withGateway {
+			want = append(want, rel(gatewayConfigDir)+"/Caddyfile", rel(gatewayConfigDir)+"/sites/app.txt")
+		}
+		sort.Strings(want)
+		if strings.Join(files, "\n") != strings.Join(want, "\n") {
+			t.Errorf("withGateway=%v: archive holds\n%s\nwant\n%s", withGateway, strings.Join(files, "\n"), strings.Join(want, "\n"))
+		}
+		if info, _ := os.Stat(archive); info.Mode().Perm() != 0600 {
+			t.Errorf("archive mode = %v, want 0600", info.Mode().Perm())
+		}
+	}
+}
+
+func TestNotifyDecommission(t *testing.T) {
+	var got map[string]interface{}
+	var path string
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	t.Cleanup(viper.Reset)
+	viper.Set(config.KeyControlURL, srv.URL)
+	viper.Set(config.KeyTimeoutHTTP, "5s")
+
+	if err := notifyDecommission("svr-gtw-nd1", "replaced by nd4"); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/api/nodes/svr-gtw-nd1/decommission" {
+		t.Errorf("posted to %s", path)
+	}
+	if got["node_id"] != "svr-gtw-nd1" || got["reason"] != "replaced by nd4" || got["timestamp"] == "" {
+		t.Errorf("payload = %v", got)
+	}
+
+	status = http.StatusInternalServerError
+	if err := notifyDecommission("svr-gtw-nd1", ""); err == nil || err.Error() != "HTTP 500" {
+		t.Errorf("error = %v, want HTTP 500", err)
+	}
+}
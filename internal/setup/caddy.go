@@ -0,0 +1,23 @@
+package setup
+
+import "os/exec"
+
+// PlanCaddy makes sure Caddy runs and starts on boot. The agent reloads it
+// through its admin API; the package itself comes from the packages step
+// (caddy is declared for gateways by default).
+func PlanCaddy() (*Plan, error) {
+	plan := &Plan{Step: "caddy"}
+	enabled := exec.Command("systemctl", "is-enabled", "--quiet", "caddy").Run() == nil
+	active := exec.Command("systemctl", "is-active", "--quiet", "caddy").Run() == nil
+	if !enabled || !active {
+		plan.add(&Change{
+			Kind:        ChangeService,
+			Target:      "caddy",
+			Description: "enable and start caddy",
+			apply: func() error {
+				return runCommand("systemctl", "enable", "--now", "caddy")
+			},
+		})
+	}
+	return plan, nil
+}
@@ -0,0 +1,59 @@
+package setup
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func numbered(from, to int, replace map[int]string) string {
+	var b strings.Builder
+	for i := from; i <= to; i++ {
+		line := fmt.Sprintf("line %d", i)
+		if r, ok := replace[i]; ok {
+			line = r
+		}
+		b.WriteString(line + "\n")
+	}
+	return b.String()
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name, before, after, want string
+	}{
+		{"create", "", "a\nb\n", "--- f\n+++ f\n@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{"remove all", "a\n", "", "--- f\n+++ f\n@@ -1,1 +0,0 @@\n-a\n"},
+		{"unchanged", "a\nb\n", "a\nb\n", "--- f\n+++ f\n"},
+		{
+			"change with context", numbered(1, 10, nil), numbered(1, 10, map[int]string{5: "five"}),
+			"--- f\n+++ f\n@@ -2,7 +2,7 @@\n line 2\n line 3\n line 4\n-line 5\n+five\n line 6\n line 7\n line 8\n",
+		},
+		{
+			"insert at the end", "a\nb\n", "a\nb\nc\n",
+			"--- f\n+++ f\n@@ -1,2 +1,3 @@\n a\n b\n+c\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := unifiedDiff("f", tt.before, tt.after); got != tt.want {
+			t.Errorf("%s:\n%s\nwant:\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUnifiedDiffHunks(t *testing.T) {
+	// Changes more than 6 lines apart get separate hunks.
+	far := unifiedDiff("f", numbered(1, 20, nil), numbered(1, 20, map[int]string{2: "two", 18: "eighteen"}))
+	if n := strings.Count(far, "@@ -"); n != 2 {
+		t.Errorf("%d hunks for distant changes:\n%s", n, far)
+	}
+	near := unifiedDiff("f", numbered(1, 20, nil), numbered(1, 20, map[int]string{5: "five", 9: "nine"}))
+	if n := strings.Count(near, "@@ -"); n != 1 {
+		t.Errorf("%d hunks for nearby changes:\n%s", n, near)
+	}
+
+	big := unifiedDiff("f", numbered(1, maxDiffLines+1, nil), "")
+	if !strings.Contains(big, "diff omitted") {
+		t.Errorf("diff of a large file:\n%.200s", big)
+	}
+}
@@ -0,0 +1,342 @@
+package setup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uverustech/infra-agent/internal/config"
+	"github.com/uverustech/infra-agent/internal/timedexec"
+)
+
+const (
+	firewallTable      = "infra_agent"
+	firewallRuleset    = "/etc/infra-agent/firewall.nft"
+	firewallUnit       = "/etc/systemd/system/infra-agent-firewall.service"
+	firewallRevertUnit = "infra-agent-firewall-revert"
+)
+
+// FirewallRule allows traffic to a port, optionally only from some sources
+// and up to a rate. Everything not allowed hits the default policy.
+type FirewallRule struct {
+	Port    string   `mapstructure:"port"`
+	Proto   string   `mapstructure:"proto"`
+	Sources []string `mapstructure:"sources"`
+	Rate    string   `mapstructure:"rate"`
+	Comment string   `mapstructure:"comment"`
+}
+
+// FirewallSpec is the declarative policy under the "firewall" config key.
+type FirewallSpec struct {
+	Enabled       bool                      `mapstructure:"enabled"`
+	DefaultPolicy string                    `mapstructure:"default-policy"`
+	Base          []FirewallRule            `mapstructure:"base"`
+	NodeTypes     map[string][]FirewallRule `mapstructure:"node-types"`
+	ConfirmAfter  time.Duration             `mapstructure:"confirm-timeout"`
+}
+
+var (
+	portPattern = regexp.MustCompile(`^\d{1,5}(-\d{1,5})?$`)
+	ratePattern = regexp.MustCompile(`^\d+/(second|minute|hour|day)$`)
+)
+
+// PlanFirewall renders the nftables ruleset for this node type and plans
+// installing it, loading it on boot and applying it now. The ruleset lives in
+// its own table, so rules added by other tools (docker, fail2ban) survive.
+func PlanFirewall() (*Plan, error) {
+	plan := &Plan{Step: "firewall"}
+
+	spec, err := loadFirewallSpec()
+	if err != nil {
+		return nil, err
+	}
+	if !spec.Enabled {
+		plan.note("firewall.enabled is false, host firewall is not managed")
+		return plan, nil
+	}
+
+	rules := desiredFirewallRules(spec, config.GetString(config.KeyNodeType))
+	ruleset, err := renderFirewall(spec.DefaultPolicy, rules)
+	if err != nil {
+		return nil, err
+	}
+
+	// The ruleset is loaded and confirmed first; it is only installed for
+	// boot once the control plane is still reachable, so a ruleset that
+	// locks the node out is never loaded again by infra-agent-firewall.
+	var install []*Change
+	install = append(install, fileChange(firewallRuleset, []byte(ruleset), 0600))
+	install = append(install, fileChange(firewallUnit, []byte(firewallUnitFile), 0644))
+	if exec.Command("systemctl", "is-enabled", "--quiet", "infra-agent-firewall").Run() != nil {
+		install = append(install, commandChange("systemctl", "enable", "infra-agent-firewall"))
+	}
+
+	active, loaded := activeRuleset()
+	pending := false
+	for _, c := range install {
+		pending = pending || c != nil
+	}
+	if pending || !loaded {
+		plan.add(&Change{
+			Kind:        ChangeCommand,
+			Target:      "table inet " + firewallTable,
+			Description: fmt.Sprintf("load firewall ruleset (%d rules, policy %s)", len(rules), spec.DefaultPolicy),
+			apply: func() error {
+				return applyFirewall(ruleset, active, loaded, spec.ConfirmAfter)
+			},
+		})
+	}
+	for _, c := range install {
+		plan.add(c)
+	}
+	return plan, nil
+}
+
+// loadFirewallSpec reads each sub-key separately so that setting one of them
+// in the config file does not hide the defaults of the others.
+func loadFirewallSpec() (FirewallSpec, error) {
+	spec := FirewallSpec{
+		Enabled:       config.GetBool(config.KeyFirewall + ".enabled"),
+		DefaultPolicy: config.GetString(config.KeyFirewall + ".default-policy"),
+		ConfirmAfter:  config.GetDuration(config.KeyFirewall + ".confirm-timeout"),
+	}
+	if spec.DefaultPolicy != "drop" && spec.DefaultPolicy != "accept" {
+		return spec, fmt.Errorf("invalid firewall.default-policy %q (want drop or accept)", spec.DefaultPolicy)
+	}
+	if err := config.UnmarshalKey(config.KeyFirewall+".base", &spec.Base); err != nil {
+		return spec, fmt.Errorf("invalid firewall.base: %w", err)
+	}
+	if err := config.UnmarshalKey(config.KeyFirewall+".node-types", &spec.NodeTypes); err != nil {
+		return spec, fmt.Errorf("invalid firewall.node-types: %w", err)
+	}
+	return spec, nil
+}
+
+// desiredFirewallRules returns the base rules plus those of the node type and
+// each of its parent types, e.g. "server:build" also gets "server".
+func desiredFirewallRules(spec FirewallSpec, nodeType string) []FirewallRule {
+	rules := append([]FirewallRule{}, spec.Base...)
+	parts := strings.Split(nodeType, ":")
+	for i := range parts {
+		rules = append(rules, spec.NodeTypes[strings.Join(parts[:i+1], ":")]...)
+	}
+	return rules
+}
+
+// renderFirewall returns an nft script that replaces the infra_agent table in
+// one transaction. The leading empty table declaration makes the delete valid
+// on the first run.
+func renderFirewall(policy string, rules []FirewallRule) (string, error) {
+	var b strings.Builder
+	b.WriteString("# Managed by infra-agent. Do not edit.\n")
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n\n", firewallTable, firewallTable)
+	fmt.Fprintf(&b, "table inet %s {\n", firewallTable)
+	b.WriteString("\tchain input {\n")
+	fmt.Fprintf(&b, "\t\ttype filter hook input priority filter; policy %s;\n", policy)
+	b.WriteString("\t\tiif \"lo\" accept\n")
+	b.WriteString("\t\tct state established,related accept\n")
+	b.WriteString("\t\tct state invalid drop\n")
+	b.WriteString("\t\tmeta l4proto { icmp, ipv6-icmp } accept\n")
+	for i, r := range rules {
+		lines, err := renderFirewallRule(r)
+		if err != nil {
+			return "", fmt.Errorf("firewall rule %d (port %s): %w", i+1, r.Port, err)
+		}
+		for _, line := range lines {
+			b.WriteString("\t\t" + line + "\n")
+		}
+	}
+	b.WriteString("\t}\n}\n")
+	return b.String(), nil
+}
+
+// renderFirewallRule returns one nft rule per address family that has
+// sources, or a single rule when the port is open to everyone.
+func renderFirewallRule(r FirewallRule) ([]string, error) {
+	proto := r.Proto
+	if proto == "" {
+		proto = "tcp"
+	}
+	if proto != "tcp" && proto != "udp" {
+		return nil, fmt.Errorf("invalid proto %q (want tcp or udp)", proto)
+	}
+	if !portPattern.MatchString(r.Port) {
+		return nil, fmt.Errorf("invalid port %q", r.Port)
+	}
+	for _, p := range strings.Split(r.Port, "-") {
+		if n, _ := strconv.Atoi(p); n < 1 || n > 65535 {
+			return nil, fmt.Errorf("port %s out of range", p)
+		}
+	}
+	suffix := ""
+	if r.Rate != "" {
+		if !ratePattern.MatchString(r.Rate) {
+			return nil, fmt.Errorf("invalid rate %q (e.g. 100/second)", r.Rate)
+		}
+		suffix += " limit rate " + r.Rate
+	}
+	suffix += " accept"
+	if r.Comment != "" {
+		suffix += fmt.Sprintf(" comment %q", r.Comment)
+	}
+	match := fmt.Sprintf("%s dport %s", proto, r.Port)
+
+	if len(r.Sources) == 0 {
+		return []string{match + suffix}, nil
+	}
+	var v4, v6 []string
+	for _, src := range r.Sources {
+		ip, _, err := net.ParseCIDR(src)
+		if err != nil {
+			if ip = net.ParseIP(src); ip == nil {
+				return nil, fmt.Errorf("invalid source %q", src)
+			}
+		}
+		if ip.To4() != nil {
+			v4 = append(v4, src)
+		} else {
+			v6 = append(v6, src)
+		}
+	}
+	var lines []string
+	if len(v4) > 0 {
+		lines = append(lines, fmt.Sprintf("ip saddr { %s } %s%s", strings.Join(v4, ", "), match, suffix))
+	}
+	if len(v6) > 0 {
+		lines = append(lines, fmt.Sprintf("ip6 saddr { %s } %s%s", strings.Join(v6, ", "), match, suffix))
+	}
+	return lines, nil
+}
+
+const firewallUnitFile = `# Managed by infra-agent. Do not edit.
+[Unit]
+Description=infra-agent host firewall
+DefaultDependencies=no
+Before=network-pre.target
+Wants=network-pre.target
+ConditionPathExists=` + firewallRuleset + `
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=/usr/sbin/nft -f ` + firewallRuleset + `
+
+[Install]
+WantedBy=sysinit.target
+`
+
+func checkRuleset(ruleset string) error {
+	f, err := os.CreateTemp("", "firewall-*.nft")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(ruleset); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if out, err := exec.Command("nft", "-c", "-f", f.Name()).CombinedOutput(); err != nil {
+		return fmt.Errorf("nft ruleset check failed: %v\n%s", err, string(out))
+	}
+	return nil
+}
+
+// activeRuleset returns the loaded infra_agent table, if any.
+func activeRuleset() (string, bool) {
+	out, err := timedexec.Command(config.KeyTimeoutCommand, "nft", "list", "table", "inet", firewallTable).Output()
+	if err != nil {
+		return "", false
+	}
+	return string(out), true
+}
+
+// applyFirewall loads the ruleset under a dead man's switch: a transient
+// systemd timer restores the previous ruleset unless the control plane is
+// still reachable afterwards and the timer is cancelled. The timer outlives
+// this process, so a setup run cut off by its own rules is reverted too.
+func applyFirewall(ruleset, previous string, hadPrevious bool, confirmAfter time.Duration) error {
+	if err := checkRuleset(ruleset); err != nil {
+		return err
+	}
+	stateDir := config.GetString(config.KeyStateDir)
+	pendingFile := filepath.Join(stateDir, "firewall-pending.nft")
+	if err := WriteFileAtomic(pendingFile, []byte(ruleset), 0600); err != nil {
+		return err
+	}
+	defer os.Remove(pendingFile)
+
+	restore := fmt.Sprintf("table inet %s\ndelete table inet %s\n", firewallTable, firewallTable)
+	if hadPrevious {
+		restore += previous
+	}
+	restoreFile := filepath.Join(stateDir, "firewall-previous.nft")
+	if err := WriteFileAtomic(restoreFile, []byte(restore), 0600); err != nil {
+		return err
+	}
+
+	// A leftover timer from an earlier run would revert the new rules.
+	exec.Command("systemctl", "stop", firewallRevertUnit+".timer").Run()
+	if err := runCommand("systemd-run", "--unit", firewallRevertUnit,
+		fmt.Sprintf("--on-active=%ds", int(confirmAfter.Seconds())),
+		"/usr/sbin/nft", "-f", restoreFile); err != nil {
+		return fmt.Errorf("failed to arm firewall revert timer: %w", err)
+	}
+	// Keep trying until shortly before the timer fires, leaving time to
+	// cancel it.
+	deadline := time.Now().Add(confirmAfter - min(10*time.Second, confirmAfter/2))
+
+	if err := runCommand("nft", "-f", pendingFile); err != nil {
+		exec.Command("systemctl", "stop", firewallRevertUnit+".timer").Run()
+		return err
+	}
+
+	if err := confirmControlPlane(deadline); err != nil {
+		revertErr := runCommand("nft", "-f", restoreFile)
+		exec.Command("systemctl", "stop", firewallRevertUnit+".timer").Run()
+		if revertErr != nil {
+			return fmt.Errorf("control plane unreachable after applying firewall (%v); revert failed, timer will retry: %v", err, revertErr)
+		}
+		return fmt.Errorf("control plane unreachable after applying firewall, previous ruleset restored: %w", err)
+	}
+	return runCommand("systemctl", "stop", firewallRevertUnit+".timer")
+}
+
+// confirmControlPlane retries until the control plane answers an HTTP
+// request or the deadline passes. Any response counts; only connectivity is
+// being checked.
+func confirmControlPlane(deadline time.Time) error {
+	controlURL := config.GetString(config.KeyControlURL)
+	for {
+		client := &http.Client{Timeout: min(config.GetDuration(config.KeyTimeoutHTTP), time.Until(deadline))}
+		resp, err := client.Get(controlURL)
+		if err == nil {
+			resp.Body.Close()
+			return nil
+		}
+		if time.Until(deadline) < 2*time.Second {
+			return err
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// FirewallRulesetHash returns the sha256 of the active infra_agent table, or
+// "" if no ruleset is loaded.
+func FirewallRulesetHash() string {
+	active, ok := activeRuleset()
+	if !ok {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(active))
+	return hex.EncodeToString(sum[:])
+}
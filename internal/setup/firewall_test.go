@@ -0,0 +1,202 @@
+package setup
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+func TestRenderFirewallRule(t *testing.T) {
+	tests := []struct {
+		rule FirewallRule
+		want []string
+		err  string
+	}{
+		{FirewallRule{Port: "22"}, []string{"tcp dport 22 accept"}, ""},
+		{FirewallRule{Port: "443", Proto: "udp", Comment: "quic"}, []string{`udp dport 443 accept comment "quic"`}, ""},
+		{FirewallRule{Port: "8000-8100", Rate: "100/second"}, []string{"tcp dport 8000-8100 limit rate 100/second accept"}, ""},
+		{FirewallRule{Port: "9100", Sources: []string{"10.0.0.0/8", "fd00::/8", "192.0.2.7", "2001:db8::1"}}, []string{
+			"ip saddr { 10.0.0.0/8, 192.0.2.7 } tcp dport 9100 accept",
+			"ip6 saddr { fd00::/8, 2001:db8::1 } tcp dport 9100 accept",
+		}, ""},
+		{FirewallRule{Port: "53", Proto: "icmp"}, nil, "invalid proto"},
+		{FirewallRule{Port: "ssh"}, nil, "invalid port"},
+		{FirewallRule{Port: "0"}, nil, "out of range"},
+		{FirewallRule{Port: "80-70000"}, nil, "out of range"},
+		{FirewallRule{Port: "80", Rate: "fast"}, nil, "invalid rate"},
+		{FirewallRule{Port: "80", Sources: []string{"10.0.0.0/33"}}, nil, "invalid source"},
+		// The comment is quoted, so it cannot smuggle in another rule.
+		{FirewallRule{Port: "80", Comment: `x"; accept`}, []string{`tcp dport 80 accept comment "x\"; accept"`}, ""},
+	}
+	for _, tt := range tests {
+		got, err := renderFirewallRule(tt.rule)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%+v: error = %v, want %q", tt.rule, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v = %q, %v, want %q", tt.rule, got, err, tt.want)
+		}
+	}
+}
+
+func TestRenderFirewall(t *testing.T) {
+	got, err := renderFirewall("drop", []FirewallRule{{Port: "22", Comment: "ssh"}, {Port: "443", Proto: "udp"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# Managed by infra-agent. Do not edit.
+table inet infra_agent
+delete table inet infra_agent
+
+table inet infra_agent {
+	chain input {
+		type filter hook input priority filter; policy drop;
+		iif "lo" accept
+		ct state established,related accept
+		ct state invalid drop
+		meta l4proto { icmp, ipv6-icmp } accept
+		tcp dport 22 accept comment "ssh"
+		udp dport 443 accept
+	}
+}
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	if _, err := renderFirewall("drop", []FirewallRule{{Port: "22"}, {Port: "x"}}); err == nil || !strings.HasPrefix(err.Error(), "firewall rule 2 (port x)") {
+		t.Errorf("invalid rule: error = %v", err)
+	}
+}
+
+func TestLoadFirewallSpec(t *testing.T) {
+	viper.Reset()
+	config.Init()
+	t.Cleanup(viper.Reset)
+	// Setting one sub-key keeps the defaults of the others.
+	viper.Set(config.KeyFirewall+".enabled", true)
+	viper.Set(config.KeyFirewall+".node-types", map[string]interface{}{
+		"server":       []map[string]interface{}{{"port": "9100", "sources": []string{"10.0.0.0/8"}}},
+		"server:build": []map[string]interface{}{{"port": "8080"}},
+	})
+
+	spec, err := loadFirewallSpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !spec.Enabled || spec.DefaultPolicy != "drop" || spec.ConfirmAfter != 2*time.Minute {
+		t.Errorf("spec = %+v", spec)
+	}
+
+	var ports []string
+	for _, r := range desiredFirewallRules(spec, "server:build") {
+		ports = append(ports, r.Port)
+	}
+	if want := []string{"22", "9100", "8080"}; !reflect.DeepEqual(ports, want) {
+		t.Errorf("server:build ports = %q, want %q", ports, want)
+	}
+	if rules := desiredFirewallRules(spec, "gateway"); len(rules) != 1 {
+		t.Errorf("gateway rules = %+v, the node-types default was replaced", rules)
+	}
+
+	viper.Set(config.KeyFirewall+".default-policy", "reject")
+	if _, err := loadFirewallSpec(); err == nil || !strings.Contains(err.Error(), "invalid firewall.default-policy") {
+		t.Errorf("policy reject: error = %v", err)
+	}
+	viper.Set(config.KeyFirewall+".default-policy", "accept")
+	viper.Set(config.KeyFirewall+".base", "22")
+	if _, err := loadFirewallSpec(); err == nil || !strings.Contains(err.Error(), "invalid firewall.base") {
+		t.Errorf("base as a string: error = %v", err)
+	}
+}
+
+// useFirewallCommands records runCommand calls and puts an nft stub on PATH
+// for the ruleset check. nft -c fails while the returned flag is set.
+func useFirewallCommands(t *testing.T) (calls *[]string, nftFails func(bool)) {
+	t.Helper()
+	bin := t.TempDir()
+	t.Setenv("PATH", bin)
+	viper.Set(config.KeyStateDir, t.TempDir())
+	viper.Set(config.KeyTimeoutHTTP, "1s")
+	t.Cleanup(viper.Reset)
+	nftFails = func(fail bool) {
+		code := "0"
+		if fail {
+			code = "1"
+		}
+		os.WriteFile(filepath.Join(bin, "nft"), []byte("#!/bin/sh\nexit "+code+"\n"), 0755)
+	}
+	nftFails(false)
+	calls, _ = stubCommands(t)
+	return calls, nftFails
+}
+
+func TestApplyFirewall(t *testing.T) {
+	calls, nftFails := useFirewallCommands(t)
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	viper.Set(config.KeyControlURL, srv.URL)
+	stateDir := config.GetString(config.KeyStateDir)
+
+	if err := applyFirewall("table inet infra_agent {}\n", "", false, 4*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"systemd-run --unit infra-agent-firewall-revert --on-active=4s /usr/sbin/nft -f " + filepath.Join(stateDir, "firewall-previous.nft"),
+		"nft -f " + filepath.Join(stateDir, "firewall-pending.nft"),
+		"systemctl stop infra-agent-firewall-revert.timer",
+	}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Errorf("ran %q, want %q", *calls, want)
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, "firewall-pending.nft")); !os.IsNotExist(err) {
+		t.Errorf("pending ruleset left behind: %v", err)
+	}
+
+	// Without the control plane the previous ruleset is put back.
+	*calls = nil
+	viper.Set(config.KeyControlURL, "http://127.0.0.1:1")
+	previous := "table inet infra_agent { }\n"
+	err := applyFirewall("table inet infra_agent {}\n", previous, true, 2*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "previous ruleset restored") {
+		t.Fatalf("unreachable control plane: error = %v", err)
+	}
+	if len(*calls) != 3 || (*calls)[2] != "nft -f "+filepath.Join(stateDir, "firewall-previous.nft") {
+		t.Errorf("ran %q", *calls)
+	}
+	restore, _ := os.ReadFile(filepath.Join(stateDir, "firewall-previous.nft"))
+	if want := "table inet infra_agent\ndelete table inet infra_agent\n" + previous; string(restore) != want {
+		t.Errorf("restore script = %q, want %q", restore, want)
+	}
+
+	// A ruleset nft rejects is never loaded.
+	*calls = nil
+	nftFails(true)
+	if err := applyFirewall("garbage", "", false, 2*time.Second); err == nil || !strings.Contains(err.Error(), "nft ruleset check failed") {
+		t.Errorf("invalid ruleset: error = %v", err)
+	}
+	if len(*calls) != 0 {
+		t.Errorf("ran %q for a rejected ruleset", *calls)
+	}
+}
+
+func TestPlanFirewallDisabled(t *testing.T) {
+	viper.Reset()
+	config.Init()
+	t.Cleanup(viper.Reset)
+	plan, err := PlanFirewall()
+	if err != nil || len(plan.Changes) != 0 || len(plan.Notes) != 1 {
+		t.Errorf("PlanFirewall() = %+v, %v", plan, err)
+	}
+}
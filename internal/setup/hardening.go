@@ -1,12 +1,500 @@
 package setup
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/uverustech/infra-agent/internal/config"
+	"github.com/uverustech/infra-agent/internal/timedexec"
 )
 
-func RunHardening(cmd *cobra.Command, args []string) error {
-	fmt.Println("OS Hardening (Not implemented yet)")
+const (
+	// sshd keeps the first value it reads for a keyword and reads drop-ins
+	// in lexical order, so ours must sort before e.g. 50-cloud-init.conf.
+	sshdDropIn   = "/etc/ssh/sshd_config.d/00-infra-agent.conf"
+	sysctlDropIn = "/etc/sysctl.d/60-infra-agent.conf"
+	fstabPath    = "/etc/fstab"
+)
+
+// sysctlBaseline is the network hardening applied to every node.
+var sysctlBaseline = []string{
+	"net.ipv4.conf.all.rp_filter = 1",
+	"net.ipv4.conf.default.rp_filter = 1",
+	"net.ipv4.conf.all.accept_redirects = 0",
+	"net.ipv4.conf.default.accept_redirects = 0",
+	"net.ipv4.conf.all.send_redirects = 0",
+	"net.ipv4.conf.default.send_redirects = 0",
+	"net.ipv4.conf.all.accept_source_route = 0",
+	"net.ipv4.conf.default.accept_source_route = 0",
+	"net.ipv4.conf.all.log_martians = 1",
+	"net.ipv4.icmp_echo_ignore_broadcasts = 1",
+	"net.ipv4.icmp_ignore_bogus_error_responses = 1",
+	"net.ipv4.tcp_syncookies = 1",
+	"net.ipv6.conf.all.accept_redirects = 0",
+	"net.ipv6.conf.default.accept_redirects = 0",
+	"net.ipv6.conf.all.accept_source_route = 0",
+}
+
+// secureMounts lists the mount options enforced per mount point.
+var secureMounts = []struct {
+	MountPoint string
+	Options    []string
+}{
+	{"/tmp", []string{"nodev", "nosuid", "noexec"}},
+	{"/dev/shm", []string{"nodev", "nosuid", "noexec"}},
+}
+
+// securePerms lists files whose mode must not be looser than given.
+var securePerms = []struct {
+	Path string
+	Mode fs.FileMode
+}{
+	{"/etc/passwd", 0644},
+	{"/etc/group", 0644},
+	{"/etc/shadow", 0640},
+	{"/etc/gshadow", 0640},
+	{"/etc/ssh/sshd_config", 0600},
+	{"/etc/crontab", 0600},
+	{"/etc/cron.d", 0700},
+}
+
+// hardeningBackup records everything a run touched so it can be reverted.
+type hardeningBackup struct {
+	Dir              string       `json:"-"`
+	CreatedAt        time.Time    `json:"created_at"`
+	Files            []backupFile `json:"files"`
+	DisabledServices []string     `json:"disabled_services"`
+	Modes            []backupMode `json:"modes"`
+}
+
+type backupFile struct {
+	Path    string      `json:"path"`
+	Existed bool        `json:"existed"`
+	Mode    fs.FileMode `json:"mode"`
+}
+
+type backupMode struct {
+	Path string      `json:"path"`
+	Mode fs.FileMode `json:"mode"`
+}
+
+// PlanHardening compares the system against the baseline and plans only the
+// changes that are actually needed, so re-running is a no-op. Every file the
+// plan touches is backed up before it is modified.
+func PlanHardening() (*Plan, error) {
+	plan := &Plan{Step: "hardening"}
+	backup := &hardeningBackup{
+		Dir:       filepath.Join(hardeningBackupRoot(), time.Now().UTC().Format("20060102T150405Z")),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	before := len(plan.Changes)
+	plan.add(backedUpFile(backup, sshdDropIn, renderSSHDConfig(), 0644, validateAndReloadSSHD))
+	if len(plan.Changes) > before {
+		plan.add(&Change{
+			Kind:        ChangeCommand,
+			Target:      "sshd -T",
+			Description: "check the effective sshd settings",
+			apply:       checkEffectiveSSHD,
+		})
+	} else if err := checkEffectiveSSHD(); err != nil {
+		// The drop-in is in place but something overrides it.
+		return nil, err
+	}
+
+	sysctl := "# Managed by infra-agent. Do not edit.\n" + strings.Join(sysctlBaseline, "\n") + "\n"
+	plan.add(backedUpFile(backup, sysctlDropIn, sysctl, 0644, func() error {
+		return runCommand("sysctl", "-p", sysctlDropIn)
+	}))
+
+	fstab, err := os.ReadFile(fstabPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", fstabPath, err)
+	}
+	plan.add(backedUpFile(backup, fstabPath, secureFstab(string(fstab)), 0644, remountSecure))
+
+	for _, svc := range config.GetStringSlice(config.KeyDisableServices) {
+		if exec.Command("systemctl", "is-enabled", "--quiet", svc).Run() != nil {
+			continue
+		}
+		svc := svc
+		plan.add(&Change{
+			Kind:        ChangeService,
+			Target:      svc,
+			Description: fmt.Sprintf("disable service %s", svc),
+			apply: func() error {
+				if err := runCommand("systemctl", "disable", "--now", svc); err != nil {
+					return err
+				}
+				backup.DisabledServices = append(backup.DisabledServices, svc)
+				return nil
+			},
+		})
+	}
+
+	for _, p := range securePerms {
+		info, err := os.Stat(p.Path)
+		if err != nil {
+			continue
+		}
+		current := info.Mode().Perm()
+		if current&^p.Mode == 0 {
+			continue
+		}
+		p := p
+		plan.add(&Change{
+			Kind:        ChangePermission,
+			Target:      p.Path,
+			Description: fmt.Sprintf("chmod %s %04o → %04o", p.Path, current, p.Mode),
+			apply: func() error {
+				if err := os.Chmod(p.Path, p.Mode); err != nil {
+					return err
+				}
+				backup.Modes = append(backup.Modes, backupMode{Path: p.Path, Mode: current})
+				return nil
+			},
+		})
+	}
+
+	if len(plan.Changes) == 0 {
+		return plan, nil
+	}
+	plan.prepare = func() error {
+		if err := os.MkdirAll(backup.Dir, 0700); err != nil {
+			return fmt.Errorf("failed to create backup dir: %w", err)
+		}
+		return nil
+	}
+	plan.finish = func(err error) error {
+		if saveErr := backup.save(); saveErr != nil {
+			if err != nil {
+				return fmt.Errorf("%w (and failed to save backup manifest: %v)", err, saveErr)
+			}
+			return fmt.Errorf("failed to save backup manifest: %w", saveErr)
+		}
+		if err != nil {
+			return fmt.Errorf("%w (revert with 'infra-agent setup revert-hardening')", err)
+		}
+		fmt.Printf("Hardening applied. Backup stored in %s\n", backup.Dir)
+		return nil
+	}
+
+	return plan, nil
+}
+
+// sshdSettings returns the keywords and values of the sshd drop-in, in order.
+func sshdSettings() [][2]string {
+	settings := [][2]string{
+		{"PasswordAuthentication", "no"},
+		{"KbdInteractiveAuthentication", "no"},
+		{"PermitEmptyPasswords", "no"},
+		{"PermitRootLogin", config.GetString(config.KeyPermitRootLogin)},
+		{"X11Forwarding", "no"},
+		{"MaxAuthTries", "3"},
+	}
+	if users := config.GetStringSlice(config.KeyAllowUsers); len(users) > 0 {
+		settings = append(settings, [2]string{"AllowUsers", strings.Join(users, " ")})
+	}
+	return settings
+}
+
+func renderSSHDConfig() string {
+	var buf bytes.Buffer
+	buf.WriteString("# Managed by infra-agent. Do not edit.\n")
+	for _, s := range sshdSettings() {
+		fmt.Fprintf(&buf, "%s %s\n", s[0], s[1])
+	}
+	return buf.String()
+}
+
+// checkEffectiveSSHD compares the settings sshd actually uses (sshd -T)
+// with the drop-in, since an earlier file or the main config can override
+// it.
+func checkEffectiveSSHD() error {
+	out, err := timedexec.Command(config.KeyTimeoutCommand, "sshd", "-T").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("sshd -T failed: %v\n%s", err, string(out))
+	}
+	effective := parseSSHDEffective(string(out))
+	var mismatches []string
+	for _, s := range sshdSettings() {
+		keyword := strings.ToLower(s[0])
+		want := normalizeSSHDValue(keyword, s[1])
+		if got := effective[keyword]; got != want {
+			mismatches = append(mismatches, fmt.Sprintf("%s is %q, want %q", s[0], got, want))
+		}
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("sshd does not use the hardened settings (overridden by another file in /etc/ssh?): %s",
+			strings.Join(mismatches, "; "))
+	}
+	return nil
+}
+
+// parseSSHDEffective reads sshd -T output into keyword → value. Keywords
+// listed once per value (allowusers) are joined with spaces.
+func parseSSHDEffective(out string) map[string]string {
+	effective := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		keyword, value, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if !ok {
+			continue
+		}
+		value = normalizeSSHDValue(keyword, value)
+		if prev, ok := effective[keyword]; ok {
+			value = prev + " " + value
+		}
+		effective[keyword] = value
+	}
+	return effective
+}
+
+func normalizeSSHDValue(keyword, value string) string {
+	value = strings.ToLower(strings.TrimSpace(value))
+	// Older sshd versions print prohibit-password under its former name.
+	if keyword == "permitrootlogin" && value == "without-password" {
+		return "prohibit-password"
+	}
+	return value
+}
+
+// secureFstab ensures each secure mount point has an fstab entry carrying the
+// required options, leaving every other line untouched.
+func secureFstab(fstab string) string {
+	lines := strings.Split(strings.TrimRight(fstab, "\n"), "\n")
+	for _, m := range secureMounts {
+		found := false
+		for i, line := range lines {
+			fields := strings.Fields(line)
+			if len(fields) < 4 || strings.HasPrefix(fields[0], "#") || fields[1] != m.MountPoint {
+				continue
+			}
+			found = true
+			opts := strings.Split(fields[3], ",")
+			for _, want := range m.Options {
+				if !containsString(opts, want) {
+					opts = append(opts, want)
+				}
+			}
+			fields[3] = strings.Join(opts, ",")
+			lines[i] = strings.Join(fields, "\t")
+		}
+		if !found {
+			lines = append(lines, fmt.Sprintf("tmpfs\t%s\ttmpfs\tdefaults,%s\t0\t0", m.MountPoint, strings.Join(m.Options, ",")))
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// backedUpFile plans writing content to path, backing the file up first.
+// after runs once the file is in place; if it fails the previous file is
+// restored.
+func backedUpFile(b *hardeningBackup, path, content string, mode fs.FileMode, after func() error) *Change {
+	c := fileChange(path, []byte(content), mode)
+	if c == nil {
+		return nil
+	}
+	write := c.apply
+	c.apply = func() error {
+		if err := b.backupFile(path); err != nil {
+			return err
+		}
+		if err := write(); err != nil {
+			return err
+		}
+		if err := after(); err != nil {
+			if rerr := b.restoreFile(b.Files[len(b.Files)-1]); rerr != nil {
+				return fmt.Errorf("%w (restore failed: %v)", err, rerr)
+			}
+			b.Files = b.Files[:len(b.Files)-1]
+			return err
+		}
+		return nil
+	}
+	return c
+}
+
+func validateAndReloadSSHD() error {
+	if out, err := timedexec.Command(config.KeyTimeoutCommand, "sshd", "-t").CombinedOutput(); err != nil {
+		return fmt.Errorf("sshd config validation failed: %v\n%s", err, string(out))
+	}
+	return runTimed("systemctl", "reload", "ssh")
+}
+
+// remountSecure applies new options to mounts that are already separate
+// filesystems; anything else takes effect on next boot.
+func remountSecure() error {
+	mounts, _ := os.ReadFile("/proc/self/mounts")
+	for _, m := range secureMounts {
+		if !strings.Contains(string(mounts), " "+m.MountPoint+" ") {
+			fmt.Printf("%s is not a separate mount; new options apply after reboot\n", m.MountPoint)
+			continue
+		}
+		if err := runCommand("mount", "-o", "remount,"+strings.Join(m.Options, ","), m.MountPoint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *hardeningBackup) backupFile(path string) error {
+	entry := backupFile{Path: path}
+	info, err := os.Stat(path)
+	if err == nil {
+		entry.Existed = true
+		entry.Mode = info.Mode().Perm()
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(b.Dir, "files", path)
+		if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			return err
+		}
+		if err := os.WriteFile(dst, content, 0600); err != nil {
+			return fmt.Errorf("failed to back up %s: %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	b.Files = append(b.Files, entry)
+	return nil
+}
+
+func (b *hardeningBackup) restoreFile(f backupFile) error {
+	if !f.Existed {
+		if err := os.Remove(f.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	content, err := os.ReadFile(filepath.Join(b.Dir, "files", f.Path))
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(f.Path, content, f.Mode)
+}
+
+func (b *hardeningBackup) save() error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(b.Dir, "manifest.json"), data, 0600)
+}
+
+// RevertHardening restores everything recorded by the most recent hardening run.
+func RevertHardening(cmd *cobra.Command, args []string) error {
+	autoConfirm := config.GetBool(config.KeyAutoConfirm)
+	b, err := latestHardeningBackup()
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		return fmt.Errorf("no hardening backups found in %s", hardeningBackupRoot())
+	}
+
+	fmt.Printf("Reverting hardening run from %s:\n", b.CreatedAt.Format(time.RFC3339))
+	for _, f := range b.Files {
+		fmt.Printf("  - restore %s\n", f.Path)
+	}
+	for _, svc := range b.DisabledServices {
+		fmt.Printf("  - re-enable service %s\n", svc)
+	}
+	for _, m := range b.Modes {
+		fmt.Printf("  - chmod %s %04o\n", m.Path, m.Mode)
+	}
+	if !confirmAction("Revert these changes?", autoConfirm) {
+		fmt.Println("Skipping revert")
+		return nil
+	}
+	if err := b.revert(); err != nil {
+		return err
+	}
+	fmt.Println("Hardening reverted")
+	return nil
+}
+
+// revertAllHardening undoes every recorded hardening run, newest first, so
+// the system ends up as it was before the first one.
+func revertAllHardening() error {
+	for {
+		b, err := latestHardeningBackup()
+		if err != nil || b == nil {
+			return err
+		}
+		if err := b.revert(); err != nil {
+			return err
+		}
+	}
+}
+
+func hardeningBackupRoot() string {
+	return filepath.Join(config.GetString(config.KeyStateDir), "backups", "hardening")
+}
+
+// latestHardeningBackup returns the most recent backup, or nil if there is
+// none.
+func latestHardeningBackup() (*hardeningBackup, error) {
+	root := hardeningBackupRoot()
+	entries, err := os.ReadDir(root)
+	if err != nil || len(entries) == 0 {
+		return nil, nil
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+
+	b := &hardeningBackup{Dir: filepath.Join(root, names[len(names)-1])}
+	data, err := os.ReadFile(filepath.Join(b.Dir, "manifest.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup manifest: %w", err)
+	}
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, fmt.Errorf("invalid backup manifest: %w", err)
+	}
+	return b, nil
+}
+
+// revert restores the files, services and modes recorded in the backup and
+// removes it.
+func (b *hardeningBackup) revert() error {
+	for _, f := range b.Files {
+		if err := b.restoreFile(f); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", f.Path, err)
+		}
+	}
+	for _, svc := range b.DisabledServices {
+		if err := runCommand("systemctl", "enable", "--now", svc); err != nil {
+			return err
+		}
+	}
+	for _, m := range b.Modes {
+		if err := os.Chmod(m.Path, m.Mode); err != nil {
+			return fmt.Errorf("failed to restore mode of %s: %w", m.Path, err)
+		}
+	}
+
+	if err := validateAndReloadSSHD(); err != nil {
+		return err
+	}
+	if err := runCommand("sysctl", "--system"); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(b.Dir); err != nil {
+		return fmt.Errorf("reverted, but failed to remove backup %s: %w", b.Dir, err)
+	}
 	return nil
 }
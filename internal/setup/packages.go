@@ -1,12 +1,325 @@
 package setup
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
-	"github.com/spf13/cobra"
+	"github.com/uverustech/infra-agent/internal/config"
 )
 
-func RunPackages(cmd *cobra.Command, args []string) error {
-	fmt.Println("Package Installation (Not implemented yet)")
+// PackageSpec is the declarative package configuration under the "packages"
+// config key.
+type PackageSpec struct {
+	Base         []string            `mapstructure:"base"`
+	NodeTypes    map[string][]string `mapstructure:"node-types"`
+	Pinned       map[string]string   `mapstructure:"pinned"`
+	Remove       []string            `mapstructure:"remove"`
+	Repositories []AptRepository     `mapstructure:"repositories"`
+}
+
+// AptRepository is an extra apt source whose packages are only trusted when
+// signed by the key fetched from KeyURL.
+type AptRepository struct {
+	Name       string   `mapstructure:"name"`
+	URI        string   `mapstructure:"uri"`
+	Suite      string   `mapstructure:"suite"`
+	Components []string `mapstructure:"components"`
+	KeyURL     string   `mapstructure:"key-url"`
+}
+
+// packageManager is the system package backend. It is a variable so tests can
+// substitute a fake that needs no network or root.
+type packageManager interface {
+	// Installed returns the installed version of each of the given packages
+	// that is installed.
+	Installed(names []string) (map[string]string, error)
+	// RepositoryFiles returns the files (keyring and source list) that
+	// configure the repository, keyed by path.
+	RepositoryFiles(repo AptRepository) (map[string][]byte, error)
+	Update() error
+	Install(specs []string) error
+}
+
+var packageBackend packageManager = aptManager{}
+
+// packagePlan is the result of comparing the declared packages to the system.
+type packagePlan struct {
+	Install     []string
+	Upgrade     []string
+	WouldRemove []string
+}
+
+func PlanPackages() (*Plan, error) {
+	plan := &Plan{Step: "packages"}
+	nodeType := config.GetString(config.KeyNodeType)
+
+	spec, err := loadPackageSpec()
+	if err != nil {
+		return nil, err
+	}
+
+	reposChanged := false
+	for _, repo := range spec.Repositories {
+		files, err := packageBackend.RepositoryFiles(repo)
+		if err != nil {
+			return nil, fmt.Errorf("repository %s: %w", repo.Name, err)
+		}
+		paths := make([]string, 0, len(files))
+		for path := range files {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			if c := fileChange(path, files[path], 0644); c != nil {
+				plan.add(c)
+				reposChanged = true
+			}
+		}
+	}
+
+	desired := desiredPackages(spec, nodeType)
+	pkgPlan, err := planPackages(packageBackend, spec, desired, loadManagedPackages())
+	if err != nil {
+		return nil, err
+	}
+
+	// Refresh the lists once, before installing: new repositories are unknown
+	// to apt until then, and on a fresh node the package cache is empty.
+	if reposChanged || len(pkgPlan.Install) > 0 || len(pkgPlan.Upgrade) > 0 {
+		plan.add(&Change{
+			Kind:        ChangeCommand,
+			Target:      "apt-get update",
+			Description: "refresh apt package lists",
+			apply:       packageBackend.Update,
+		})
+	}
+
+	for _, group := range []struct {
+		verb string
+		pkgs []string
+	}{{"install", pkgPlan.Install}, {"upgrade", pkgPlan.Upgrade}} {
+		if len(group.pkgs) == 0 {
+			continue
+		}
+		pkgs := group.pkgs
+		plan.add(&Change{
+			Kind:        ChangePackage,
+			Target:      strings.Join(pkgs, " "),
+			Description: fmt.Sprintf("%s %s", group.verb, strings.Join(pkgs, ", ")),
+			apply: func() error {
+				return packageBackend.Install(pkgs)
+			},
+		})
+	}
+
+	if len(plan.Changes) == 0 {
+		plan.note("all %d declared packages are installed", len(desired))
+	}
+	// Removal is reported rather than performed: apt may drag dependants along.
+	for _, p := range pkgPlan.WouldRemove {
+		plan.note("would remove %s (not declared or listed under packages.remove)", p)
+	}
+
+	// Record the declared set even when nothing changed, so packages dropped
+	// later are reported.
+	plan.finish = func(err error) error {
+		if err != nil {
+			return err
+		}
+		return saveManagedPackages(desired)
+	}
+	return plan, nil
+}
+
+// loadPackageSpec reads each sub-key separately so that setting one of them
+// in the config file does not hide the defaults of the others.
+func loadPackageSpec() (PackageSpec, error) {
+	spec := PackageSpec{
+		Base:   config.GetStringSlice(config.KeyPackages + ".base"),
+		Pinned: config.GetStringMapString(config.KeyPackages + ".pinned"),
+		Remove: config.GetStringSlice(config.KeyPackages + ".remove"),
+	}
+	if err := config.UnmarshalKey(config.KeyPackages+".node-types", &spec.NodeTypes); err != nil {
+		return spec, fmt.Errorf("invalid packages.node-types: %w", err)
+	}
+	if err := config.UnmarshalKey(config.KeyPackages+".repositories", &spec.Repositories); err != nil {
+		return spec, fmt.Errorf("invalid packages.repositories: %w", err)
+	}
+	return spec, nil
+}
+
+// desiredPackages resolves the base set plus the sets for the node type and
+// each of its parent types, e.g. "server:build" also gets "server".
+func desiredPackages(spec PackageSpec, nodeType string) []string {
+	set := map[string]bool{}
+	for _, p := range spec.Base {
+		set[p] = true
+	}
+	parts := strings.Split(nodeType, ":")
+	for i := range parts {
+		for _, p := range spec.NodeTypes[strings.Join(parts[:i+1], ":")] {
+			set[p] = true
+		}
+	}
+	for _, p := range spec.Remove {
+		delete(set, p)
+	}
+
+	out := make([]string, 0, len(set))
+	for p := range set {
+		out = append(out, p)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func planPackages(pm packageManager, spec PackageSpec, desired, previous []string) (*packagePlan, error) {
+	query := append(append([]string{}, desired...), spec.Remove...)
+	query = append(query, previous...)
+	installed, err := pm.Installed(query)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &packagePlan{}
+	for _, p := range desired {
+		pin := spec.Pinned[p]
+		version, ok := installed[p]
+		switch {
+		case !ok && pin != "":
+			plan.Install = append(plan.Install, p+"="+pin)
+		case !ok:
+			plan.Install = append(plan.Install, p)
+		case pin != "" && version != pin:
+			plan.Upgrade = append(plan.Upgrade, p+"="+pin)
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, p := range append(append([]string{}, spec.Remove...), previous...) {
+		if _, ok := installed[p]; !ok || seen[p] || containsString(desired, p) {
+			continue
+		}
+		seen[p] = true
+		plan.WouldRemove = append(plan.WouldRemove, p)
+	}
+	return plan, nil
+}
+
+func managedPackagesFile() string {
+	return filepath.Join(config.GetString(config.KeyStateDir), "packages.json")
+}
+
+// loadManagedPackages returns the packages declared on the previous run, so
+// packages dropped from the config can be reported.
+func loadManagedPackages() []string {
+	data, err := os.ReadFile(managedPackagesFile())
+	if err != nil {
+		return nil
+	}
+	var pkgs []string
+	json.Unmarshal(data, &pkgs)
+	return pkgs
+}
+
+func saveManagedPackages(pkgs []string) error {
+	data, _ := json.Marshal(pkgs)
+	if err := os.MkdirAll(filepath.Dir(managedPackagesFile()), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(managedPackagesFile(), data, 0644)
+}
+
+// aptManager implements packageManager with dpkg-query and apt-get.
+type aptManager struct{}
+
+func (aptManager) Installed(names []string) (map[string]string, error) {
+	installed := map[string]string{}
+	if len(names) == 0 {
+		return installed, nil
+	}
+	args := append([]string{"-W", "-f=${Package}\t${Version}\t${db:Status-Status}\n"}, names...)
+	// dpkg-query exits 1 when some packages are unknown but still prints the rest.
+	out, err := exec.Command("dpkg-query", args...).Output()
+	if err != nil && len(out) == 0 {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return nil, fmt.Errorf("dpkg-query failed: %w", err)
+		}
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) == 3 && fields[2] == "installed" {
+			installed[fields[0]] = fields[1]
+		}
+	}
+	return installed, nil
+}
+
+func (aptManager) Update() error {
+	fmt.Println("Running apt-get update...")
+	return runCommand("apt-get", "update", "-qq")
+}
+
+func (aptManager) Install(specs []string) error {
+	args := append([]string{"install", "-y", "-qq", "--allow-downgrades"}, specs...)
+	cmd := exec.Command("apt-get", args...)
+	cmd.Env = append(os.Environ(), "DEBIAN_FRONTEND=noninteractive")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("apt-get install failed: %v\n%s", err, string(out))
+	}
 	return nil
 }
+
+func (aptManager) RepositoryFiles(repo AptRepository) (map[string][]byte, error) {
+	if repo.Name == "" || repo.URI == "" || repo.KeyURL == "" {
+		return nil, fmt.Errorf("name, uri and key-url are required")
+	}
+
+	key, err := downloadKey(repo.KeyURL)
+	if err != nil {
+		return nil, err
+	}
+	// apt reads armored keys directly as long as the file ends in .asc.
+	keyring := filepath.Join("/etc/apt/keyrings", repo.Name+".gpg")
+	if bytes.HasPrefix(bytes.TrimSpace(key), []byte("-----BEGIN PGP")) {
+		keyring = filepath.Join("/etc/apt/keyrings", repo.Name+".asc")
+	}
+
+	suite := repo.Suite
+	if suite == "" {
+		suite = "stable"
+	}
+	components := repo.Components
+	if len(components) == 0 {
+		components = []string{"main"}
+	}
+	list := fmt.Sprintf("# Managed by infra-agent. Do not edit.\ndeb [signed-by=%s] %s %s %s\n",
+		keyring, repo.URI, suite, strings.Join(components, " "))
+
+	return map[string][]byte{
+		keyring: key,
+		filepath.Join("/etc/apt/sources.list.d", repo.Name+".list"): []byte(list),
+	}, nil
+}
+
+func downloadKey(url string) ([]byte, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download key: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download key: %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
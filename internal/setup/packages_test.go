@@ -0,0 +1,133 @@
+package setup
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+// fakePackages is a packageManager that keeps the installed set in memory and
+// records the calls made to it.
+type fakePackages struct {
+	installed  map[string]string
+	installErr error
+	calls      []string
+}
+
+func (f *fakePackages) Installed(names []string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, n := range names {
+		if v, ok := f.installed[n]; ok {
+			out[n] = v
+		}
+	}
+	return out, nil
+}
+
+func (f *fakePackages) RepositoryFiles(repo AptRepository) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func (f *fakePackages) Update() error {
+	f.calls = append(f.calls, "update")
+	return nil
+}
+
+func (f *fakePackages) Install(specs []string) error {
+	f.calls = append(f.calls, "install "+strings.Join(specs, " "))
+	if f.installErr != nil {
+		return f.installErr
+	}
+	for _, s := range specs {
+		name, version, _ := strings.Cut(s, "=")
+		f.installed[name] = version
+	}
+	return nil
+}
+
+func usePackages(t *testing.T, fake *fakePackages, base []string, pinned map[string]string) {
+	t.Helper()
+	saved := packageBackend
+	packageBackend = fake
+	t.Cleanup(func() {
+		packageBackend = saved
+		viper.Reset()
+	})
+	viper.Set(config.KeyStateDir, t.TempDir())
+	viper.Set(config.KeyPackages+".base", base)
+	viper.Set(config.KeyPackages+".pinned", pinned)
+}
+
+func TestPlanPackagesInstall(t *testing.T) {
+	fake := &fakePackages{installed: map[string]string{"curl": "8.5.0"}}
+	usePackages(t, fake, []string{"git", "curl", "caddy"}, map[string]string{"caddy": "2.8.4"})
+
+	plan, err := PlanPackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var targets []string
+	for _, c := range plan.Changes {
+		targets = append(targets, c.Target)
+	}
+	want := []string{"apt-get update", "caddy=2.8.4 git"}
+	if !reflect.DeepEqual(targets, want) {
+		t.Fatalf("changes = %q, want %q", targets, want)
+	}
+
+	if err := plan.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"update", "install caddy=2.8.4 git"}; !reflect.DeepEqual(fake.calls, want) {
+		t.Errorf("calls = %q, want %q", fake.calls, want)
+	}
+	if got := loadManagedPackages(); !reflect.DeepEqual(got, []string{"caddy", "curl", "git"}) {
+		t.Errorf("managed packages = %q", got)
+	}
+}
+
+func TestPlanPackagesAlreadyInstalled(t *testing.T) {
+	fake := &fakePackages{installed: map[string]string{"git": "2.43.0", "caddy": "2.8.4"}}
+	usePackages(t, fake, []string{"git", "caddy"}, map[string]string{"caddy": "2.8.4"})
+
+	plan, err := PlanPackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 {
+		t.Fatalf("expected no changes, got %+v", plan.Changes)
+	}
+	if want := []string{"all 2 declared packages are installed"}; !reflect.DeepEqual(plan.Notes, want) {
+		t.Errorf("notes = %q, want %q", plan.Notes, want)
+	}
+	if err := plan.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.calls) != 0 {
+		t.Errorf("expected no package manager calls, got %q", fake.calls)
+	}
+}
+
+func TestPlanPackagesInstallFailure(t *testing.T) {
+	fake := &fakePackages{installed: map[string]string{}, installErr: errors.New("E: Unable to locate package caddy")}
+	usePackages(t, fake, []string{"caddy"}, nil)
+
+	plan, err := PlanPackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = plan.Apply()
+	if err == nil || !strings.Contains(err.Error(), "install caddy: E: Unable to locate package caddy") {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	// A failed run must not record the declaration, or the next run would
+	// not report packages dropped in between.
+	if _, err := os.Stat(managedPackagesFile()); !os.IsNotExist(err) {
+		t.Errorf("managed packages recorded after a failed install: %v", err)
+	}
+}
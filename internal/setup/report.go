@@ -0,0 +1,138 @@
+package setup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+var reportFile = "/etc/infra-agent/setup-report.json"
+
+// Step statuses in a setup report.
+const (
+	StepApplied   = "applied"
+	StepUnchanged = "unchanged"
+	StepSkipped   = "skipped"
+	StepDeclined  = "declined"
+	StepFailed    = "failed"
+)
+
+// SetupReport is the structured result of one setup run.
+type SetupReport struct {
+	NodeID       string       `json:"node_id"`
+	NodeType     string       `json:"node_type"`
+	AgentVersion string       `json:"agent_version"`
+	StartedAt    time.Time    `json:"started_at"`
+	FinishedAt   time.Time    `json:"finished_at"`
+	Status       string       `json:"status"`
+	PendingSteps []string     `json:"pending_steps"`
+	Steps        []StepReport `json:"steps"`
+}
+
+type StepReport struct {
+	Name       string   `json:"name"`
+	Status     string   `json:"status"`
+	Reason     string   `json:"reason,omitempty"`
+	DurationMS int64    `json:"duration_ms"`
+	Changes    []string `json:"changes,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// ReportSummary is the part of the latest report sent with every heartbeat.
+type ReportSummary struct {
+	FinishedAt   time.Time `json:"finished_at"`
+	Status       string    `json:"status"`
+	FailedStep   string    `json:"failed_step,omitempty"`
+	PendingSteps []string  `json:"pending_steps"`
+}
+
+func newReport() *SetupReport {
+	return &SetupReport{
+		NodeID:       config.GetString(config.KeyNodeID),
+		NodeType:     config.GetString(config.KeyNodeType),
+		AgentVersion: AgentVersion,
+		StartedAt:    time.Now().UTC(),
+		Steps:        []StepReport{},
+	}
+}
+
+func (r *SetupReport) add(s StepReport) {
+	r.Steps = append(r.Steps, s)
+}
+
+// finish sets the overall status, stores the report and posts it to the
+// control plane. "incomplete" means some step applicable to this node has
+// never succeeded, so provisioning is not done even if nothing failed.
+func (r *SetupReport) finish(state *SetupState) {
+	r.FinishedAt = time.Now().UTC()
+	r.PendingSteps = []string{}
+	for _, step := range Steps {
+		if !step.appliesTo(r.NodeType) {
+			continue
+		}
+		if st := state.Steps[step.Name]; st == nil || st.LastSuccess.IsZero() {
+			r.PendingSteps = append(r.PendingSteps, step.Name)
+		}
+	}
+
+	r.Status = "complete"
+	if len(r.PendingSteps) > 0 {
+		r.Status = "incomplete"
+	}
+	for _, s := range r.Steps {
+		if s.Status == StepFailed {
+			r.Status = "failed"
+		}
+	}
+
+	data, _ := json.MarshalIndent(r, "", "  ")
+	if err := WriteFileAtomic(reportFile, data, 0600); err != nil {
+		fmt.Printf("Warning: failed to store setup report: %v\n", err)
+	}
+	if err := postReport(data); err != nil {
+		fmt.Printf("Warning: failed to send setup report to control plane: %v\n", err)
+	}
+}
+
+func postReport(data []byte) error {
+	controlURL := config.GetString(config.KeyControlURL)
+	client := &http.Client{Timeout: config.GetDuration(config.KeyTimeoutHTTP)}
+	resp, err := client.Post(controlURL+"/api/setup/reports", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// LatestReportSummary returns a summary of the last stored setup report, or
+// nil if setup has never run on this node.
+func LatestReportSummary() *ReportSummary {
+	data, err := os.ReadFile(reportFile)
+	if err != nil {
+		return nil
+	}
+	var r SetupReport
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil
+	}
+	summary := &ReportSummary{
+		FinishedAt:   r.FinishedAt,
+		Status:       r.Status,
+		PendingSteps: r.PendingSteps,
+	}
+	for _, s := range r.Steps {
+		if s.Status == StepFailed {
+			summary.FailedStep = s.Name
+		}
+	}
+	return summary
+}
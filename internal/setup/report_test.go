@@ -0,0 +1,123 @@
+package setup
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+// useReportServer points control-url at a server collecting posted reports.
+func useReportServer(t *testing.T) func() []SetupReport {
+	t.Helper()
+	var mu sync.Mutex
+	var posted []SetupReport
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/setup/reports" {
+			http.NotFound(w, r)
+			return
+		}
+		var report SetupReport
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			t.Errorf("posted report: %v", err)
+		}
+		mu.Lock()
+		posted = append(posted, report)
+		mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+	viper.Set(config.KeyControlURL, srv.URL)
+	viper.Set(config.KeyTimeoutHTTP, "5s")
+	return func() []SetupReport {
+		mu.Lock()
+		defer mu.Unlock()
+		return posted
+	}
+}
+
+func stepStatuses(r SetupReport) map[string]string {
+	statuses := map[string]string{}
+	for _, s := range r.Steps {
+		statuses[s.Name] = s.Status
+	}
+	return statuses
+}
+
+func TestSetupReport(t *testing.T) {
+	r := useTestSteps(t)
+	posted := useReportServer(t)
+	viper.Set(config.KeyNodeID, "gw-1")
+
+	if LatestReportSummary() != nil {
+		t.Fatal("summary before any setup run")
+	}
+
+	// Only a: b and c apply to a gateway but have never run.
+	if err := runSetup(t, "--only", "a"); err != nil {
+		t.Fatal(err)
+	}
+	summary := LatestReportSummary()
+	if summary == nil || summary.Status != "incomplete" || !reflect.DeepEqual(summary.PendingSteps, []string{"c", "b"}) {
+		t.Fatalf("after --only a: %+v", summary)
+	}
+
+	// b fails, c is never reached.
+	r.fail["b"] = true
+	if err := runSetup(t); err == nil {
+		t.Fatal("failing step: no error")
+	}
+	summary = LatestReportSummary()
+	if summary.Status != "failed" || summary.FailedStep != "b" || !reflect.DeepEqual(summary.PendingSteps, []string{"c", "b"}) {
+		t.Errorf("after failure: %+v", summary)
+	}
+
+	r.fail["b"] = false
+	if err := runSetup(t); err != nil {
+		t.Fatal(err)
+	}
+	summary = LatestReportSummary()
+	if summary.Status != "complete" || summary.FailedStep != "" || len(summary.PendingSteps) != 0 {
+		t.Errorf("after success: %+v", summary)
+	}
+
+	reports := posted()
+	if len(reports) != 3 {
+		t.Fatalf("posted %d reports, want 3", len(reports))
+	}
+	last := reports[2]
+	if last.NodeID != "gw-1" || last.NodeType != "gateway" || last.AgentVersion != "1.0.0" || last.Status != "complete" {
+		t.Errorf("posted report = %+v", last)
+	}
+	// a is skipped because its inputs are unchanged since the first run.
+	want := map[string]string{"a": StepSkipped, "b": StepApplied, "c": StepApplied, "d": StepSkipped}
+	if got := stepStatuses(last); !reflect.DeepEqual(got, want) {
+		t.Errorf("step statuses = %v, want %v", got, want)
+	}
+	if got := stepStatuses(reports[1]); got["b"] != StepFailed || got["c"] != "" {
+		t.Errorf("failed run statuses = %v", got)
+	}
+	for _, s := range last.Steps {
+		if s.Name == "b" && !reflect.DeepEqual(s.Changes, []string{"run b"}) {
+			t.Errorf("b changes = %q", s.Changes)
+		}
+	}
+}
+
+// A report that cannot be posted is still stored.
+func TestSetupReportControlPlaneDown(t *testing.T) {
+	useTestSteps(t)
+	viper.Set(config.KeyControlURL, "http://127.0.0.1:1")
+	viper.Set(config.KeyTimeoutHTTP, "1s")
+
+	if err := runSetup(t); err != nil {
+		t.Fatal(err)
+	}
+	if s := LatestReportSummary(); s == nil || s.Status != "complete" {
+		t.Errorf("summary = %+v", s)
+	}
+}
@@ -0,0 +1,158 @@
+package setup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// accessSteps grant people access to the node; RevertAll can keep them so
+// the node stays reachable after the agent is gone.
+var accessSteps = []string{"users", "ssh", "ssh-ca"}
+
+// RevertAll undoes what the setup steps manage, in reverse dependency order,
+// and removes the setup state and report. It carries on past failures and
+// returns them all. Steps without a Revert (packages, timezone) are left as
+// they are.
+func RevertAll(keepAccess bool) error {
+	steps, err := orderedSteps()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for i := len(steps) - 1; i >= 0; i-- {
+		step := steps[i]
+		if step.Revert == nil || (keepAccess && containsString(accessSteps, step.Name)) {
+			continue
+		}
+		fmt.Printf("Reverting %s...\n", step.Name)
+		if err := step.Revert(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", step.Name, err))
+		}
+	}
+	for _, path := range []string{stateFile, reportFile} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// revertSSHKeys removes the managed block from the authorized_keys of every
+// user that has one, leaving the other lines.
+func revertSSHKeys() error {
+	names := loadManagedSSHUsers()
+	// Installs from before the managed list only have the declaration.
+	declared, err := declaredSSHKeys()
+	if err != nil && !errors.Is(err, errNoSSHKeys) {
+		return err
+	}
+	for name := range declared {
+		if !containsString(names, name) {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		u, err := user.Lookup(name)
+		if err != nil {
+			continue
+		}
+		if c := clearManagedKeys(u); c != nil {
+			if err := c.apply(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Remove(managedSSHUsersFile()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func stripManagedKeys(existing string) string {
+	var out []string
+	inBlock := false
+	for _, line := range strings.Split(strings.TrimRight(existing, "\n"), "\n") {
+		switch strings.TrimSpace(line) {
+		case managedKeysBegin:
+			inBlock = true
+		case managedKeysEnd:
+			inBlock = false
+		default:
+			if !inBlock {
+				out = append(out, line)
+			}
+		}
+	}
+	if len(out) == 0 || (len(out) == 1 && out[0] == "") {
+		return ""
+	}
+	return strings.Join(out, "\n") + "\n"
+}
+
+// revertSSHCA removes the CA trust and principals files and reloads sshd.
+func revertSSHCA() error {
+	if _, err := os.Stat(sshCADropIn); os.IsNotExist(err) {
+		return nil
+	}
+	for _, path := range []string{sshCADropIn, sshCAKeysFile, sshPrincipalsDir} {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return validateAndReloadSSHD()
+}
+
+// revertFirewall unloads the agent's nftables table and removes its boot unit.
+func revertFirewall() error {
+	if _, loaded := activeRuleset(); loaded {
+		if err := runCommand("nft", "delete", "table", "inet", firewallTable); err != nil {
+			return err
+		}
+	}
+	exec.Command("systemctl", "disable", "infra-agent-firewall").Run()
+	for _, path := range []string{firewallUnit, firewallRuleset} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return runCommand("systemctl", "daemon-reload")
+}
+
+// revertUsers removes the accounts the users step created with useradd and
+// the sudoers drop-ins. Accounts that existed before are kept even if they
+// were declared, and so are root and the operator running the uninstall.
+// Home directories are kept.
+func revertUsers() error {
+	users, err := readSystemUsers()
+	if err != nil {
+		return err
+	}
+	for _, name := range loadCreatedUsers() {
+		u, ok := users[name]
+		if !ok {
+			continue
+		}
+		if protectedUser(name, u) {
+			fmt.Printf("Keeping %s: it is the account running the uninstall or root\n", name)
+			continue
+		}
+		if err := runCommand("userdel", name); err != nil {
+			return err
+		}
+	}
+	dropIns, _ := filepath.Glob(filepath.Join(sudoersDir, "infra-agent-*"))
+	for _, path := range dropIns {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(createdUsersFile()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package setup
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRevertUsers(t *testing.T) {
+	calls, _ := useUserFiles(t, testPasswd+
+		"alice:x:2001:2001::/home/alice:/bin/bash\n"+
+		"bob:x:2002:2002::/home/bob:/bin/bash\n"+
+		"toor:x:0:0::/root:/bin/bash\n")
+	t.Setenv("SUDO_USER", "bob")
+	// ubuntu is declared but existed before; carol was created but is gone.
+	declareUsers(map[string]interface{}{"name": "ubuntu"}, map[string]interface{}{"name": "alice"})
+	saveCreatedUsers([]string{"alice", "bob", "carol", "toor"})
+	dropIn := filepath.Join(sudoersDir, "infra-agent-alice")
+	os.WriteFile(dropIn, []byte("alice ALL=(ALL) ALL\n"), 0440)
+
+	if err := revertUsers(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"userdel alice"}; !reflect.DeepEqual(*calls, want) {
+		t.Errorf("ran %q, want %q", *calls, want)
+	}
+	if _, err := os.Stat(dropIn); !os.IsNotExist(err) {
+		t.Errorf("sudoers drop-in left behind: %v", err)
+	}
+	if _, err := os.Stat(createdUsersFile()); !os.IsNotExist(err) {
+		t.Errorf("created-users.json left behind: %v", err)
+	}
+}
+
+func TestStripManagedKeys(t *testing.T) {
+	existing := "ssh-ed25519 AAAAown laptop\n" +
+		managedKeysBegin + "\nssh-ed25519 AAAAmanaged ops\n" + managedKeysEnd + "\n" +
+		"ssh-rsa AAAAother backup\n"
+	want := "ssh-ed25519 AAAAown laptop\nssh-rsa AAAAother backup\n"
+	if got := stripManagedKeys(existing); got != want {
+		t.Errorf("stripManagedKeys() = %q, want %q", got, want)
+	}
+
+	u := testUser(t)
+	if err := writeAuthorizedKeys(u, existing); err != nil {
+		t.Fatal(err)
+	}
+	c := clearManagedKeys(u)
+	if c == nil {
+		t.Fatal("clearManagedKeys() = nil for a file with a managed block")
+	}
+	if err := c.apply(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := readAuthorizedKeys(u); got != want {
+		t.Errorf("after revert = %q, want %q", got, want)
+	}
+	if c := clearManagedKeys(u); c != nil {
+		t.Errorf("clearManagedKeys() = %+v without a managed block", c)
+	}
+}
@@ -1,21 +1,311 @@
 package setup
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/uverustech/infra-agent/internal/config"
 )
 
+// runOptions are the setup command-line flags.
+type runOptions struct {
+	dryRun bool
+	output string
+	only   []string
+	skip   []string
+	resume bool
+	force  bool
+}
+
+func optionsFrom(cmd *cobra.Command) runOptions {
+	var o runOptions
+	o.dryRun, _ = cmd.Flags().GetBool("dry-run")
+	o.output, _ = cmd.Flags().GetString("output")
+	o.only, _ = cmd.Flags().GetStringSlice("only")
+	o.skip, _ = cmd.Flags().GetStringSlice("skip")
+	o.resume, _ = cmd.Flags().GetBool("resume")
+	o.force, _ = cmd.Flags().GetBool("force")
+	return o
+}
+
 func RunFullSetup(cmd *cobra.Command, args []string) error {
-	fmt.Println("=== Starting Full System Setup ===")
+	opts := optionsFrom(cmd)
+	nodeType := config.GetString(config.KeyNodeType)
+
+	for _, name := range append(append([]string{}, opts.only...), opts.skip...) {
+		if _, ok := FindStep(name); !ok {
+			return fmt.Errorf("unknown setup step %q", name)
+		}
+	}
+
+	steps, err := orderedSteps()
+	if err != nil {
+		return err
+	}
+	state := loadState()
+
+	// Progress goes to stderr when stdout carries the JSON plan.
+	out := os.Stdout
+	if opts.dryRun && opts.output == "json" {
+		out = os.Stderr
+	}
+
+	resumeFrom := ""
+	if opts.resume {
+		if state.FailedStep == "" {
+			fmt.Fprintln(out, "No failed setup run to resume")
+			return nil
+		}
+		resumeFrom = state.FailedStep
+		fmt.Fprintf(out, "Resuming setup from failed step %s\n", resumeFrom)
+	}
+
+	if !opts.dryRun {
+		fmt.Println("=== Starting Full System Setup ===")
+	}
+
+	satisfied := map[string]bool{}
+	plans := []*Plan{}
+	report := newReport()
+	skip := func(step Step, reason string, ok bool) {
+		fmt.Fprintf(out, "--- Step: %s (%s, skipping) ---\n", step.Name, reason)
+		report.add(StepReport{Name: step.Name, Status: StepSkipped, Reason: reason})
+		if ok {
+			satisfied[step.Name] = true
+		}
+	}
+
+	for _, step := range steps {
+		// Steps before the failed one are skipped only if they completed;
+		// one that was declined or never ran is handled as usual.
+		if resumeFrom != "" {
+			if step.Name != resumeFrom && state.succeeded(step.Name) && state.Steps[step.Name].LastError == "" {
+				skip(step, "completed before failure", true)
+				continue
+			}
+			if step.Name == resumeFrom {
+				resumeFrom = ""
+			}
+		}
+
+		switch {
+		case !step.appliesTo(nodeType):
+			skip(step, "not applicable to "+nodeType, true)
+			continue
+		case len(opts.only) > 0 && !containsString(opts.only, step.Name),
+			containsString(opts.skip, step.Name):
+			skip(step, "not selected", false)
+			continue
+		}
+		sum := inputChecksum(step)
+		if !opts.force && state.upToDate(step, sum) {
+			skip(step, "inputs unchanged since "+state.Steps[step.Name].LastSuccess.Format(time.RFC3339), true)
+			continue
+		}
+
+		if err := checkDependencies(step, state, satisfied); err != nil && !opts.force {
+			if !opts.dryRun {
+				report.add(StepReport{Name: step.Name, Status: StepFailed, Error: err.Error()})
+				report.finish(state)
+			}
+			return err
+		}
+
+		if opts.dryRun {
+			plan, err := step.Plan()
+			if err != nil {
+				return fmt.Errorf("step %s failed to plan: %w", step.Name, err)
+			}
+			plans = append(plans, plan)
+			satisfied[step.Name] = true
+			continue
+		}
 
-	for _, step := range Steps {
 		fmt.Printf("--- Step: %s ---\n", step.Name)
-		if err := step.Run(cmd, args); err != nil {
-			return fmt.Errorf("step %s failed: %w", step.Name, err)
+		stepReport, err := runStep(step)
+		report.add(stepReport)
+		if err != nil {
+			state.recordFailure(step, err)
+			if serr := state.save(); serr != nil {
+				fmt.Printf("Warning: failed to save setup state: %v\n", serr)
+			}
+			report.finish(state)
+			return fmt.Errorf("step %s failed: %w (continue with 'infra-agent setup --resume')", step.Name, err)
+		}
+		if stepReport.Status != StepDeclined {
+			state.recordSuccess(step, sum)
+			satisfied[step.Name] = true
+			if err := state.save(); err != nil {
+				fmt.Printf("Warning: failed to save setup state: %v\n", err)
+			}
 		}
 	}
 
-	fmt.Println("=== Setup Complete ===")
+	if opts.dryRun {
+		return printPlans(plans, opts.output)
+	}
+	report.finish(state)
+	fmt.Printf("=== Setup Complete (%s) ===\n", report.Status)
 	return nil
 }
+
+// checkDependencies requires each dependency to have succeeded, either
+// earlier in this run or in a previous one.
+func checkDependencies(step Step, state *SetupState, satisfied map[string]bool) error {
+	for _, dep := range step.DependsOn {
+		if satisfied[dep] {
+			continue
+		}
+		if st := state.Steps[dep]; st != nil && !st.LastSuccess.IsZero() {
+			continue
+		}
+		return fmt.Errorf("step %s requires step %s, which has not completed; run it first or use --force", step.Name, dep)
+	}
+	return nil
+}
+
+// StepCommand returns the cobra handler that runs a single step. An explicitly
+// requested step always runs, even if its inputs are unchanged.
+func StepCommand(step Step) func(cmd *cobra.Command, args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		opts := optionsFrom(cmd)
+		nodeType := config.GetString(config.KeyNodeType)
+
+		if !step.appliesTo(nodeType) && !opts.force {
+			return fmt.Errorf("step %s does not apply to node type %s (use --force to run anyway)", step.Name, nodeType)
+		}
+		state := loadState()
+		if err := checkDependencies(step, state, map[string]bool{}); err != nil && !opts.force {
+			return err
+		}
+
+		if opts.dryRun {
+			plan, err := step.Plan()
+			if err != nil {
+				return err
+			}
+			return printPlans([]*Plan{plan}, opts.output)
+		}
+
+		report := newReport()
+		sum := inputChecksum(step)
+		stepReport, err := runStep(step)
+		report.add(stepReport)
+		if err != nil {
+			state.recordFailure(step, err)
+		} else if stepReport.Status != StepDeclined {
+			state.recordSuccess(step, sum)
+		}
+		if serr := state.save(); serr != nil {
+			fmt.Printf("Warning: failed to save setup state: %v\n", serr)
+		}
+		report.finish(state)
+		return err
+	}
+}
+
+// runStep plans, confirms and applies a step, and reports what happened.
+// The returned error is the step's failure, also recorded in the report.
+func runStep(step Step) (StepReport, error) {
+	autoConfirm := config.GetBool(config.KeyAutoConfirm)
+	start := time.Now()
+	report := StepReport{Name: step.Name}
+
+	done := func(status string, err error) (StepReport, error) {
+		report.Status = status
+		report.DurationMS = time.Since(start).Milliseconds()
+		if err != nil {
+			report.Error = err.Error()
+		}
+		return report, err
+	}
+
+	plan, err := step.Plan()
+	if err != nil {
+		return done(StepFailed, err)
+	}
+	printPlan(plan)
+
+	status := StepApplied
+	if len(plan.Changes) == 0 {
+		// Nothing to confirm, but the step may still record state in finish.
+		status = StepUnchanged
+	} else if !confirmAction(fmt.Sprintf("Apply %d %s changes?", len(plan.Changes), step.Name), autoConfirm) {
+		fmt.Printf("Skipping %s\n", step.Name)
+		return done(StepDeclined, nil)
+	}
+
+	err = plan.Apply()
+	report.Changes = plan.applied
+	if err != nil {
+		return done(StepFailed, err)
+	}
+	return done(status, nil)
+}
+
+// Apply executes the plan's changes in order, stopping at the first failure.
+func (p *Plan) Apply() error {
+	if p.prepare != nil {
+		if err := p.prepare(); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	for _, c := range p.Changes {
+		if err = c.apply(); err != nil {
+			err = fmt.Errorf("%s: %w", c.Description, err)
+			break
+		}
+		fmt.Printf("Applied: %s\n", c.Description)
+		p.applied = append(p.applied, c.Description)
+	}
+
+	if p.finish != nil {
+		return p.finish(err)
+	}
+	return err
+}
+
+func printPlans(plans []*Plan, output string) error {
+	switch output {
+	case "json":
+		for _, p := range plans {
+			if p.Changes == nil {
+				p.Changes = []Change{}
+			}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plans)
+	case "", "text":
+		for _, p := range plans {
+			fmt.Printf("--- Step: %s ---\n", p.Step)
+			printPlan(p)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown output format %q (expected text or json)", output)
+	}
+}
+
+func printPlan(p *Plan) {
+	if len(p.Changes) == 0 {
+		fmt.Println("No changes needed")
+	}
+	for _, c := range p.Changes {
+		fmt.Printf("  [%s] %s\n", c.Kind, c.Description)
+		if c.Diff != "" {
+			for _, line := range strings.Split(strings.TrimRight(c.Diff, "\n"), "\n") {
+				fmt.Printf("      %s\n", line)
+			}
+		}
+	}
+	for _, n := range p.Notes {
+		fmt.Printf("  note: %s\n", n)
+	}
+}
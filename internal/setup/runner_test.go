@@ -0,0 +1,389 @@
+package setup
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+// testRun replaces Steps with stubs whose single change records the step
+// name, and keeps the setup state and report in a temp dir.
+type testRun struct {
+	ran     []string
+	fail    map[string]bool
+	fetched string
+}
+
+func useTestSteps(t *testing.T) *testRun {
+	t.Helper()
+	dir := t.TempDir()
+	savedSteps, savedState, savedReport, savedVersion := Steps, stateFile, reportFile, AgentVersion
+	t.Cleanup(func() {
+		Steps, stateFile, reportFile, AgentVersion = savedSteps, savedState, savedReport, savedVersion
+		viper.Reset()
+	})
+	stateFile = filepath.Join(dir, "setup-state.json")
+	reportFile = filepath.Join(dir, "setup-report.json")
+	AgentVersion = "1.0.0"
+	viper.Set(config.KeyAutoConfirm, true)
+	viper.Set(config.KeyNodeType, "gateway")
+
+	r := &testRun{fail: map[string]bool{}, fetched: "v1"}
+	step := func(name string, deps []string, nodeTypes []string) Step {
+		return Step{
+			Name:      name,
+			DependsOn: deps,
+			NodeTypes: nodeTypes,
+			Inputs:    []string{config.KeyTimezone},
+			Plan: func() (*Plan, error) {
+				plan := &Plan{Step: name}
+				plan.add(&Change{Kind: ChangeCommand, Target: name, Description: "run " + name, apply: func() error {
+					r.ran = append(r.ran, name)
+					if r.fail[name] {
+						return errors.New("boom")
+					}
+					return nil
+				}})
+				return plan, nil
+			},
+		}
+	}
+	// Declared out of order: c needs b, which needs a.
+	Steps = []Step{
+		step("c", []string{"b"}, []string{"gateway"}),
+		step("d", nil, []string{"server"}),
+		step("a", nil, nil),
+		step("b", []string{"a"}, nil),
+	}
+	Steps[2].Fetch = func() ([]byte, error) {
+		if r.fetched == "" {
+			return nil, errors.New("unreachable")
+		}
+		return []byte(r.fetched), nil
+	}
+	return r
+}
+
+func runSetup(t *testing.T, args ...string) error {
+	t.Helper()
+	cmd := &cobra.Command{}
+	cmd.Flags().Bool("dry-run", false, "")
+	cmd.Flags().String("output", "text", "")
+	cmd.Flags().Bool("force", false, "")
+	cmd.Flags().StringSlice("only", nil, "")
+	cmd.Flags().StringSlice("skip", nil, "")
+	cmd.Flags().Bool("resume", false, "")
+	if err := cmd.Flags().Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return RunFullSetup(cmd, nil)
+}
+
+func TestOrderedSteps(t *testing.T) {
+	useTestSteps(t)
+	steps, err := orderedSteps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, s := range steps {
+		names = append(names, s.Name)
+	}
+	if want := []string{"a", "b", "c", "d"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("order = %q, want %q", names, want)
+	}
+
+	Steps[2].DependsOn = []string{"c"}
+	if _, err := orderedSteps(); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("cycle: error = %v", err)
+	}
+	Steps[2].DependsOn = []string{"nope"}
+	if _, err := orderedSteps(); err == nil || !strings.Contains(err.Error(), "unknown step nope") {
+		t.Errorf("unknown dependency: error = %v", err)
+	}
+}
+
+func TestOrderedStepsBuiltin(t *testing.T) {
+	steps, err := orderedSteps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := map[string]int{}
+	for i, s := range steps {
+		pos[s.Name] = i
+	}
+	for _, s := range Steps {
+		for _, dep := range s.DependsOn {
+			if pos[dep] > pos[s.Name] {
+				t.Errorf("%s runs before its dependency %s", s.Name, dep)
+			}
+		}
+	}
+	caddy, _ := FindStep("caddy")
+	if !caddy.appliesTo("gateway") || caddy.appliesTo("server") {
+		t.Error("the caddy step must run on gateways only")
+	}
+}
+
+func TestStepAppliesTo(t *testing.T) {
+	tests := []struct {
+		nodeTypes []string
+		nodeType  string
+		want      bool
+	}{
+		{nil, "server", true},
+		{[]string{"gateway"}, "gateway", true},
+		{[]string{"server"}, "server:build", true},
+		{[]string{"server:build"}, "server", false},
+		{[]string{"server"}, "serverless", false},
+		{[]string{"gateway", "service"}, "service:db", true},
+	}
+	for _, tt := range tests {
+		if got := (Step{NodeTypes: tt.nodeTypes}).appliesTo(tt.nodeType); got != tt.want {
+			t.Errorf("%q appliesTo(%s) = %v, want %v", tt.nodeTypes, tt.nodeType, got, tt.want)
+		}
+	}
+}
+
+func TestRunFullSetupSelection(t *testing.T) {
+	tests := []struct {
+		nodeType string
+		args     []string
+		ran      []string
+		error    string
+	}{
+		{"gateway", nil, []string{"a", "b", "c"}, ""},
+		{"server", nil, []string{"a", "b", "d"}, ""},
+		{"server:build", nil, []string{"a", "b", "d"}, ""},
+		{"gateway", []string{"--only", "a,b"}, []string{"a", "b"}, ""},
+		{"gateway", []string{"--skip", "c"}, []string{"a", "b"}, ""},
+		// b needs a, which is neither selected nor completed before.
+		{"gateway", []string{"--only", "b"}, nil, "requires step a"},
+		{"gateway", []string{"--skip", "a"}, nil, "requires step a"},
+		{"gateway", []string{"--skip", "a", "--force"}, []string{"b", "c"}, ""},
+		{"gateway", []string{"--only", "x"}, nil, `unknown setup step "x"`},
+	}
+	for _, tt := range tests {
+		r := useTestSteps(t)
+		viper.Set(config.KeyNodeType, tt.nodeType)
+		err := runSetup(t, tt.args...)
+		if tt.error == "" && err != nil {
+			t.Errorf("%s %q: %v", tt.nodeType, tt.args, err)
+		} else if tt.error != "" && (err == nil || !strings.Contains(err.Error(), tt.error)) {
+			t.Errorf("%s %q: error = %v, want %q", tt.nodeType, tt.args, err, tt.error)
+		}
+		if !reflect.DeepEqual(r.ran, tt.ran) {
+			t.Errorf("%s %q: ran %q, want %q", tt.nodeType, tt.args, r.ran, tt.ran)
+		}
+	}
+}
+
+// A step completed in an earlier run satisfies its dependents.
+func TestRunFullSetupDependencyFromState(t *testing.T) {
+	r := useTestSteps(t)
+	if err := runSetup(t, "--only", "a"); err != nil {
+		t.Fatal(err)
+	}
+	r.ran = nil
+	if err := runSetup(t, "--only", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b"}; !reflect.DeepEqual(r.ran, want) {
+		t.Errorf("ran %q, want %q", r.ran, want)
+	}
+}
+
+func TestRunFullSetupResume(t *testing.T) {
+	r := useTestSteps(t)
+	if err := runSetup(t, "--resume"); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.ran) != 0 {
+		t.Errorf("--resume without a failed run ran %q", r.ran)
+	}
+
+	r.fail["b"] = true
+	if err := runSetup(t); err == nil || !strings.Contains(err.Error(), "setup --resume") {
+		t.Fatalf("error = %v, want the failure of b", err)
+	}
+	if st := loadState(); st.FailedStep != "b" || st.Steps["b"].LastError == "" {
+		t.Errorf("state after the failure = %+v", st)
+	}
+
+	r.ran, r.fail["b"] = nil, false
+	// Changed inputs would normally rerun a; resume still skips it.
+	viper.Set(config.KeyTimezone, "Europe/Berlin")
+	if err := runSetup(t, "--resume"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b", "c"}; !reflect.DeepEqual(r.ran, want) {
+		t.Errorf("resume ran %q, want %q", r.ran, want)
+	}
+	if st := loadState(); st.FailedStep != "" {
+		t.Errorf("failed step after resuming = %q", st.FailedStep)
+	}
+}
+
+func TestRunFullSetupSkipsUnchanged(t *testing.T) {
+	r := useTestSteps(t)
+	if err := runSetup(t); err != nil {
+		t.Fatal(err)
+	}
+
+	r.ran = nil
+	if err := runSetup(t); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.ran) != 0 {
+		t.Errorf("unchanged inputs reran %q", r.ran)
+	}
+
+	// a fetches content: a change or a failed fetch reruns it.
+	r.fetched = "v2"
+	if err := runSetup(t); err != nil {
+		t.Fatal(err)
+	}
+	r.fetched = ""
+	if err := runSetup(t); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "a"}; !reflect.DeepEqual(r.ran, want) {
+		t.Errorf("after fetch changes ran %q, want %q", r.ran, want)
+	}
+
+	r.ran, r.fetched = nil, "v2"
+	AgentVersion = "1.1.0"
+	if err := runSetup(t); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(r.ran, want) {
+		t.Errorf("after an upgrade ran %q, want %q", r.ran, want)
+	}
+
+	r.ran = nil
+	if err := runSetup(t, "--force", "--only", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"c"}; !reflect.DeepEqual(r.ran, want) {
+		t.Errorf("--force ran %q, want %q", r.ran, want)
+	}
+}
+
+func TestInputChecksum(t *testing.T) {
+	r := useTestSteps(t)
+	a, _ := FindStep("a")
+	viper.Set(config.KeyTimezone, "UTC")
+	base := inputChecksum(a)
+	if base == "" || inputChecksum(a) != base {
+		t.Fatalf("checksum is not stable: %q", base)
+	}
+
+	viper.Set(config.KeyTimezone, "Europe/Berlin")
+	if inputChecksum(a) == base {
+		t.Error("a changed input key did not change the checksum")
+	}
+	viper.Set(config.KeyTimezone, "UTC")
+	r.fetched = "v2"
+	if inputChecksum(a) == base {
+		t.Error("changed fetched content did not change the checksum")
+	}
+	r.fetched = ""
+	if got := inputChecksum(a); got != "" {
+		t.Errorf("checksum with a failed fetch = %q, want none", got)
+	}
+	// An unrelated key is not an input.
+	r.fetched = "v1"
+	viper.Set(config.KeyRegion, "eu")
+	if inputChecksum(a) != base {
+		t.Error("a key the step does not read changed the checksum")
+	}
+}
+
+// captureStdout returns what fn prints to stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	done := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- string(data)
+	}()
+	defer func() { os.Stdout = saved }()
+	fn()
+	w.Close()
+	return <-done
+}
+
+func TestRunFullSetupDryRun(t *testing.T) {
+	r := useTestSteps(t)
+
+	var err error
+	out := captureStdout(t, func() { err = runSetup(t, "--dry-run", "--output", "json") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plans []struct {
+		Step    string
+		Changes []Change
+	}
+	if err := json.Unmarshal([]byte(out), &plans); err != nil {
+		t.Fatalf("stdout is not a JSON plan: %v\n%s", err, out)
+	}
+	var steps []string
+	for _, p := range plans {
+		steps = append(steps, p.Step)
+		if len(p.Changes) != 1 || p.Changes[0].Kind != ChangeCommand || p.Changes[0].Description != "run "+p.Step {
+			t.Errorf("plan of %s = %+v", p.Step, p.Changes)
+		}
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(steps, want) {
+		t.Errorf("planned %q, want %q", steps, want)
+	}
+	if len(r.ran) != 0 {
+		t.Errorf("dry run applied %q", r.ran)
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Errorf("dry run wrote the setup state: %v", err)
+	}
+
+	out = captureStdout(t, func() { err = runSetup(t, "--dry-run", "--only", "a") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "--- Step: a ---\n  [command] run a\n") || strings.Contains(out, "Step: b ---\n") {
+		t.Errorf("text plan:\n%s", out)
+	}
+
+	if err := runSetup(t, "--dry-run", "--output", "yaml"); err == nil || !strings.Contains(err.Error(), "unknown output format") {
+		t.Errorf("--output yaml: %v", err)
+	}
+}
+
+func TestPrintPlan(t *testing.T) {
+	plan := &Plan{Step: "x", Notes: []string{"apt-get update runs first"}}
+	plan.add(&Change{Kind: ChangeFile, Description: "update /etc/x", Diff: "--- /etc/x\n+++ /etc/x\n-a\n+b\n"})
+	out := captureStdout(t, func() { printPlan(plan) })
+	want := "  [file] update /etc/x\n      --- /etc/x\n      +++ /etc/x\n      -a\n      +b\n  note: apt-get update runs first\n"
+	if out != want {
+		t.Errorf("printPlan:\n%s\nwant:\n%s", out, want)
+	}
+
+	out = captureStdout(t, func() { printPlans([]*Plan{{Step: "y"}}, "json") })
+	if !strings.Contains(out, `"changes": []`) {
+		t.Errorf("a plan without changes prints %s", out)
+	}
+}
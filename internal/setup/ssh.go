@@ -1,79 +1,344 @@
 package setup
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"os/user"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 	"github.com/uverustech/infra-agent/internal/config"
 )
 
-func RunSSH(cmd *cobra.Command, args []string) error {
-	githubToken := viper.GetString(config.KeyGithubToken)
-	sshKeyURL := viper.GetString(config.KeySSHKeyURL)
-	autoConfirm := viper.GetBool(config.KeyAutoConfirm)
+// PlanSSH reconciles the managed block of each declared user's
+// authorized_keys with the keys from that user's sources. Keys outside the
+// block are left alone. A user declared with no sources, or no longer
+// declared at all, has the managed block removed.
+func PlanSSH() (*Plan, error) {
+	plan := &Plan{Step: "ssh"}
 
-	if githubToken == "" {
-		return fmt.Errorf("GitHub token is required for SSH setup. Set --github-token or GITHUB_TOKEN env var")
+	declared, err := declaredSSHKeys()
+	if err != nil {
+		return nil, err
 	}
+	managed := loadManagedSSHUsers()
 
-	fmt.Printf("Fetching SSH public key from: %s\n", sshKeyURL)
-	pubKey, err := fetchGithubFile(sshKeyURL, githubToken)
-	if err != nil {
-		return fmt.Errorf("failed to fetch SSH key: %w", err)
+	users := make([]string, 0, len(declared))
+	for name := range declared {
+		users = append(users, name)
 	}
-	pubKey = strings.TrimSpace(pubKey)
+	sort.Strings(users)
 
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		return fmt.Errorf("could not determine home directory: %w", err)
+	var names []string
+	for _, name := range users {
+		// Resolve every source before touching anything: a source that fails
+		// to fetch must not be mistaken for a revocation.
+		keys, err := resolveUserKeys(declared[name])
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %w", name, err)
+		}
+		if len(keys) == 0 && len(declared[name]) > 0 {
+			return nil, fmt.Errorf("user %s: no keys resolved from %d sources, refusing to empty the managed block (declare an empty list to revoke every key)", name, len(declared[name]))
+		}
+
+		u, err := user.Lookup(name)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %w", name, err)
+		}
+		if len(keys) == 0 {
+			plan.add(clearManagedKeys(u))
+			continue
+		}
+		names = append(names, name)
+
+		authKeysFile := filepath.Join(u.HomeDir, ".ssh", "authorized_keys")
+		existing, err := readAuthorizedKeys(u)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %w", name, err)
+		}
+		c := authorizedKeysChange(u, existing, renderAuthorizedKeys(existing, keys))
+		if c == nil {
+			plan.note("%s: %d managed keys up to date", authKeysFile, len(keys))
+			continue
+		}
+		plan.add(c)
 	}
 
-	sshDir := filepath.Join(homeDir, ".ssh")
-	authKeysFile := filepath.Join(sshDir, "authorized_keys")
+	// Users dropped from ssh-keys lose the keys the agent gave them.
+	for _, name := range managed {
+		if _, ok := declared[name]; ok {
+			continue
+		}
+		if u, err := user.Lookup(name); err == nil {
+			plan.add(clearManagedKeys(u))
+		}
+	}
 
-	if _, err := os.Stat(sshDir); os.IsNotExist(err) {
-		if confirmAction(fmt.Sprintf("Create directory %s?", sshDir), autoConfirm) {
-			if err := os.MkdirAll(sshDir, 0700); err != nil {
-				return fmt.Errorf("failed to create %s: %w", sshDir, err)
+	if len(plan.Changes) > 0 || !equalStrings(names, managed) {
+		plan.finish = func(err error) error {
+			if err != nil {
+				return err
 			}
-			fmt.Printf("Created %s\n", sshDir)
-		} else {
-			fmt.Println("Skipping SSH key installation")
-			return nil
+			return saveManagedSSHUsers(names)
 		}
 	}
+	return plan, nil
+}
 
-	content, _ := os.ReadFile(authKeysFile)
-	if strings.Contains(string(content), pubKey) {
-		fmt.Println("SSH key already exists in authorized_keys. Skipping")
-		return nil
+// resolveUserKeys returns the keys from all of a user's sources, without
+// duplicates.
+func resolveUserKeys(sources []string) ([]string, error) {
+	var keys []string
+	seen := map[string]bool{}
+	for _, source := range sources {
+		resolved, err := resolveKeySource(source)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range resolved {
+			if m := keyMaterial(k); !seen[m] {
+				seen[m] = true
+				keys = append(keys, k)
+			}
+		}
 	}
+	return keys, nil
+}
 
-	if confirmAction(fmt.Sprintf("Add SSH key to %s?", authKeysFile), autoConfirm) {
-		f, err := os.OpenFile(authKeysFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
-		if err != nil {
-			return fmt.Errorf("failed to open %s: %w", authKeysFile, err)
+// fetchSSHKeys returns every declared user's resolved keys for the input
+// checksum.
+func fetchSSHKeys() ([]byte, error) {
+	declared, err := declaredSSHKeys()
+	if err != nil {
+		return nil, err
+	}
+	resolved := make(map[string][]string, len(declared))
+	for name, sources := range declared {
+		if resolved[name], err = resolveUserKeys(sources); err != nil {
+			return nil, err
 		}
-		defer f.Close()
+	}
+	return json.Marshal(resolved)
+}
+
+// authorizedKeysChange returns a change that writes content to u's
+// authorized_keys, or nil if existing already is content. The diff is made
+// from existing, which readAuthorizedKeys has read safely, not from whatever
+// the path resolves to.
+func authorizedKeysChange(u *user.User, existing, content string) *Change {
+	if existing == content {
+		return nil
+	}
+	path := filepath.Join(u.HomeDir, ".ssh", "authorized_keys")
+	verb := "update"
+	if existing == "" {
+		verb = "create"
+	}
+	return &Change{
+		Kind:        ChangeFile,
+		Target:      path,
+		Description: fmt.Sprintf("%s %s", verb, path),
+		Diff:        unifiedDiff(path, existing, content),
+		apply: func() error {
+			return writeAuthorizedKeys(u, content)
+		},
+	}
+}
+
+// clearManagedKeys returns a change that removes the managed block from u's
+// authorized_keys, or nil if there is none.
+func clearManagedKeys(u *user.User) *Change {
+	existing, err := readAuthorizedKeys(u)
+	if err != nil || !strings.Contains(existing, managedKeysBegin) {
+		return nil
+	}
+	c := authorizedKeysChange(u, existing, stripManagedKeys(existing))
+	if c != nil {
+		c.Description = fmt.Sprintf("remove the managed keys of %s from %s", u.Username, c.Target)
+	}
+	return c
+}
+
+// The agent edits authorized_keys as root in a directory the user controls.
+// A user could point ~/.ssh or authorized_keys at a file only root can read,
+// e.g. /etc/shadow, to have root merge it into a keys file and hand that
+// file over to them. Every access therefore goes through a descriptor for
+// ~/.ssh opened without following symlinks, and the keys file is opened
+// relative to it, also without following symlinks.
+
+// openSSHDir opens u's ~/.ssh, refusing a symlink or anything that is not a
+// directory. It returns nil and no error if the directory does not exist.
+func openSSHDir(u *user.User) (*os.File, error) {
+	path := filepath.Join(u.HomeDir, ".ssh")
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	switch {
+	case err == syscall.ENOENT:
+		return nil, nil
+	case err == syscall.ELOOP || err == syscall.ENOTDIR:
+		return nil, fmt.Errorf("%s is a symlink or not a directory, refusing to manage its keys", path)
+	case err != nil:
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// readAuthorizedKeys returns the content of u's authorized_keys, or "" if it
+// does not exist. Symlinks, special files, files owned by another user and
+// files with more than one link (a hard link to a root-only file) are
+// refused.
+func readAuthorizedKeys(u *user.User) (string, error) {
+	dir, err := openSSHDir(u)
+	if err != nil || dir == nil {
+		return "", err
+	}
+	defer dir.Close()
+
+	path := filepath.Join(dir.Name(), "authorized_keys")
+	fd, err := syscall.Openat(int(dir.Fd()), "authorized_keys", syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	switch {
+	case err == syscall.ENOENT:
+		return "", nil
+	case err == syscall.ELOOP:
+		return "", fmt.Errorf("%s is a symlink, refusing to manage it", path)
+	case err != nil:
+		return "", &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	f := os.NewFile(uintptr(fd), path)
+	defer f.Close()
+
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return "", &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	switch {
+	case st.Mode&syscall.S_IFMT != syscall.S_IFREG:
+		return "", fmt.Errorf("%s is not a regular file, refusing to manage it", path)
+	case st.Nlink != 1:
+		return "", fmt.Errorf("%s has %d links, refusing to manage it", path, st.Nlink)
+	case int(st.Uid) != uid && st.Uid != 0:
+		return "", fmt.Errorf("%s is owned by uid %d, not %s, refusing to manage it", path, st.Uid, u.Username)
+	}
+	data, err := io.ReadAll(f)
+	return string(data), err
+}
+
+// writeAuthorizedKeys replaces u's authorized_keys with content. The new file
+// is created in ~/.ssh, given to u and synced before it is renamed over the
+// old one, so it never exists as a root-owned file at the final path. sshd
+// ignores keys files that are not owned by the user. ~/.ssh is created if
+// missing.
+func writeAuthorizedKeys(u *user.User, content string) error {
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
 
-		if _, err := f.WriteString("\n" + pubKey + "\n"); err != nil {
-			return fmt.Errorf("failed to write to %s: %w", authKeysFile, err)
+	path := filepath.Join(u.HomeDir, ".ssh")
+	err := os.Mkdir(path, 0700)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	created := err == nil
+	dir, err := openSSHDir(u)
+	if err != nil {
+		return err
+	}
+	if dir == nil {
+		return fmt.Errorf("%s disappeared while writing keys", path)
+	}
+	defer dir.Close()
+	if created {
+		if err := dir.Chown(uid, gid); err != nil {
+			return err
 		}
-		fmt.Printf("Successfully added SSH key to %s\n", authKeysFile)
-	} else {
-		fmt.Println("Skipping SSH key installation")
 	}
 
+	dirfd := int(dir.Fd())
+	tmpName := fmt.Sprintf(".authorized_keys-%d-%d", os.Getpid(), time.Now().UnixNano())
+	fd, err := syscall.Openat(dirfd, tmpName, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0600)
+	if err != nil {
+		return &os.PathError{Op: "create", Path: filepath.Join(path, tmpName), Err: err}
+	}
+	tmp := os.NewFile(uintptr(fd), filepath.Join(path, tmpName))
+	defer syscall.Unlinkat(dirfd, tmpName)
+
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chown(uid, gid); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := syscall.Renameat(dirfd, tmpName, dirfd, "authorized_keys"); err != nil {
+		return &os.PathError{Op: "rename", Path: filepath.Join(path, "authorized_keys"), Err: err}
+	}
 	return nil
 }
 
+func managedSSHUsersFile() string {
+	return filepath.Join(config.GetString(config.KeyStateDir), "ssh-keys.json")
+}
+
+// loadManagedSSHUsers returns the users whose authorized_keys got a managed
+// block on the previous run.
+func loadManagedSSHUsers() []string {
+	data, err := os.ReadFile(managedSSHUsersFile())
+	if err != nil {
+		return nil
+	}
+	var names []string
+	json.Unmarshal(data, &names)
+	return names
+}
+
+func saveManagedSSHUsers(names []string) error {
+	data, _ := json.Marshal(names)
+	if err := os.MkdirAll(filepath.Dir(managedSSHUsersFile()), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(managedSSHUsersFile(), data, 0644)
+}
+
+// ReconcileSSHKeys applies the ssh step without prompting. The agent calls it
+// periodically so that key revocations propagate to every node.
+func ReconcileSSHKeys() ([]string, error) {
+	plan, err := PlanSSH()
+	if errors.Is(err, errNoSSHKeys) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(plan.Changes) == 0 && plan.finish == nil {
+		return nil, nil
+	}
+	err = plan.Apply()
+	return plan.applied, err
+}
+
+func currentUserName() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("could not determine current user: %w", err)
+	}
+	return u.Username, nil
+}
+
 func fetchGithubFile(urlStr, token string) (string, error) {
 	trimmed := strings.TrimPrefix(urlStr, "https://github.com/")
 	parts := strings.Split(trimmed, "/")
@@ -95,7 +360,7 @@ func fetchGithubFile(urlStr, token string) (string, error) {
 	req.Header.Set("Accept", "application/vnd.github.raw+json")
 	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
 
-	client := &http.Client{Timeout: 10 * time.Second}
+	client := &http.Client{Timeout: config.GetDuration(config.KeyTimeoutHTTP)}
 	resp, err := client.Do(req)
 	if err != nil {
 		return "", err
@@ -0,0 +1,140 @@
+package setup
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// testUser returns the current user with its home directory moved to a temp
+// dir, so the keys file code can run without root.
+func testUser(t *testing.T) *user.User {
+	t.Helper()
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	home := *u
+	home.HomeDir = t.TempDir()
+	return &home
+}
+
+func TestAuthorizedKeysRefusesLinks(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "shadow")
+	if err := os.WriteFile(secret, []byte("root:$6$secret:19000:0:99999:7:::\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, sshDir string)
+		want  string
+	}{
+		{"symlinked keys file", func(t *testing.T, sshDir string) {
+			os.Mkdir(sshDir, 0700)
+			if err := os.Symlink(secret, filepath.Join(sshDir, "authorized_keys")); err != nil {
+				t.Fatal(err)
+			}
+		}, "is a symlink"},
+		{"symlinked .ssh", func(t *testing.T, sshDir string) {
+			target := t.TempDir()
+			os.WriteFile(filepath.Join(target, "authorized_keys"), []byte("ssh-ed25519 AAAA other\n"), 0600)
+			if err := os.Symlink(target, sshDir); err != nil {
+				t.Fatal(err)
+			}
+		}, "is a symlink or not a directory"},
+		{"hard-linked keys file", func(t *testing.T, sshDir string) {
+			os.Mkdir(sshDir, 0700)
+			if err := os.Link(secret, filepath.Join(sshDir, "authorized_keys")); err != nil {
+				t.Skip("cannot hard link across temp dirs:", err)
+			}
+		}, "has 2 links"},
+		{"fifo", func(t *testing.T, sshDir string) {
+			os.Mkdir(sshDir, 0700)
+			if err := syscall.Mkfifo(filepath.Join(sshDir, "authorized_keys"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}, "not a regular file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := testUser(t)
+			tt.setup(t, filepath.Join(u.HomeDir, ".ssh"))
+
+			if _, err := readAuthorizedKeys(u); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("readAuthorizedKeys() error = %v, want %q", err, tt.want)
+			}
+			if c := clearManagedKeys(u); c != nil {
+				t.Errorf("clearManagedKeys() = %+v, want nil", c)
+			}
+			if data, _ := os.ReadFile(secret); !strings.HasPrefix(string(data), "root:") {
+				t.Errorf("link target changed: %q", data)
+			}
+		})
+	}
+}
+
+func TestWriteAuthorizedKeys(t *testing.T) {
+	u := testUser(t)
+	content := managedKeysBegin + "\nssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIA ops\n" + managedKeysEnd + "\n"
+
+	// ~/.ssh is created on the first write.
+	if err := writeAuthorizedKeys(u, content); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readAuthorizedKeys(u)
+	if err != nil || got != content {
+		t.Fatalf("readAuthorizedKeys() = %q, %v", got, err)
+	}
+
+	sshDir := filepath.Join(u.HomeDir, ".ssh")
+	for path, mode := range map[string]os.FileMode{sshDir: 0700, filepath.Join(sshDir, "authorized_keys"): 0600} {
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("%s mode = %v, want %v", path, info.Mode().Perm(), mode)
+		}
+		if uid := info.Sys().(*syscall.Stat_t).Uid; strconv.Itoa(int(uid)) != u.Uid {
+			t.Errorf("%s owned by %d, want %s", path, uid, u.Uid)
+		}
+	}
+
+	// A symlink planted at the keys file is replaced, not written through.
+	target := filepath.Join(t.TempDir(), "target")
+	os.WriteFile(target, []byte("untouched\n"), 0600)
+	keysFile := filepath.Join(sshDir, "authorized_keys")
+	os.Remove(keysFile)
+	if err := os.Symlink(target, keysFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeAuthorizedKeys(u, content); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(target); string(data) != "untouched\n" {
+		t.Errorf("write followed the symlink: target = %q", data)
+	}
+	if info, _ := os.Lstat(keysFile); info.Mode()&os.ModeSymlink != 0 {
+		t.Error("keys file is still a symlink")
+	}
+
+	// No temp files are left behind.
+	entries, _ := os.ReadDir(sshDir)
+	if len(entries) != 1 {
+		t.Errorf("~/.ssh holds %d entries, want only authorized_keys", len(entries))
+	}
+
+	// A symlinked ~/.ssh is refused.
+	os.RemoveAll(sshDir)
+	if err := os.Symlink(t.TempDir(), sshDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeAuthorizedKeys(u, content); err == nil {
+		t.Error("wrote through a symlinked ~/.ssh")
+	}
+}
@@ -0,0 +1,219 @@
+package setup
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+// The files the ssh-ca step writes. They are variables so tests can point
+// them at a temporary directory.
+var (
+	sshCADropIn      = "/etc/ssh/sshd_config.d/40-infra-agent-ca.conf"
+	sshCAKeysFile    = "/etc/ssh/infra-agent-user-ca.pub"
+	sshPrincipalsDir = "/etc/ssh/auth_principals"
+)
+
+// PlanSSHCA plans trusting the operator CA in sshd and writing one
+// AuthorizedPrincipalsFile per declared local user. sshd is validated with
+// sshd -t before it is reloaded; if validation fails every file the plan
+// wrote is put back.
+func PlanSSHCA() (*Plan, error) {
+	plan := &Plan{Step: "ssh-ca"}
+
+	source := config.GetString(config.KeySSHCAKeyURL)
+	if source == "" {
+		plan.note("ssh-ca-key-url is not set, certificate authentication stays disabled")
+		return plan, nil
+	}
+	// The CA file may hold several keys so a new CA can be rolled out next
+	// to the old one.
+	caKeys, err := resolveKeySource(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch SSH CA key: %w", err)
+	}
+	if len(caKeys) == 0 {
+		return nil, fmt.Errorf("no CA keys found at %s", source)
+	}
+
+	var changes []*Change
+	changes = append(changes, fileChange(sshCAKeysFile, []byte(strings.Join(caKeys, "\n")+"\n"), 0644))
+
+	principals := desiredPrincipals()
+	users := make([]string, 0, len(principals))
+	for name := range principals {
+		users = append(users, name)
+	}
+	sort.Strings(users)
+	if len(users) == 0 {
+		plan.note("ssh-principals is empty, no certificate will grant access")
+	}
+	for _, name := range users {
+		path := filepath.Join(sshPrincipalsDir, name)
+		changes = append(changes, fileChange(path, []byte(strings.Join(principals[name], "\n")+"\n"), 0644))
+	}
+
+	// Files of users no longer declared are removed, revoking their access.
+	entries, _ := os.ReadDir(sshPrincipalsDir)
+	for _, e := range entries {
+		if _, ok := principals[e.Name()]; ok || e.IsDir() {
+			continue
+		}
+		path := filepath.Join(sshPrincipalsDir, e.Name())
+		changes = append(changes, &Change{
+			Kind:        ChangeFile,
+			Target:      path,
+			Description: fmt.Sprintf("remove %s", path),
+			apply: func() error {
+				return os.Remove(path)
+			},
+		})
+	}
+
+	changes = append(changes, fileChange(sshCADropIn, []byte(renderSSHCAConfig()), 0644))
+
+	var touched []string
+	for _, c := range changes {
+		if c != nil {
+			touched = append(touched, c.Target)
+			plan.add(c)
+		}
+	}
+	if len(plan.Changes) == 0 {
+		return plan, nil
+	}
+
+	snapshot := map[string][]byte{}
+	plan.prepare = func() error {
+		for _, path := range touched {
+			if data, err := os.ReadFile(path); err == nil {
+				snapshot[path] = data
+			}
+		}
+		return os.MkdirAll(sshPrincipalsDir, 0755)
+	}
+	plan.finish = func(err error) error {
+		if err == nil {
+			err = validateAndReloadSSHD()
+		}
+		if err != nil {
+			if rerr := restoreSnapshot(touched, snapshot); rerr != nil {
+				return fmt.Errorf("%w (restore failed: %v)", err, rerr)
+			}
+		}
+		return err
+	}
+	return plan, nil
+}
+
+// ReconcileSSHCA applies the ssh-ca step without prompting, so CA rotation and
+// principal changes reach every node without a setup run.
+func ReconcileSSHCA() ([]string, error) {
+	plan, err := PlanSSHCA()
+	if err != nil {
+		return nil, err
+	}
+	if len(plan.Changes) == 0 {
+		return nil, nil
+	}
+	err = plan.Apply()
+	return plan.applied, err
+}
+
+// fetchSSHCAKeys returns the CA keys from ssh-ca-key-url for the input
+// checksum.
+func fetchSSHCAKeys() ([]byte, error) {
+	source := config.GetString(config.KeySSHCAKeyURL)
+	if source == "" {
+		return nil, nil
+	}
+	keys, err := resolveKeySource(source)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.Join(keys, "\n")), nil
+}
+
+func renderSSHCAConfig() string {
+	var buf bytes.Buffer
+	buf.WriteString("# Managed by infra-agent. Do not edit.\n")
+	fmt.Fprintf(&buf, "TrustedUserCAKeys %s\n", sshCAKeysFile)
+	fmt.Fprintf(&buf, "AuthorizedPrincipalsFile %s/%%u\n", sshPrincipalsDir)
+	return buf.String()
+}
+
+// desiredPrincipals expands ssh-principals for this node. Entries may use
+// {node-id}, {node-type}, {region} and {label:<name>}; an entry that refers to
+// an empty value is dropped rather than granting a malformed principal.
+func desiredPrincipals() map[string][]string {
+	vars := map[string]string{
+		"node-id":   config.GetString(config.KeyNodeID),
+		"node-type": config.GetString(config.KeyNodeType),
+		"region":    config.GetString(config.KeyRegion),
+	}
+	for k, v := range config.GetStringMapString(config.KeyLabels) {
+		vars["label:"+k] = v
+	}
+
+	out := map[string][]string{}
+	for name, entries := range config.GetStringMapStringSlice(config.KeySSHPrincipals) {
+		var list []string
+		for _, entry := range entries {
+			if p, ok := expandPrincipal(entry, vars); ok && !containsString(list, p) {
+				list = append(list, p)
+			}
+		}
+		if len(list) > 0 {
+			out[name] = list
+		}
+	}
+	return out
+}
+
+func expandPrincipal(entry string, vars map[string]string) (string, bool) {
+	var out strings.Builder
+	for {
+		start := strings.Index(entry, "{")
+		if start < 0 {
+			out.WriteString(entry)
+			break
+		}
+		end := strings.Index(entry[start:], "}")
+		if end < 0 {
+			return "", false
+		}
+		value := vars[entry[start+1:start+end]]
+		if value == "" {
+			return "", false
+		}
+		out.WriteString(entry[:start])
+		out.WriteString(value)
+		entry = entry[start+end+1:]
+	}
+	p := strings.TrimSpace(out.String())
+	// Principals are comma-separated in certificates.
+	return p, p != "" && !strings.ContainsAny(p, ", \t")
+}
+
+// restoreSnapshot puts back the given files as they were before a plan ran,
+// removing those that did not exist.
+func restoreSnapshot(paths []string, snapshot map[string][]byte) error {
+	for _, path := range paths {
+		data, existed := snapshot[path]
+		if !existed {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if err := WriteFileAtomic(path, data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
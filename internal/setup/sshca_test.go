@@ -0,0 +1,162 @@
+package setup
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+// useSSHCAFiles moves the ssh-ca files to a temp dir and puts stub sshd and
+// systemctl commands on PATH. sshd -t fails while the returned flag is set.
+func useSSHCAFiles(t *testing.T) (dir string, sshdFails func(bool)) {
+	t.Helper()
+	dir = t.TempDir()
+	saved := []string{sshCADropIn, sshCAKeysFile, sshPrincipalsDir}
+	t.Cleanup(func() {
+		sshCADropIn, sshCAKeysFile, sshPrincipalsDir = saved[0], saved[1], saved[2]
+		viper.Reset()
+	})
+	sshCADropIn = filepath.Join(dir, "40-infra-agent-ca.conf")
+	sshCAKeysFile = filepath.Join(dir, "infra-agent-user-ca.pub")
+	sshPrincipalsDir = filepath.Join(dir, "auth_principals")
+
+	bin := filepath.Join(dir, "bin")
+	os.Mkdir(bin, 0755)
+	t.Setenv("PATH", bin)
+	os.WriteFile(filepath.Join(bin, "systemctl"), []byte("#!/bin/sh\nexit 0\n"), 0755)
+	sshdFails = func(fail bool) {
+		code := "0"
+		if fail {
+			code = "1"
+		}
+		os.WriteFile(filepath.Join(bin, "sshd"), []byte("#!/bin/sh\nexit "+code+"\n"), 0755)
+	}
+	sshdFails(false)
+	viper.Set(config.KeyTimeoutCommand, "5s")
+	return dir, sshdFails
+}
+
+func TestExpandPrincipal(t *testing.T) {
+	vars := map[string]string{"node-id": "gw-1", "region": "eu", "label:team": "edge", "node-type": "server:build"}
+	tests := []struct {
+		entry string
+		want  string
+		ok    bool
+	}{
+		{"ops", "ops", true},
+		{"{node-id}", "gw-1", true},
+		{"deploy-{region}-{label:team}", "deploy-eu-edge", true},
+		{"{node-type}", "server:build", true},
+		{"{label:missing}", "", false},
+		{"unclosed-{region", "", false},
+		{"a,b", "", false},
+		{"  ", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := expandPrincipal(tt.entry, vars)
+		if ok != tt.ok || ok && got != tt.want {
+			t.Errorf("expandPrincipal(%q) = %q, %v, want %q, %v", tt.entry, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestDesiredPrincipals(t *testing.T) {
+	t.Cleanup(viper.Reset)
+	viper.Set(config.KeyNodeID, "gw-1")
+	viper.Set(config.KeyRegion, "eu")
+	viper.Set(config.KeySSHPrincipals, map[string][]string{
+		"ops":    {"ops", "{node-id}", "ops"},
+		"deploy": {"{label:team}"},
+	})
+	want := map[string][]string{"ops": {"ops", "gw-1"}}
+	if got := desiredPrincipals(); !reflect.DeepEqual(got, want) {
+		t.Errorf("desiredPrincipals() = %v, want %v", got, want)
+	}
+}
+
+func TestPlanSSHCA(t *testing.T) {
+	dir, sshdFails := useSSHCAFiles(t)
+	ca := testKey("ssh-ed25519", "ca", "user-ca")
+	caFile := filepath.Join(dir, "ca.pub")
+	os.WriteFile(caFile, []byte(ca+"\n"), 0644)
+	viper.Set(config.KeyNodeID, "gw-1")
+
+	plan, err := PlanSSHCA()
+	if err != nil || len(plan.Changes) != 0 || len(plan.Notes) != 1 {
+		t.Fatalf("without ssh-ca-key-url: %+v, %v", plan, err)
+	}
+
+	viper.Set(config.KeySSHCAKeyURL, "file:"+caFile)
+	viper.Set(config.KeySSHPrincipals, map[string][]string{"ops": {"ops", "{node-id}"}})
+	os.MkdirAll(sshPrincipalsDir, 0755)
+	stale := filepath.Join(sshPrincipalsDir, "former")
+	os.WriteFile(stale, []byte("ops\n"), 0644)
+
+	plan, err = PlanSSHCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plan.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		sshCAKeysFile:                          ca + "\n",
+		filepath.Join(sshPrincipalsDir, "ops"): "ops\ngw-1\n",
+		sshCADropIn: "# Managed by infra-agent. Do not edit.\nTrustedUserCAKeys " + sshCAKeysFile +
+			"\nAuthorizedPrincipalsFile " + sshPrincipalsDir + "/%u\n",
+	}
+	for path, want := range files {
+		if data, _ := os.ReadFile(path); string(data) != want {
+			t.Errorf("%s = %q, want %q", path, data, want)
+		}
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("principals of an undeclared user left behind: %v", err)
+	}
+
+	if plan, err := PlanSSHCA(); err != nil || len(plan.Changes) != 0 {
+		t.Errorf("second plan = %+v, %v", plan, err)
+	}
+
+	// A config sshd rejects is rolled back.
+	viper.Set(config.KeySSHPrincipals, map[string][]string{"ops": {"ops"}, "deploy": {"deploy"}})
+	sshdFails(true)
+	plan, err = PlanSSHCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plan.Apply(); err == nil || !strings.Contains(err.Error(), "sshd config validation failed") {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(sshPrincipalsDir, "ops")); string(data) != "ops\ngw-1\n" {
+		t.Errorf("ops principals not restored: %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(sshPrincipalsDir, "deploy")); !os.IsNotExist(err) {
+		t.Errorf("new principals file not removed: %v", err)
+	}
+}
+
+func TestRevertSSHCA(t *testing.T) {
+	useSSHCAFiles(t)
+	if err := revertSSHCA(); err != nil {
+		t.Fatalf("nothing installed: %v", err)
+	}
+
+	os.MkdirAll(sshPrincipalsDir, 0755)
+	for _, path := range []string{sshCADropIn, sshCAKeysFile, filepath.Join(sshPrincipalsDir, "ops")} {
+		os.WriteFile(path, []byte("x\n"), 0644)
+	}
+	if err := revertSSHCA(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{sshCADropIn, sshCAKeysFile, sshPrincipalsDir} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package setup
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+const (
+	managedKeysBegin = "# BEGIN infra-agent managed keys (do not edit)"
+	managedKeysEnd   = "# END infra-agent managed keys"
+)
+
+var errNoSSHKeys = errors.New("no SSH keys configured: set ssh-keys or ssh-key-url")
+
+// sshKeyTypes are the public key algorithms accepted in authorized_keys.
+var sshKeyTypes = map[string]bool{
+	"ssh-ed25519":                        true,
+	"ssh-rsa":                            true,
+	"ecdsa-sha2-nistp256":                true,
+	"ecdsa-sha2-nistp384":                true,
+	"ecdsa-sha2-nistp521":                true,
+	"sk-ssh-ed25519@openssh.com":         true,
+	"sk-ecdsa-sha2-nistp256@openssh.com": true,
+}
+
+// declaredSSHKeys returns the key sources per target user from ssh-keys. When
+// that is unset, the legacy ssh-key-url is installed for the invoking user.
+func declaredSSHKeys() (map[string][]string, error) {
+	declared := config.GetStringMapStringSlice(config.KeySSHKeys)
+	if len(declared) > 0 {
+		return declared, nil
+	}
+	keyURL := config.GetString(config.KeySSHKeyURL)
+	if keyURL == "" {
+		return nil, errNoSSHKeys
+	}
+	name, err := currentUserName()
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]string{name: {keyURL}}, nil
+}
+
+// resolveKeySource returns the keys provided by one source:
+//   - https://github.com/<owner>/<repo>/<path>: file in a private repo, read with github-token
+//   - https://github.com/<user>.keys or any other http(s) URL: fetched anonymously
+//   - file:/path: a local file
+//   - anything else: an inline public key
+func resolveKeySource(source string) ([]string, error) {
+	var content string
+	switch {
+	case strings.HasPrefix(source, "https://github.com/") && !strings.HasSuffix(source, ".keys"):
+		token, err := config.Secret(config.KeyGithubToken)
+		if err != nil {
+			return nil, err
+		}
+		if token == "" {
+			return nil, fmt.Errorf("GitHub token is required to fetch %s. Set --github-token or GITHUB_TOKEN env var", source)
+		}
+		body, err := fetchGithubFile(source, token)
+		if err != nil {
+			return nil, err
+		}
+		content = body
+	case strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://"):
+		body, err := fetchURL(source)
+		if err != nil {
+			return nil, err
+		}
+		content = body
+	case strings.HasPrefix(source, "file:"):
+		body, err := os.ReadFile(strings.TrimPrefix(source, "file:"))
+		if err != nil {
+			return nil, err
+		}
+		content = string(body)
+	default:
+		content = source
+	}
+
+	var keys []string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := validateAuthorizedKey(line); err != nil {
+			return nil, fmt.Errorf("invalid key from %s: %w", source, err)
+		}
+		keys = append(keys, line)
+	}
+	return keys, nil
+}
+
+func fetchURL(url string) (string, error) {
+	client := &http.Client{Timeout: config.GetDuration(config.KeyTimeoutHTTP)}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	return string(body), err
+}
+
+// validateAuthorizedKey checks that an authorized_keys line carries a
+// well-formed public key: a known algorithm followed by base64 data whose
+// embedded algorithm name matches. Leading options such as from="..." are
+// allowed.
+func validateAuthorizedKey(line string) error {
+	fields := strings.Fields(line)
+	for i, f := range fields {
+		if !sshKeyTypes[f] {
+			continue
+		}
+		if i+1 >= len(fields) {
+			return fmt.Errorf("missing key data after %s", f)
+		}
+		blob, err := base64.StdEncoding.DecodeString(fields[i+1])
+		if err != nil {
+			return fmt.Errorf("key data is not valid base64")
+		}
+		if len(blob) < 4 {
+			return fmt.Errorf("key data too short")
+		}
+		n := binary.BigEndian.Uint32(blob[:4])
+		if uint32(len(blob)-4) < n || string(blob[4:4+n]) != f {
+			return fmt.Errorf("key data does not match type %s", f)
+		}
+		return nil
+	}
+	return fmt.Errorf("no supported key type found")
+}
+
+// keyMaterial returns the "type base64" part of a key line, which identifies
+// the key regardless of options and comment.
+func keyMaterial(line string) string {
+	fields := strings.Fields(line)
+	for i, f := range fields {
+		if sshKeyTypes[f] && i+1 < len(fields) {
+			return f + " " + fields[i+1]
+		}
+	}
+	return ""
+}
+
+// renderAuthorizedKeys replaces the managed block in an authorized_keys file
+// with keys, preserving every line outside it. Copies of managed keys outside
+// the block (left by the old append-only install) are dropped, so a later
+// removal from the source really revokes them.
+func renderAuthorizedKeys(existing string, keys []string) string {
+	managed := map[string]bool{}
+	for _, k := range keys {
+		managed[keyMaterial(k)] = true
+	}
+
+	var outside []string
+	inBlock := false
+	for _, line := range strings.Split(existing, "\n") {
+		switch {
+		case strings.TrimSpace(line) == managedKeysBegin:
+			inBlock = true
+		case strings.TrimSpace(line) == managedKeysEnd:
+			inBlock = false
+		case inBlock:
+		case strings.TrimSpace(line) == "":
+		case managed[keyMaterial(line)]:
+		default:
+			outside = append(outside, line)
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, line := range outside {
+		buf.WriteString(line + "\n")
+	}
+	buf.WriteString(managedKeysBegin + "\n")
+	for _, k := range keys {
+		buf.WriteString(k + "\n")
+	}
+	buf.WriteString(managedKeysEnd + "\n")
+	return buf.String()
+}
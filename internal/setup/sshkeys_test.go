@@ -0,0 +1,133 @@
+package setup
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+// testKey returns a well-formed public key line of the given type.
+func testKey(typ, data, comment string) string {
+	blob := binary.BigEndian.AppendUint32(nil, uint32(len(typ)))
+	blob = append(append(blob, typ...), data...)
+	return typ + " " + base64.StdEncoding.EncodeToString(blob) + " " + comment
+}
+
+func TestValidateAuthorizedKey(t *testing.T) {
+	ed := testKey("ssh-ed25519", "k1", "ops")
+	tests := []struct {
+		line string
+		want string
+	}{
+		{ed, ""},
+		{`from="10.0.0.0/8",no-pty ` + ed, ""},
+		{testKey("ssh-rsa", "k2", ""), ""},
+		{"ssh-dss AAAAB3NzaC1kc3M= old", "no supported key type"},
+		{"ssh-ed25519", "missing key data"},
+		{"ssh-ed25519 not!base64", "not valid base64"},
+		{"ssh-ed25519 AAE=", "too short"},
+		{"ssh-ed25519 " + strings.Fields(testKey("ssh-rsa", "k3", ""))[1], "does not match type ssh-ed25519"},
+	}
+	for _, tt := range tests {
+		err := validateAuthorizedKey(tt.line)
+		if tt.want == "" && err != nil || tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("validateAuthorizedKey(%q) = %v, want %q", tt.line, err, tt.want)
+		}
+	}
+}
+
+func TestRenderAuthorizedKeys(t *testing.T) {
+	own := testKey("ssh-ed25519", "own", "laptop")
+	ops := testKey("ssh-ed25519", "ops", "ops")
+	dev := testKey("ssh-rsa", "dev", "dev")
+	old := testKey("ssh-ed25519", "old", "revoked")
+	block := func(keys ...string) string {
+		return managedKeysBegin + "\n" + strings.Join(append(keys, managedKeysEnd), "\n") + "\n"
+	}
+
+	tests := []struct {
+		name     string
+		existing string
+		keys     []string
+		want     string
+	}{
+		{"empty file", "", []string{ops}, block(ops)},
+		{"keys outside kept", own + "\n\n", []string{ops}, own + "\n" + block(ops)},
+		{"block replaced", own + "\n" + block(old, ops), []string{ops, dev}, own + "\n" + block(ops, dev)},
+		// The old installer appended managed keys outside any block.
+		{"appended copies dropped", own + "\n" + "no-pty " + ops + "\n", []string{ops}, own + "\n" + block(ops)},
+		{"lines after the block kept", block(old) + "# backup\n" + dev + "\n", []string{ops}, "# backup\n" + dev + "\n" + block(ops)},
+		{"no trailing newline", own, []string{ops}, own + "\n" + block(ops)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := renderAuthorizedKeys(tt.existing, tt.keys)
+			if got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+			if again := renderAuthorizedKeys(got, tt.keys); again != got {
+				t.Errorf("not idempotent:\n%s", again)
+			}
+		})
+	}
+}
+
+func TestResolveUserKeys(t *testing.T) {
+	ops := testKey("ssh-ed25519", "ops", "ops")
+	dev := testKey("ssh-rsa", "dev", "dev")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dev.keys" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(dev + "\n" + ops + " ops@other\n"))
+	}))
+	defer srv.Close()
+	viper.Set(config.KeyTimeoutHTTP, "5s")
+	t.Cleanup(viper.Reset)
+
+	file := filepath.Join(t.TempDir(), "keys")
+	os.WriteFile(file, []byte("# team keys\n\n"+ops+"\n"), 0644)
+
+	keys, err := resolveUserKeys([]string{"file:" + file, srv.URL + "/dev.keys", ops})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same key with another comment is a duplicate.
+	if want := []string{ops, dev}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys = %q, want %q", keys, want)
+	}
+
+	for _, source := range []string{srv.URL + "/missing.keys", "file:" + file + ".missing", "ssh-ed25519 garbage"} {
+		if _, err := resolveUserKeys([]string{ops, source}); err == nil {
+			t.Errorf("source %q: no error", source)
+		}
+	}
+}
+
+// A source that yields no keys must not be taken as a revocation.
+func TestPlanSSHRefusesEmptySources(t *testing.T) {
+	empty := filepath.Join(t.TempDir(), "keys")
+	os.WriteFile(empty, []byte("# nothing here\n"), 0644)
+	viper.Set(config.KeyStateDir, t.TempDir())
+	viper.Set(config.KeySSHKeys, map[string][]string{"deploy": {"file:" + empty}})
+	t.Cleanup(viper.Reset)
+
+	if _, err := PlanSSH(); err == nil || !strings.Contains(err.Error(), "refusing to empty the managed block") {
+		t.Errorf("PlanSSH() error = %v", err)
+	}
+
+	viper.Set(config.KeySSHKeys, map[string][]string{"deploy": {"file:" + empty + ".missing"}})
+	if _, err := PlanSSH(); err == nil || !strings.HasPrefix(err.Error(), "user deploy:") {
+		t.Errorf("unreachable source: error = %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package setup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+var stateFile = "/etc/infra-agent/setup-state.json"
+
+// AgentVersion is recorded with each successful step; it is set by main.
+var AgentVersion string
+
+// SetupState records the outcome of setup runs so unchanged steps can be
+// skipped and a failed run can be resumed.
+type SetupState struct {
+	Steps      map[string]*StepState `json:"steps"`
+	FailedStep string                `json:"failed_step,omitempty"`
+}
+
+type StepState struct {
+	LastSuccess time.Time `json:"last_success,omitempty"`
+	Version     string    `json:"version,omitempty"`
+	Checksum    string    `json:"checksum,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+func loadState() *SetupState {
+	st := &SetupState{Steps: map[string]*StepState{}}
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		return st
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		fmt.Printf("Warning: ignoring corrupt setup state %s: %v\n", stateFile, err)
+		return &SetupState{Steps: map[string]*StepState{}}
+	}
+	if st.Steps == nil {
+		st.Steps = map[string]*StepState{}
+	}
+	return st
+}
+
+func (s *SetupState) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(stateFile), 0755); err != nil {
+		return err
+	}
+	return WriteFileAtomic(stateFile, data, 0600)
+}
+
+func (s *SetupState) step(name string) *StepState {
+	if s.Steps[name] == nil {
+		s.Steps[name] = &StepState{}
+	}
+	return s.Steps[name]
+}
+
+// recordSuccess records that step succeeded with the inputs whose checksum
+// is sum.
+func (s *SetupState) recordSuccess(step Step, sum string) {
+	st := s.step(step.Name)
+	st.LastSuccess = time.Now().UTC()
+	st.Version = AgentVersion
+	st.Checksum = sum
+	st.LastError = ""
+	if s.FailedStep == step.Name {
+		s.FailedStep = ""
+	}
+}
+
+func (s *SetupState) recordFailure(step Step, err error) {
+	s.step(step.Name).LastError = err.Error()
+	s.FailedStep = step.Name
+}
+
+// StepSucceeded reports whether the step has succeeded on this node, i.e. it
+// was run and not declined.
+func StepSucceeded(name string) bool {
+	return loadState().succeeded(name)
+}
+
+func (s *SetupState) succeeded(name string) bool {
+	st := s.Steps[name]
+	return st != nil && !st.LastSuccess.IsZero()
+}
+
+// upToDate reports whether the step last succeeded with the inputs whose
+// checksum is sum and the same agent version, in which case re-running it
+// would be a no-op.
+func (s *SetupState) upToDate(step Step, sum string) bool {
+	st := s.Steps[step.Name]
+	return s.succeeded(step.Name) && sum != "" &&
+		st.Version == AgentVersion && st.Checksum == sum
+}
+
+// inputChecksum hashes the current values of the config keys a step reads
+// and the content it fetches. The github-token is an input of the ssh step,
+// so values are hashed rather than stored; secrets are hashed as resolved,
+// so moving one to the secret store does not count as a change but rotating
+// it does. It returns "" if the content cannot be fetched, which never
+// counts as up to date.
+func inputChecksum(step Step) string {
+	values := make(map[string]interface{}, len(step.Inputs)+1)
+	for _, key := range step.Inputs {
+		values[key] = config.Get(key)
+		if config.IsSecret(key) {
+			values[key], _ = config.Secret(key)
+		}
+	}
+	if step.Fetch != nil {
+		fetched, err := step.Fetch()
+		if err != nil {
+			return ""
+		}
+		sum := sha256.Sum256(fetched)
+		// Not a config key, so it cannot collide with one.
+		values["fetched content"] = hex.EncodeToString(sum[:])
+	}
+	// encoding/json sorts map keys, so the encoding is stable.
+	data, _ := json.Marshal(values)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -1,15 +1,197 @@
 package setup
 
-import "github.com/spf13/cobra"
+import (
+	"fmt"
+	"strings"
 
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+// Step is a setup task. Plan inspects the system and returns the changes the
+// step would make without touching anything; the runner then prints, confirms
+// and applies that plan.
 type Step struct {
 	Name string
-	Run  func(cmd *cobra.Command, args []string) error
+	Plan func() (*Plan, error)
+	// DependsOn lists steps that must have succeeded before this one.
+	DependsOn []string
+	// NodeTypes restricts the step to these node types and their subtypes
+	// ("server" matches "server:build"). Empty means every node.
+	NodeTypes []string
+	// Inputs are the config keys the step reads. A step whose inputs are
+	// unchanged since its last success is skipped.
+	Inputs []string
+	// Fetch returns the content the step reads from outside the config (key
+	// sources, users-url), which counts as an input too. Nil means none.
+	Fetch func() ([]byte, error)
+	// Revert undoes what the step manages when the agent is uninstalled.
+	// Nil means the step's changes are left in place.
+	Revert func() error
+}
+
+// appliesTo reports whether the step runs on the given node type.
+func (s Step) appliesTo(nodeType string) bool {
+	if len(s.NodeTypes) == 0 {
+		return true
+	}
+	for _, t := range s.NodeTypes {
+		if nodeType == t || strings.HasPrefix(nodeType, t+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// Kinds of change a plan can contain.
+const (
+	ChangeFile       = "file"
+	ChangePackage    = "package"
+	ChangeCommand    = "command"
+	ChangeService    = "service"
+	ChangePermission = "permission"
+)
+
+// Change is a single intended modification of the system.
+type Change struct {
+	Kind        string `json:"kind"`
+	Target      string `json:"target"`
+	Description string `json:"description"`
+	Diff        string `json:"diff,omitempty"`
+
+	apply func() error
+}
+
+// Plan is the set of changes a step intends to make. Notes carry information
+// that is not a change, e.g. packages that would be removed.
+type Plan struct {
+	Step    string   `json:"step"`
+	Changes []Change `json:"changes"`
+	Notes   []string `json:"notes,omitempty"`
+
+	// prepare runs before the first change; finish runs after the last one,
+	// or after the first failure, receiving that error.
+	prepare func() error
+	finish  func(err error) error
+	// applied collects the descriptions of changes made by Apply.
+	applied []string
+}
+
+func (p *Plan) add(c *Change) {
+	if c != nil {
+		p.Changes = append(p.Changes, *c)
+	}
+}
+
+func (p *Plan) note(format string, args ...interface{}) {
+	p.Notes = append(p.Notes, fmt.Sprintf(format, args...))
 }
 
 var Steps = []Step{
-	{Name: "ssh", Run: RunSSH},
-	{Name: "hardening", Run: RunHardening},
-	{Name: "packages", Run: RunPackages},
-	{Name: "timezone", Run: RunTimezone},
+	{
+		Name:   "users",
+		Plan:   PlanUsers,
+		Inputs: []string{config.KeyGithubToken, config.KeyUsers, config.KeyGroups, config.KeyUsersURL},
+		Fetch:  fetchUserSpec,
+		Revert: revertUsers,
+	},
+	{
+		Name: "ssh",
+		Plan: PlanSSH,
+		// Keys can be declared for users the users step creates.
+		DependsOn: []string{"users"},
+		Inputs:    []string{config.KeyGithubToken, config.KeySSHKeyURL, config.KeySSHKeys},
+		Fetch:     fetchSSHKeys,
+		Revert:    revertSSHKeys,
+	},
+	{
+		Name: "ssh-ca",
+		Plan: PlanSSHCA,
+		// Certificates complement the authorized keys, which remain the
+		// fallback if the CA setup is broken.
+		DependsOn: []string{"ssh"},
+		Inputs: []string{config.KeyGithubToken, config.KeySSHCAKeyURL, config.KeySSHPrincipals,
+			config.KeyNodeID, config.KeyNodeType, config.KeyRegion, config.KeyLabels},
+		Fetch:  fetchSSHCAKeys,
+		Revert: revertSSHCA,
+	},
+	{
+		Name: "hardening",
+		Plan: PlanHardening,
+		// Password auth is disabled, so key access must be in place first.
+		DependsOn: []string{"ssh"},
+		Inputs:    []string{config.KeyPermitRootLogin, config.KeyAllowUsers, config.KeyDisableServices},
+		Revert:    revertAllHardening,
+	},
+	{
+		Name:   "firewall",
+		Plan:   PlanFirewall,
+		Inputs: []string{config.KeyFirewall, config.KeyNodeType},
+		Revert: revertFirewall,
+	},
+	{
+		Name:   "packages",
+		Plan:   PlanPackages,
+		Inputs: []string{config.KeyPackages, config.KeyNodeType},
+	},
+	{
+		Name: "timezone",
+		Plan: PlanTimezone,
+		// chrony, if declared, must be installed before it is configured.
+		DependsOn: []string{"packages"},
+		Inputs:    []string{config.KeyTimezone, config.KeyNTPServers},
+	},
+	{
+		Name: "caddy",
+		Plan: PlanCaddy,
+		// Caddy is installed as a gateway package.
+		DependsOn: []string{"packages"},
+		NodeTypes: []string{"gateway"},
+	},
+}
+
+// FindStep returns the step with the given name.
+func FindStep(name string) (Step, bool) {
+	for _, s := range Steps {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return Step{}, false
+}
+
+// orderedSteps returns Steps sorted so that every step comes after its
+// dependencies, keeping declaration order otherwise.
+func orderedSteps() ([]Step, error) {
+	var ordered []Step
+	state := map[string]int{} // 0 = unvisited, 1 = visiting, 2 = done
+
+	var visit func(s Step) error
+	visit = func(s Step) error {
+		switch state[s.Name] {
+		case 1:
+			return fmt.Errorf("setup step dependency cycle at %s", s.Name)
+		case 2:
+			return nil
+		}
+		state[s.Name] = 1
+		for _, dep := range s.DependsOn {
+			d, ok := FindStep(dep)
+			if !ok {
+				return fmt.Errorf("step %s depends on unknown step %s", s.Name, dep)
+			}
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		state[s.Name] = 2
+		ordered = append(ordered, s)
+		return nil
+	}
+
+	for _, s := range Steps {
+		if err := visit(s); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
 }
@@ -2,11 +2,131 @@ package setup
 
 import (
 	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
 
-	"github.com/spf13/cobra"
+	"github.com/uverustech/infra-agent/internal/config"
 )
 
-func RunTimezone(cmd *cobra.Command, args []string) error {
-	fmt.Println("Timezone Configuration (Not implemented yet)")
+// The files the timezone step reads and writes. They are variables so tests
+// can point them at a temporary directory.
+var (
+	zoneinfoDir      = "/usr/share/zoneinfo"
+	localtimeFile    = "/etc/localtime"
+	timezoneFile     = "/etc/timezone"
+	timesyncdDropIn  = "/etc/systemd/timesyncd.conf.d/50-infra-agent.conf"
+	chronySourceFile = "/etc/chrony/sources.d/infra-agent.sources"
+)
+
+func PlanTimezone() (*Plan, error) {
+	plan := &Plan{Step: "timezone"}
+	tz := config.GetString(config.KeyTimezone)
+	servers := config.GetStringSlice(config.KeyNTPServers)
+
+	if _, err := os.Stat(filepath.Join(zoneinfoDir, tz)); err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", tz)
+	}
+	if current := currentTimezone(); !sameZone(current, tz) {
+		plan.add(&Change{
+			Kind:        ChangeCommand,
+			Target:      "timedatectl set-timezone " + tz,
+			Description: fmt.Sprintf("change timezone %s → %s", current, tz),
+			apply: func() error {
+				return setTimezone(tz)
+			},
+		})
+	}
+
+	if len(servers) > 0 {
+		planTimeSync(plan, servers)
+	}
+
+	plan.finish = func(err error) error {
+		if err != nil {
+			return err
+		}
+		return verifyTimeSync()
+	}
+	return plan, nil
+}
+
+func currentTimezone() string {
+	target, err := os.Readlink(localtimeFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(target, zoneinfoDir+"/")
+}
+
+// sameZone treats aliases such as UTC and Etc/UTC as equal.
+func sameZone(a, b string) bool {
+	if a == b {
+		return true
+	}
+	ra, errA := filepath.EvalSymlinks(filepath.Join(zoneinfoDir, a))
+	rb, errB := filepath.EvalSymlinks(filepath.Join(zoneinfoDir, b))
+	return errA == nil && errB == nil && ra == rb
+}
+
+func setTimezone(tz string) error {
+	if err := runCommand("timedatectl", "set-timezone", tz); err == nil {
+		return nil
+	}
+	// No systemd (e.g. containers): set it by hand.
+	tmp := localtimeFile + ".infra-agent"
+	os.Remove(tmp)
+	if err := os.Symlink(filepath.Join(zoneinfoDir, tz), tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, localtimeFile); err != nil {
+		return err
+	}
+	return os.WriteFile(timezoneFile, []byte(tz+"\n"), 0644)
+}
+
+// planTimeSync points whichever NTP daemon the node runs at our servers.
+// chrony is used if installed, otherwise systemd-timesyncd.
+func planTimeSync(plan *Plan, servers []string) {
+	if _, err := exec.LookPath("chronyd"); err == nil {
+		var b strings.Builder
+		b.WriteString("# Managed by infra-agent. Do not edit.\n")
+		for _, s := range servers {
+			fmt.Fprintf(&b, "server %s iburst\n", s)
+		}
+		if c := fileChange(chronySourceFile, []byte(b.String()), 0644); c != nil {
+			plan.add(c)
+			plan.add(commandChange("chronyc", "reload", "sources"))
+		}
+		return
+	}
+
+	content := fmt.Sprintf("# Managed by infra-agent. Do not edit.\n[Time]\nNTP=%s\n", strings.Join(servers, " "))
+	if c := fileChange(timesyncdDropIn, []byte(content), 0644); c != nil {
+		plan.add(c)
+		plan.add(commandChange("timedatectl", "set-ntp", "true"))
+		plan.add(commandChange("systemctl", "restart", "systemd-timesyncd"))
+	}
+}
+
+// verifyTimeSync waits briefly for the clock to report synchronization. An
+// unsynchronized clock is a warning, not a failure: the first sync can take
+// minutes and the agent reports the offset in its heartbeat anyway.
+func verifyTimeSync() error {
+	for i := 0; i < 10; i++ {
+		out, err := exec.Command("timedatectl", "show", "-p", "NTPSynchronized", "--value").Output()
+		if err != nil {
+			fmt.Println("Warning: could not query time synchronization state")
+			return nil
+		}
+		if strings.TrimSpace(string(out)) == "yes" {
+			fmt.Println("System clock is synchronized")
+			return nil
+		}
+		time.Sleep(3 * time.Second)
+	}
+	fmt.Println("Warning: system clock is not synchronized yet")
 	return nil
 }
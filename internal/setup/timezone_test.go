@@ -0,0 +1,159 @@
+package setup
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+// useZoneFiles builds a small zoneinfo tree and a localtime link to
+// currentZone, and records the commands the step runs. PATH is emptied so
+// neither chronyd nor timedatectl is found unless a test provides them.
+func useZoneFiles(t *testing.T, currentZone string) (dir string, calls *[]string, fail *string) {
+	t.Helper()
+	dir = t.TempDir()
+	saved := []string{zoneinfoDir, localtimeFile, timezoneFile, timesyncdDropIn, chronySourceFile}
+	t.Cleanup(func() {
+		zoneinfoDir, localtimeFile, timezoneFile, timesyncdDropIn, chronySourceFile = saved[0], saved[1], saved[2], saved[3], saved[4]
+		viper.Reset()
+	})
+	zoneinfoDir = filepath.Join(dir, "zoneinfo")
+	localtimeFile = filepath.Join(dir, "localtime")
+	timezoneFile = filepath.Join(dir, "timezone")
+	timesyncdDropIn = filepath.Join(dir, "timesyncd.conf.d", "50-infra-agent.conf")
+	chronySourceFile = filepath.Join(dir, "chrony", "infra-agent.sources")
+	for _, zone := range []string{"UTC", "Europe/Berlin"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(zoneinfoDir, zone)), 0755)
+		os.WriteFile(filepath.Join(zoneinfoDir, zone), []byte("TZif "+zone), 0644)
+	}
+	os.Mkdir(filepath.Join(zoneinfoDir, "Etc"), 0755)
+	os.Symlink("../UTC", filepath.Join(zoneinfoDir, "Etc", "UTC"))
+	os.Symlink(filepath.Join(zoneinfoDir, currentZone), localtimeFile)
+
+	bin := filepath.Join(dir, "bin")
+	os.Mkdir(bin, 0755)
+	t.Setenv("PATH", bin)
+	calls, fail = stubCommands(t)
+	return dir, calls, fail
+}
+
+func TestSameZone(t *testing.T) {
+	useZoneFiles(t, "UTC")
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"UTC", "UTC", true},
+		{"UTC", "Etc/UTC", true},
+		{"Etc/UTC", "Europe/Berlin", false},
+		{"", "UTC", false},
+		{"Mars/Olympus", "Mars/Olympus", true},
+		{"Mars/Olympus", "UTC", false},
+	}
+	for _, tt := range tests {
+		if got := sameZone(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameZone(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+	if got := currentTimezone(); got != "UTC" {
+		t.Errorf("currentTimezone() = %q", got)
+	}
+}
+
+func TestPlanTimezone(t *testing.T) {
+	_, calls, _ := useZoneFiles(t, "Etc/UTC")
+
+	viper.Set(config.KeyTimezone, "UTC")
+	plan, err := PlanTimezone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 {
+		t.Errorf("Etc/UTC → UTC planned %+v", plan.Changes)
+	}
+
+	viper.Set(config.KeyTimezone, "Europe/Berlin")
+	plan, err = PlanTimezone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 1 || plan.Changes[0].Description != "change timezone Etc/UTC → Europe/Berlin" {
+		t.Fatalf("changes = %+v", plan.Changes)
+	}
+	if err := plan.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"timedatectl set-timezone Europe/Berlin"}; !reflect.DeepEqual(*calls, want) {
+		t.Errorf("ran %q, want %q", *calls, want)
+	}
+
+	viper.Set(config.KeyTimezone, "Mars/Olympus")
+	if _, err := PlanTimezone(); err == nil || !strings.Contains(err.Error(), `unknown timezone "Mars/Olympus"`) {
+		t.Errorf("error = %v", err)
+	}
+}
+
+// Without systemd the zone is set by replacing the localtime link.
+func TestSetTimezoneWithoutTimedatectl(t *testing.T) {
+	dir, _, fail := useZoneFiles(t, "UTC")
+	*fail = "timedatectl"
+
+	if err := setTimezone("Europe/Berlin"); err != nil {
+		t.Fatal(err)
+	}
+	if got := currentTimezone(); got != "Europe/Berlin" {
+		t.Errorf("localtime points at %q", got)
+	}
+	if data, _ := os.ReadFile(timezoneFile); string(data) != "Europe/Berlin\n" {
+		t.Errorf("/etc/timezone = %q", data)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "localtime.infra-agent")); !os.IsNotExist(err) {
+		t.Errorf("temp link left behind: %v", err)
+	}
+}
+
+func TestPlanTimeSync(t *testing.T) {
+	dir, calls, _ := useZoneFiles(t, "UTC")
+	viper.Set(config.KeyTimezone, "UTC")
+	viper.Set(config.KeyNTPServers, []string{"time.cloudflare.com", "ntp.ubuntu.com"})
+
+	plan, err := PlanTimezone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plan.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	want := "# Managed by infra-agent. Do not edit.\n[Time]\nNTP=time.cloudflare.com ntp.ubuntu.com\n"
+	if data, _ := os.ReadFile(timesyncdDropIn); string(data) != want {
+		t.Errorf("timesyncd drop-in = %q, want %q", data, want)
+	}
+	if want := []string{"timedatectl set-ntp true", "systemctl restart systemd-timesyncd"}; !reflect.DeepEqual(*calls, want) {
+		t.Errorf("ran %q, want %q", *calls, want)
+	}
+
+	// Applied once, nothing is left to do.
+	if plan, _ := PlanTimezone(); len(plan.Changes) != 0 {
+		t.Errorf("second plan = %+v", plan.Changes)
+	}
+
+	// chrony takes precedence when installed.
+	os.WriteFile(filepath.Join(dir, "bin", "chronyd"), []byte("#!/bin/sh\n"), 0755)
+	*calls = nil
+	plan, _ = PlanTimezone()
+	if err := plan.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	want = "# Managed by infra-agent. Do not edit.\nserver time.cloudflare.com iburst\nserver ntp.ubuntu.com iburst\n"
+	if data, _ := os.ReadFile(chronySourceFile); string(data) != want {
+		t.Errorf("chrony sources = %q, want %q", data, want)
+	}
+	if want := []string{"chronyc reload sources"}; !reflect.DeepEqual(*calls, want) {
+		t.Errorf("ran %q, want %q", *calls, want)
+	}
+}
@@ -0,0 +1,468 @@
+package setup
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+// The account databases and the sudoers drop-in directory. They are
+// variables so tests can use copies.
+var (
+	passwdFile = "/etc/passwd"
+	groupFile  = "/etc/group"
+	shadowFile = "/etc/shadow"
+	sudoersDir = "/etc/sudoers.d"
+)
+
+// UserSpec is the declarative set of local accounts, read from the "users"
+// and "groups" config keys or from the file at users-url.
+type UserSpec struct {
+	Users  []LocalUser  `mapstructure:"users"`
+	Groups []LocalGroup `mapstructure:"groups"`
+}
+
+// LocalUser is a declared account. A locked account has expired, which also
+// refuses key-based logins; Sudo rules are written to a sudoers drop-in as
+// "<name> <rule>".
+type LocalUser struct {
+	Name   string   `mapstructure:"name"`
+	UID    int      `mapstructure:"uid"`
+	Shell  string   `mapstructure:"shell"`
+	Groups []string `mapstructure:"groups"`
+	Locked bool     `mapstructure:"locked"`
+	Sudo   []string `mapstructure:"sudo"`
+}
+
+type LocalGroup struct {
+	Name string `mapstructure:"name"`
+	GID  int    `mapstructure:"gid"`
+}
+
+// systemUser is an account as found in /etc/passwd, /etc/group and
+// /etc/shadow.
+type systemUser struct {
+	UID    int
+	Shell  string
+	Groups []string
+	Locked bool
+}
+
+// PlanUsers reconciles declared users and groups with the system. Accounts
+// this step created with useradd are removed once they are no longer
+// declared; accounts that existed before, even if declared to adjust them,
+// are never removed.
+func PlanUsers() (*Plan, error) {
+	plan := &Plan{Step: "users"}
+
+	spec, err := loadUserSpec()
+	if err != nil {
+		return nil, err
+	}
+	users, err := readSystemUsers()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := readSystemGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, g := range spec.Groups {
+		gid, exists := groups[g.Name]
+		switch {
+		case !exists:
+			args := []string{}
+			if g.GID != 0 {
+				args = append(args, "--gid", strconv.Itoa(g.GID))
+			}
+			plan.add(commandChange("groupadd", append(args, g.Name)...))
+		case g.GID != 0 && gid != g.GID:
+			plan.add(commandChange("groupmod", "--gid", strconv.Itoa(g.GID), g.Name))
+		}
+	}
+
+	// created holds the accounts this step has created that still exist. It
+	// is updated as changes apply, so a run that fails halfway still records
+	// the accounts it did create.
+	recorded := loadCreatedUsers()
+	created := map[string]bool{}
+	for _, name := range recorded {
+		if _, exists := users[name]; exists {
+			created[name] = true
+		}
+	}
+
+	declared := map[string]bool{}
+	for _, u := range spec.Users {
+		if u.Name == "" {
+			return nil, fmt.Errorf("declared user without a name")
+		}
+		declared[u.Name] = true
+		changes := planUser(u, users)
+		if _, exists := users[u.Name]; !exists {
+			name, useradd := u.Name, changes[0].apply
+			changes[0].apply = func() error {
+				if err := useradd(); err != nil {
+					return err
+				}
+				created[name] = true
+				return nil
+			}
+		}
+		for _, c := range changes {
+			plan.add(c)
+		}
+		c, err := sudoersChange(u)
+		if err != nil {
+			return nil, err
+		}
+		plan.add(c)
+	}
+
+	for _, name := range sortedKeys(created) {
+		if declared[name] {
+			continue
+		}
+		if protectedUser(name, users[name]) {
+			plan.note("%s is no longer declared but will not be removed", name)
+			delete(created, name)
+			continue
+		}
+		c := commandChange("userdel", name)
+		name, userdel := name, c.apply
+		c.apply = func() error {
+			if err := userdel(); err != nil {
+				return err
+			}
+			delete(created, name)
+			return nil
+		}
+		plan.add(c)
+		plan.note("home directory of %s is kept", name)
+	}
+
+	// Drop-ins of users that no longer have sudo rules are removed.
+	entries, _ := filepath.Glob(filepath.Join(sudoersDir, "infra-agent-*"))
+	for _, path := range entries {
+		name := strings.TrimPrefix(filepath.Base(path), "infra-agent-")
+		if u := findLocalUser(spec.Users, name); u != nil && len(u.Sudo) > 0 {
+			continue
+		}
+		path := path
+		plan.add(&Change{
+			Kind:        ChangeFile,
+			Target:      path,
+			Description: fmt.Sprintf("remove %s", path),
+			apply: func() error {
+				return os.Remove(path)
+			},
+		})
+	}
+
+	if len(plan.Changes) > 0 || !equalStrings(sortedKeys(created), recorded) {
+		plan.finish = func(err error) error {
+			if saveErr := saveCreatedUsers(sortedKeys(created)); err == nil {
+				err = saveErr
+			}
+			return err
+		}
+	}
+	return plan, nil
+}
+
+// protectedUser reports whether an account must never be removed: root, any
+// uid 0 account, the user running setup and, since setup runs under sudo,
+// the operator who invoked sudo.
+func protectedUser(name string, u systemUser) bool {
+	if name == "root" || u.UID == 0 {
+		return true
+	}
+	if current, err := currentUserName(); err == nil && name == current {
+		return true
+	}
+	return name == os.Getenv("SUDO_USER")
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// planUser returns the commands that bring one account in line with its
+// declaration.
+func planUser(u LocalUser, users map[string]systemUser) []*Change {
+	shell := u.Shell
+	if shell == "" {
+		shell = "/bin/bash"
+	}
+	sort.Strings(u.Groups)
+
+	cur, exists := users[u.Name]
+	if !exists {
+		args := []string{"--create-home", "--user-group", "--shell", shell}
+		if u.UID != 0 {
+			args = append(args, "--uid", strconv.Itoa(u.UID))
+		}
+		if len(u.Groups) > 0 {
+			args = append(args, "--groups", strings.Join(u.Groups, ","))
+		}
+		changes := []*Change{commandChange("useradd", append(args, u.Name)...)}
+		if u.Locked {
+			changes = append(changes, commandChange("usermod", "--expiredate", "1", u.Name))
+		}
+		return changes
+	}
+
+	var changes []*Change
+	if u.UID != 0 && cur.UID != u.UID {
+		changes = append(changes, commandChange("usermod", "--uid", strconv.Itoa(u.UID), u.Name))
+	}
+	if cur.Shell != shell {
+		changes = append(changes, commandChange("usermod", "--shell", shell, u.Name))
+	}
+	if !equalStrings(cur.Groups, u.Groups) {
+		changes = append(changes, commandChange("usermod", "--groups", strings.Join(u.Groups, ","), u.Name))
+	}
+	if cur.Locked != u.Locked {
+		expire := ""
+		if u.Locked {
+			expire = "1"
+		}
+		changes = append(changes, commandChange("usermod", "--expiredate", expire, u.Name))
+	}
+	return changes
+}
+
+// sudoersChange plans the sudoers drop-in of a user. The file is checked with
+// visudo before it is installed, since a broken drop-in disables sudo for
+// everyone.
+func sudoersChange(u LocalUser) (*Change, error) {
+	if len(u.Sudo) == 0 {
+		return nil, nil
+	}
+	var buf strings.Builder
+	buf.WriteString("# Managed by infra-agent. Do not edit.\n")
+	for _, rule := range u.Sudo {
+		if strings.ContainsAny(rule, "\n") {
+			return nil, fmt.Errorf("sudo rule for %s spans several lines", u.Name)
+		}
+		fmt.Fprintf(&buf, "%s %s\n", u.Name, rule)
+	}
+	content := []byte(buf.String())
+
+	// sudo skips drop-ins whose name contains a dot.
+	if strings.Contains(u.Name, ".") {
+		return nil, fmt.Errorf("cannot write sudoers drop-in for %s: sudo ignores file names with dots", u.Name)
+	}
+	path := filepath.Join(sudoersDir, "infra-agent-"+u.Name)
+	c := fileChange(path, content, 0440)
+	if c == nil {
+		return nil, nil
+	}
+	write := c.apply
+	c.apply = func() error {
+		if err := validateSudoers(content); err != nil {
+			return err
+		}
+		return write()
+	}
+	return c, nil
+}
+
+func validateSudoers(content []byte) error {
+	f, err := os.CreateTemp("", "sudoers-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if out, err := exec.Command("visudo", "-cf", f.Name()).CombinedOutput(); err != nil {
+		return fmt.Errorf("sudoers validation failed: %v\n%s", err, string(out))
+	}
+	return nil
+}
+
+// loadUserSpec reads the declared users from users-url when set, otherwise
+// from the local config.
+func loadUserSpec() (UserSpec, error) {
+	var spec UserSpec
+	unmarshalKey := config.UnmarshalKey
+	if url := config.GetString(config.KeyUsersURL); url != "" {
+		token, err := config.Secret(config.KeyGithubToken)
+		if err != nil {
+			return spec, err
+		}
+		if token == "" {
+			return spec, fmt.Errorf("GitHub token is required to fetch %s. Set --github-token or GITHUB_TOKEN env var", url)
+		}
+		body, err := fetchGithubFile(url, token)
+		if err != nil {
+			return spec, fmt.Errorf("failed to fetch users from %s: %w", url, err)
+		}
+		src := viper.New()
+		format := strings.TrimPrefix(filepath.Ext(url), ".")
+		if format == "" || format == "yml" {
+			format = "yaml"
+		}
+		src.SetConfigType(format)
+		if err := src.ReadConfig(strings.NewReader(body)); err != nil {
+			return spec, fmt.Errorf("invalid users file %s: %w", url, err)
+		}
+		unmarshalKey = func(key string, out interface{}) error { return src.UnmarshalKey(key, out) }
+	}
+	if err := unmarshalKey(config.KeyUsers, &spec.Users); err != nil {
+		return spec, fmt.Errorf("invalid users: %w", err)
+	}
+	if err := unmarshalKey(config.KeyGroups, &spec.Groups); err != nil {
+		return spec, fmt.Errorf("invalid groups: %w", err)
+	}
+	return spec, nil
+}
+
+// fetchUserSpec returns the declared users and groups, fetched from
+// users-url when set, for the input checksum.
+func fetchUserSpec() ([]byte, error) {
+	spec, err := loadUserSpec()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(spec)
+}
+
+func readSystemUsers() (map[string]systemUser, error) {
+	users := map[string]systemUser{}
+	err := readColonFile(passwdFile, func(f []string) {
+		if len(f) < 7 {
+			return
+		}
+		uid, _ := strconv.Atoi(f[2])
+		users[f[0]] = systemUser{UID: uid, Shell: f[6]}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = readColonFile(groupFile, func(f []string) {
+		if len(f) < 4 || f[3] == "" {
+			return
+		}
+		for _, member := range strings.Split(f[3], ",") {
+			if u, ok := users[member]; ok {
+				u.Groups = append(u.Groups, f[0])
+				users[member] = u
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	today := int(time.Now().Unix() / 86400)
+	// /etc/shadow is only readable by root; without it lock state is unknown
+	// and reported as unlocked.
+	readColonFile(shadowFile, func(f []string) {
+		if len(f) < 8 || f[7] == "" {
+			return
+		}
+		if u, ok := users[f[0]]; ok {
+			expire, _ := strconv.Atoi(f[7])
+			u.Locked = expire <= today
+			users[f[0]] = u
+		}
+	})
+	for name, u := range users {
+		sort.Strings(u.Groups)
+		users[name] = u
+	}
+	return users, nil
+}
+
+func readSystemGroups() (map[string]int, error) {
+	groups := map[string]int{}
+	err := readColonFile(groupFile, func(f []string) {
+		if len(f) >= 3 {
+			groups[f[0]], _ = strconv.Atoi(f[2])
+		}
+	})
+	return groups, err
+}
+
+func readColonFile(path string, fn func(fields []string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fn(strings.Split(line, ":"))
+	}
+	return scanner.Err()
+}
+
+func findLocalUser(users []LocalUser, name string) *LocalUser {
+	for i := range users {
+		if users[i].Name == name {
+			return &users[i]
+		}
+	}
+	return nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func createdUsersFile() string {
+	return filepath.Join(config.GetString(config.KeyStateDir), "created-users.json")
+}
+
+// loadCreatedUsers returns the accounts the users step created with useradd;
+// only these are ever removed.
+func loadCreatedUsers() []string {
+	data, err := os.ReadFile(createdUsersFile())
+	if err != nil {
+		return nil
+	}
+	var names []string
+	json.Unmarshal(data, &names)
+	sort.Strings(names)
+	return names
+}
+
+func saveCreatedUsers(names []string) error {
+	data, _ := json.Marshal(names)
+	if err := os.MkdirAll(filepath.Dir(createdUsersFile()), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(createdUsersFile(), data, 0644)
+}
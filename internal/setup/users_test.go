@@ -0,0 +1,222 @@
+package setup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+const testPasswd = `root:x:0:0:root:/root:/bin/bash
+ubuntu:x:1000:1000:Ubuntu:/home/ubuntu:/bin/bash
+`
+
+const testGroup = `root:x:0:
+sudo:x:27:ubuntu
+ops:x:3000:
+ubuntu:x:1000:
+`
+
+// useUserFiles points the users step at copies of the account databases and
+// a temp sudoers.d, and records the commands it runs (see stubCommands).
+func useUserFiles(t *testing.T, passwd string) (calls *[]string, fail *string) {
+	t.Helper()
+	dir := t.TempDir()
+	saved := []string{passwdFile, groupFile, shadowFile, sudoersDir}
+	t.Cleanup(func() {
+		passwdFile, groupFile, shadowFile, sudoersDir = saved[0], saved[1], saved[2], saved[3]
+		viper.Reset()
+	})
+	passwdFile = filepath.Join(dir, "passwd")
+	groupFile = filepath.Join(dir, "group")
+	shadowFile = filepath.Join(dir, "shadow")
+	sudoersDir = filepath.Join(dir, "sudoers.d")
+	os.WriteFile(passwdFile, []byte(passwd), 0644)
+	os.WriteFile(groupFile, []byte(testGroup), 0644)
+	os.Mkdir(sudoersDir, 0755)
+	viper.Set(config.KeyStateDir, filepath.Join(dir, "state"))
+	return stubCommands(t)
+}
+
+// stubCommands records the commands run through runCommand instead of
+// running them. Commands starting with *fail fail.
+func stubCommands(t *testing.T) (calls *[]string, fail *string) {
+	t.Helper()
+	saved := runCommand
+	t.Cleanup(func() { runCommand = saved })
+	var recorded []string
+	var failing string
+	runCommand = func(name string, args ...string) error {
+		line := strings.Join(append([]string{name}, args...), " ")
+		recorded = append(recorded, line)
+		if failing != "" && strings.HasPrefix(line, failing) {
+			return errors.New("exit status 1")
+		}
+		return nil
+	}
+	return &recorded, &failing
+}
+
+func declareUsers(users ...map[string]interface{}) {
+	viper.Set(config.KeyUsers, users)
+}
+
+func applyUsers(t *testing.T) error {
+	t.Helper()
+	plan, err := PlanUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plan.Apply()
+}
+
+func TestPlanUsersCreatesAndRemoves(t *testing.T) {
+	calls, _ := useUserFiles(t, testPasswd)
+	t.Setenv("SUDO_USER", "")
+	declareUsers(map[string]interface{}{"name": "alice", "uid": 2001, "groups": []string{"ops"}})
+
+	if err := applyUsers(t); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"useradd --create-home --user-group --shell /bin/bash --uid 2001 --groups ops alice"}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Errorf("ran %q, want %q", *calls, want)
+	}
+	if got := loadCreatedUsers(); !reflect.DeepEqual(got, []string{"alice"}) {
+		t.Fatalf("created users = %q", got)
+	}
+
+	// alice now exists; dropping her declaration removes the account.
+	os.WriteFile(passwdFile, []byte(testPasswd+"alice:x:2001:2001::/home/alice:/bin/bash\n"), 0644)
+	*calls = nil
+	declareUsers()
+	if err := applyUsers(t); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"userdel alice"}; !reflect.DeepEqual(*calls, want) {
+		t.Errorf("ran %q, want %q", *calls, want)
+	}
+	if got := loadCreatedUsers(); len(got) != 0 {
+		t.Errorf("created users after userdel = %q", got)
+	}
+}
+
+// An account that existed before the step is adjusted while declared and
+// left alone once it is not.
+func TestPlanUsersKeepsPreexistingAccounts(t *testing.T) {
+	calls, _ := useUserFiles(t, testPasswd)
+	declareUsers(map[string]interface{}{"name": "ubuntu", "groups": []string{"ops", "sudo"}})
+
+	if err := applyUsers(t); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"usermod --groups ops,sudo ubuntu"}; !reflect.DeepEqual(*calls, want) {
+		t.Errorf("ran %q, want %q", *calls, want)
+	}
+	if got := loadCreatedUsers(); len(got) != 0 {
+		t.Errorf("created users = %q, want none", got)
+	}
+
+	*calls = nil
+	declareUsers()
+	plan, err := PlanUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 {
+		t.Errorf("undeclaring ubuntu planned %+v", plan.Changes)
+	}
+}
+
+func TestPlanUsersProtectsSudoUser(t *testing.T) {
+	useUserFiles(t, testPasswd+"alice:x:2001:2001::/home/alice:/bin/bash\n")
+	saveCreatedUsers([]string{"alice"})
+	t.Setenv("SUDO_USER", "alice")
+	declareUsers()
+
+	plan, err := PlanUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 {
+		t.Errorf("planned %+v for the operator's own account", plan.Changes)
+	}
+	if want := []string{"alice is no longer declared but will not be removed"}; !reflect.DeepEqual(plan.Notes, want) {
+		t.Errorf("notes = %q, want %q", plan.Notes, want)
+	}
+}
+
+// A run that fails after useradd still records the account, so a later
+// undeclaration removes it.
+func TestPlanUsersRecordsCreatedOnFailure(t *testing.T) {
+	calls, fail := useUserFiles(t, testPasswd)
+	*fail = "usermod --expiredate"
+	declareUsers(map[string]interface{}{"name": "bob", "locked": true})
+
+	if err := applyUsers(t); err == nil {
+		t.Fatal("expected the usermod failure")
+	}
+	if len(*calls) != 2 {
+		t.Errorf("ran %q", *calls)
+	}
+	if got := loadCreatedUsers(); !reflect.DeepEqual(got, []string{"bob"}) {
+		t.Errorf("created users = %q, want bob", got)
+	}
+}
+
+func TestSudoersChange(t *testing.T) {
+	useUserFiles(t, testPasswd)
+
+	c, err := sudoersChange(LocalUser{Name: "alice", Sudo: []string{"ALL=(ALL) NOPASSWD: ALL", "ALL=(root) /usr/bin/systemctl"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Target != filepath.Join(sudoersDir, "infra-agent-alice") {
+		t.Errorf("target = %s", c.Target)
+	}
+	for _, line := range []string{"+alice ALL=(ALL) NOPASSWD: ALL", "+alice ALL=(root) /usr/bin/systemctl"} {
+		if !strings.Contains(c.Diff, line) {
+			t.Errorf("diff lacks %q:\n%s", line, c.Diff)
+		}
+	}
+
+	if c, err := sudoersChange(LocalUser{Name: "alice"}); c != nil || err != nil {
+		t.Errorf("no sudo rules: %+v, %v", c, err)
+	}
+	if _, err := sudoersChange(LocalUser{Name: "a.b", Sudo: []string{"ALL=(ALL) ALL"}}); err == nil {
+		t.Error("accepted a user name sudo would skip")
+	}
+	if _, err := sudoersChange(LocalUser{Name: "alice", Sudo: []string{"ALL=(ALL) ALL\nbob ALL=(ALL) ALL"}}); err == nil {
+		t.Error("accepted a multi-line rule")
+	}
+}
+
+func TestPlanUsersRemovesStaleSudoers(t *testing.T) {
+	useUserFiles(t, testPasswd)
+	stale := filepath.Join(sudoersDir, "infra-agent-carol")
+	os.WriteFile(stale, []byte("carol ALL=(ALL) ALL\n"), 0440)
+	declareUsers(map[string]interface{}{"name": "ubuntu", "groups": []string{"sudo"}})
+
+	plan, err := PlanUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var targets []string
+	for _, c := range plan.Changes {
+		targets = append(targets, c.Target)
+	}
+	if !reflect.DeepEqual(targets, []string{stale}) {
+		t.Fatalf("changes = %q, want the stale drop-in removed", targets)
+	}
+	if err := plan.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale drop-in still there: %v", err)
+	}
+}
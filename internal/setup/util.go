@@ -0,0 +1,114 @@
+package setup
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/uverustech/infra-agent/internal/config"
+	"github.com/uverustech/infra-agent/internal/timedexec"
+)
+
+// WriteFileAtomic writes data to a temp file next to path, syncs it and
+// renames it into place, so readers never see a partially written file, even
+// after a crash.
+func WriteFileAtomic(path string, data []byte, mode fs.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// fileChange returns a change that writes content to path, or nil if the file
+// already has exactly that content.
+func fileChange(path string, content []byte, mode fs.FileMode) *Change {
+	existing, err := os.ReadFile(path)
+	if err == nil && bytes.Equal(existing, content) {
+		return nil
+	}
+	verb := "create"
+	if err == nil {
+		verb = "update"
+	}
+	diff := "(binary content)"
+	if utf8.Valid(existing) && utf8.Valid(content) {
+		diff = unifiedDiff(path, string(existing), string(content))
+	}
+	return &Change{
+		Kind:        ChangeFile,
+		Target:      path,
+		Description: fmt.Sprintf("%s %s", verb, path),
+		Diff:        diff,
+		apply: func() error {
+			return WriteFileAtomic(path, content, mode)
+		},
+	}
+}
+
+// commandChange returns a change that runs a command.
+func commandChange(name string, args ...string) *Change {
+	line := strings.TrimSpace(name + " " + strings.Join(args, " "))
+	return &Change{
+		Kind:        ChangeCommand,
+		Target:      line,
+		Description: "run " + line,
+		apply: func() error {
+			return runCommand(name, args...)
+		},
+	}
+}
+
+// runCommand runs a command and includes its output in the error on failure.
+// It is a variable so tests can record commands instead of running them.
+var runCommand = func(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v\n%s", name, err, string(out))
+	}
+	return nil
+}
+
+// runTimed is runCommand under command-timeout, for the commands the agent
+// also runs unattended (SSH reconcile, heartbeat).
+func runTimed(name string, args ...string) error {
+	out, err := timedexec.Command(config.KeyTimeoutCommand, name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v\n%s", name, err, string(out))
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package setup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conf.d", "infra-agent.conf")
+
+	c := fileChange(path, []byte("a = 1\n"), 0640)
+	if c == nil || c.Kind != ChangeFile || c.Description != "create "+path || !strings.Contains(c.Diff, "+a = 1") {
+		t.Fatalf("create = %+v", c)
+	}
+	if err := c.apply(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("written file: %v, %v", info, err)
+	}
+
+	if c := fileChange(path, []byte("a = 1\n"), 0640); c != nil {
+		t.Errorf("same content planned %+v", c)
+	}
+
+	c = fileChange(path, []byte("a = 2\n"), 0640)
+	if c == nil || c.Description != "update "+path || !strings.Contains(c.Diff, "-a = 1\n+a = 2") {
+		t.Errorf("update = %+v", c)
+	}
+	if c := fileChange(path, []byte{0xff, 0xfe}, 0640); c == nil || c.Diff != "(binary content)" {
+		t.Errorf("binary = %+v", c)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	os.WriteFile(path, []byte("old"), 0644)
+
+	if err := WriteFileAtomic(path, []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "new" {
+		t.Errorf("content = %q", data)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want 0600", info.Mode().Perm())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temp files left: %v", entries)
+	}
+}
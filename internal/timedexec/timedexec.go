@@ -0,0 +1,103 @@
+// Package timedexec runs external commands under the deadlines configured in
+// the *-timeout options, so a hung git remote or systemctl call cannot stall
+// the agent until the watchdog kills it.
+package timedexec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/uverustech/infra-agent/internal/config"
+)
+
+// TimeoutError is returned when an external command or HTTP call exceeds its
+// deadline. It is reported as such in last_error, so a hung git remote is
+// distinguishable from a failing one.
+type TimeoutError struct {
+	Op    string
+	After time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s", e.Op, e.After)
+}
+
+// IsTimeout reports whether err is a TimeoutError or a network timeout.
+func IsTimeout(err error) bool {
+	var te *TimeoutError
+	if errors.As(err, &te) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// Cmd is an exec.Cmd that is killed when the timeout configured under its
+// key runs out.
+type Cmd struct {
+	*exec.Cmd
+	op      string
+	timeout time.Duration
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// Command prepares name with args under the timeout configured at
+// timeoutKey (one of the config.KeyTimeout* keys).
+func Command(timeoutKey, name string, args ...string) *Cmd {
+	return CommandTimeout(config.GetDuration(timeoutKey), name, args...)
+}
+
+// CommandTimeout prepares name with args under an explicit timeout, for
+// callers that cut the configured one short.
+func CommandTimeout(timeout time.Duration, name string, args ...string) *Cmd {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	cmd := exec.CommandContext(ctx, name, args...)
+	// Do not wait forever on pipes held open by grandchildren (ssh for git).
+	cmd.WaitDelay = 5 * time.Second
+	return &Cmd{Cmd: cmd, op: label(name, args), timeout: timeout, ctx: ctx, cancel: cancel}
+}
+
+func (c *Cmd) Run() error {
+	defer c.cancel()
+	return c.wrap(c.Cmd.Run())
+}
+
+func (c *Cmd) Output() ([]byte, error) {
+	defer c.cancel()
+	out, err := c.Cmd.Output()
+	return out, c.wrap(err)
+}
+
+func (c *Cmd) CombinedOutput() ([]byte, error) {
+	defer c.cancel()
+	out, err := c.Cmd.CombinedOutput()
+	return out, c.wrap(err)
+}
+
+func (c *Cmd) wrap(err error) error {
+	if err != nil && errors.Is(c.ctx.Err(), context.DeadlineExceeded) {
+		return &TimeoutError{Op: c.op, After: c.timeout}
+	}
+	return err
+}
+
+// label names a command by its program and subcommand, e.g. "git fetch" for
+// git -C dir fetch --quiet origin.
+func label(name string, args []string) string {
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "-C" || args[i] == "-c":
+			i++
+		case strings.HasPrefix(args[i], "-"):
+		default:
+			return name + " " + args[i]
+		}
+	}
+	return name
+}